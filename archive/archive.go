@@ -0,0 +1,210 @@
+package archive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	snapshotPrefix = "ibdiagnet2-"
+	snapshotSuffix = ".tgz"
+	timeLayout     = "20060102T150405Z"
+)
+
+// Archive keeps timestamped, compressed copies of ibdiagnet2 output
+// directories in Dir. Zero limits disable the corresponding retention rule.
+type Archive struct {
+	Dir      string
+	MaxCount int
+	MaxAge   time.Duration
+	MaxSize  int64
+}
+
+type Snapshot struct {
+	Path string
+	Time time.Time
+	Size int64
+}
+
+// Save compresses srcDir into a snapshot named after runTime, the time the
+// ibdiagnet run was taken, and applies the retention rules.
+func (a *Archive) Save(srcDir string, runTime time.Time) (string, error) {
+	if err := os.MkdirAll(a.Dir, 0755); err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("%s%s%s", snapshotPrefix, runTime.UTC().Format(timeLayout), snapshotSuffix)
+	snapshotPath := filepath.Join(a.Dir, name)
+	tmpFile, err := os.CreateTemp(a.Dir, name+".tmp*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpFile.Name())
+	if err := writeTgz(tmpFile, srcDir); err != nil {
+		tmpFile.Close()
+		return "", err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmpFile.Name(), snapshotPath); err != nil {
+		return "", err
+	}
+	return snapshotPath, a.Prune(time.Now())
+}
+
+// List returns the snapshots in the archive, oldest first.
+func (a *Archive) List() ([]Snapshot, error) {
+	entries, err := os.ReadDir(a.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []Snapshot
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, snapshotPrefix) || !strings.HasSuffix(name, snapshotSuffix) {
+			continue
+		}
+		snapshotTime, err := time.Parse(timeLayout, strings.TrimSuffix(strings.TrimPrefix(name, snapshotPrefix), snapshotSuffix))
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, Snapshot{
+			Path: filepath.Join(a.Dir, name),
+			Time: snapshotTime,
+			Size: info.Size(),
+		})
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Time.Before(snapshots[j].Time)
+	})
+	return snapshots, nil
+}
+
+// Prune removes the oldest snapshots until every retention rule holds.
+func (a *Archive) Prune(now time.Time) error {
+	snapshots, err := a.List()
+	if err != nil {
+		return err
+	}
+	var totalSize int64
+	for _, snapshot := range snapshots {
+		totalSize += snapshot.Size
+	}
+	for len(snapshots) > 0 {
+		oldest := snapshots[0]
+		expired := a.MaxAge > 0 && now.Sub(oldest.Time) > a.MaxAge
+		tooMany := a.MaxCount > 0 && len(snapshots) > a.MaxCount
+		tooLarge := a.MaxSize > 0 && totalSize > a.MaxSize
+		if !expired && !tooMany && !tooLarge {
+			break
+		}
+		if err := os.Remove(oldest.Path); err != nil {
+			return err
+		}
+		totalSize -= oldest.Size
+		snapshots = snapshots[1:]
+	}
+	return nil
+}
+
+// Extract unpacks a snapshot, or any ibdiagnet2 tarball, into dstDir.
+func Extract(snapshotPath string, dstDir string) error {
+	file, err := os.Open(snapshotPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer gzipReader.Close()
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dstDir, filepath.Clean("/"+header.Name))
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, tarReader); err != nil {
+				out.Close()
+				return err
+			}
+			if err := out.Close(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// writeTgz writes the regular files of srcDir under an ibdiagnet2/ prefix,
+// the layout of the tarball ibdiagnet uploads in local mode.
+func writeTgz(w io.Writer, srcDir string) error {
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
+	err := filepath.WalkDir(srcDir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		relPath, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(filepath.Join("ibdiagnet2", relPath))
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tarWriter, file)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+	return gzipWriter.Close()
+}
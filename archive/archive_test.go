@@ -0,0 +1,176 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testDataDir = "../data/ibdiagnet2"
+
+// writeTarball writes a tarball of entries, the regular files holding their
+// own name.
+func writeTarball(t *testing.T, path string, entries []tar.Header) {
+	t.Helper()
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, header := range entries {
+		content := []byte(header.Name)
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(content))
+		}
+		header.Mode = 0644
+		if err := tarWriter.WriteHeader(&header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			if _, err := tarWriter.Write(content); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtract(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		target string
+	}{
+		{"ibdiagnet2/ibdiagnet2.pm", "ibdiagnet2/ibdiagnet2.pm"},
+		{"./ibdiagnet2/ibdiagnet2.lst", "ibdiagnet2/ibdiagnet2.lst"},
+		{"../escape", "escape"},
+		{"ibdiagnet2/../../../escape2", "escape2"},
+		{"/etc/absolute", "etc/absolute"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			snapshotPath := filepath.Join(root, "ib.tgz")
+			writeTarball(t, snapshotPath, []tar.Header{{Name: test.name, Typeflag: tar.TypeReg}})
+			dstDir := filepath.Join(root, "a", "b")
+			if err := Extract(snapshotPath, dstDir); err != nil {
+				t.Fatal(err)
+			}
+			content, err := os.ReadFile(filepath.Join(dstDir, test.target))
+			if err != nil {
+				t.Fatalf("%s not extracted to %s: %s", test.name, test.target, err)
+			}
+			if string(content) != test.name {
+				t.Errorf("content %q, expected %q", content, test.name)
+			}
+			// Nothing lands outside dstDir.
+			for _, outside := range []string{"escape", "escape2", "a/escape", "a/escape2"} {
+				if _, err := os.Stat(filepath.Join(root, outside)); err == nil {
+					t.Errorf("%s extracted outside of %s", outside, dstDir)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractSkipsLinks(t *testing.T) {
+	root := t.TempDir()
+	snapshotPath := filepath.Join(root, "ib.tgz")
+	writeTarball(t, snapshotPath, []tar.Header{
+		{Name: "ibdiagnet2/", Typeflag: tar.TypeDir},
+		{Name: "ibdiagnet2/passwd", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"},
+		{Name: "ibdiagnet2/hosts", Typeflag: tar.TypeLink, Linkname: "../../etc/hosts"},
+	})
+	dstDir := filepath.Join(root, "dst")
+	if err := Extract(snapshotPath, dstDir); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(filepath.Join(dstDir, "ibdiagnet2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("links extracted: %v", entries)
+	}
+}
+
+func TestSaveExtract(t *testing.T) {
+	archive := &Archive{Dir: t.TempDir()}
+	runTime := time.Date(2025, 3, 31, 23, 43, 18, 0, time.UTC)
+	snapshotPath, err := archive.Save(testDataDir, runTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(snapshotPath) != "ibdiagnet2-20250331T234318Z.tgz" {
+		t.Errorf("snapshot named %s", filepath.Base(snapshotPath))
+	}
+	dstDir := t.TempDir()
+	if err := Extract(snapshotPath, dstDir); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"ibdiagnet2.db_csv", "ibdiagnet2.pm", "ibdiagnet2.net_dump"} {
+		expected, err := os.ReadFile(filepath.Join(testDataDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := os.ReadFile(filepath.Join(dstDir, "ibdiagnet2", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(content, expected) {
+			t.Errorf("%s differs once extracted", name)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	now := time.Date(2025, 4, 1, 12, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		name    string
+		archive Archive
+		kept    int
+	}{
+		{"no limit", Archive{}, 4},
+		{"max count", Archive{MaxCount: 3}, 3},
+		{"max age", Archive{MaxAge: 150 * time.Minute}, 2},
+		{"max size", Archive{MaxSize: 25}, 2},
+		{"strictest wins", Archive{MaxCount: 3, MaxAge: 90 * time.Minute}, 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.archive.Dir = t.TempDir()
+			// Four 10 byte snapshots taken one hour apart, and a file that
+			// is not one.
+			for i := 1; i <= 4; i++ {
+				name := snapshotPrefix + now.Add(-time.Duration(i)*time.Hour).Format(timeLayout) + snapshotSuffix
+				if err := os.WriteFile(filepath.Join(test.archive.Dir, name), make([]byte, 10), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.WriteFile(filepath.Join(test.archive.Dir, "notes.txt"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := test.archive.Prune(now); err != nil {
+				t.Fatal(err)
+			}
+			snapshots, err := test.archive.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(snapshots) != test.kept {
+				t.Fatalf("%d snapshots kept, expected %d", len(snapshots), test.kept)
+			}
+			// The newest ones are kept.
+			if last := snapshots[len(snapshots)-1]; !last.Time.Equal(now.Add(-time.Hour)) {
+				t.Errorf("newest snapshot %s pruned", now.Add(-time.Hour))
+			}
+		})
+	}
+}
@@ -0,0 +1,326 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"infiniband_exporter/global"
+	"infiniband_exporter/ibdiagnet2"
+	iblog "infiniband_exporter/log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	apiDefaultLimit = 100
+	apiMaxLimit     = 1000
+)
+
+var (
+	// fabricLock guards fabric, the state of the last collection served on
+	// /api/v1.
+	fabricLock sync.RWMutex
+	fabric     *ibdiagnet2.Fabric
+)
+
+// apiLink is a port along with the port it is cabled to. Every link is
+// listed once from each of its ends.
+type apiLink struct {
+	*ibdiagnet2.FabricPort
+	PeerName string `json:"peerName,omitempty"`
+}
+
+// apiPort is a link along with the pm counters of its port.
+type apiPort struct {
+	apiLink
+	Counters map[string]float64 `json:"counters"`
+}
+
+type apiSwitch struct {
+	*ibdiagnet2.FabricNode
+	Ports       int `json:"ports"`
+	ActivePorts int `json:"activePorts"`
+}
+
+type apiPage struct {
+	RunTime time.Time `json:"runTime"`
+	Total   int       `json:"total"`
+	Offset  int       `json:"offset"`
+	Limit   int       `json:"limit"`
+	Items   []any     `json:"items"`
+}
+
+// handleApi registers the /api/v1 endpoints.
+func handleApi() {
+	http.HandleFunc("GET /api/v1/nodes", apiNodesHandler)
+	http.HandleFunc("GET /api/v1/switches", apiSwitchesHandler)
+	http.HandleFunc("GET /api/v1/links", apiLinksHandler)
+	http.HandleFunc("GET /api/v1/ports/{guid}/{port}", apiPortHandler)
+}
+
+// updateFabric builds the fabric of context for /api/v1 from what its
+// collectors parsed, so that the API answers from the collection /metrics
+// serves.
+func updateFabric(context *ibdiagnet2.CollectorContext) {
+	if !context.Fabric {
+		return
+	}
+	loaded, err := ibdiagnet2.BuildFabric(context)
+	if err != nil {
+		iblog.GetLogger().Error(fmt.Sprintf("Load fabric error, the API keeps the previous one: %s", err))
+		return
+	}
+	fabricLock.Lock()
+	fabric = loaded
+	fabricLock.Unlock()
+}
+
+// getFabric returns the fabric of the last collection, answering 503 while
+// there is none yet.
+func getFabric(w http.ResponseWriter) *ibdiagnet2.Fabric {
+	fabricLock.RLock()
+	defer fabricLock.RUnlock()
+	if fabric == nil {
+		writeApiError(w, http.StatusServiceUnavailable, "no collection yet, scrape /metrics first")
+	}
+	return fabric
+}
+
+// apiNodesHandler lists the switches and CAs.
+func apiNodesHandler(w http.ResponseWriter, r *http.Request) {
+	current := getFabric(w)
+	if current == nil {
+		return
+	}
+	var items []any
+	for _, node := range sortedNodes(current) {
+		items = append(items, node)
+	}
+	writeApiPage(w, r, current, items, ibdiagnet2.FabricNode{})
+}
+
+// apiSwitchesHandler lists the switches with their port counts.
+func apiSwitchesHandler(w http.ResponseWriter, r *http.Request) {
+	current := getFabric(w)
+	if current == nil {
+		return
+	}
+	ports := make(map[string]int)
+	activePorts := make(map[string]int)
+	for _, port := range current.Ports {
+		ports[port.Guid]++
+		if port.State == "ACT" {
+			activePorts[port.Guid]++
+		}
+	}
+	var items []any
+	for _, node := range sortedNodes(current) {
+		if node.Component == global.ComponentSw {
+			items = append(items, apiSwitch{node, ports[node.Guid], activePorts[node.Guid]})
+		}
+	}
+	writeApiPage(w, r, current, items, apiSwitch{})
+}
+
+// apiLinksHandler lists every port with its peer, e.g. ?state=DOWN for the
+// down ports or ?name=LEAF03&port=17 for what LEAF03 port 17 is cabled to.
+func apiLinksHandler(w http.ResponseWriter, r *http.Request) {
+	current := getFabric(w)
+	if current == nil {
+		return
+	}
+	keys := make([]string, 0, len(current.Ports))
+	for key := range current.Ports {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return comparePorts(current.Ports[keys[i]], current.Ports[keys[j]])
+	})
+	var items []any
+	for _, key := range keys {
+		items = append(items, newApiLink(current, current.Ports[key]))
+	}
+	writeApiPage(w, r, current, items, apiLink{})
+}
+
+// apiPortHandler serves one port with its peer and pm counters. The GUID may
+// be given without its 0x prefix.
+func apiPortHandler(w http.ResponseWriter, r *http.Request) {
+	current := getFabric(w)
+	if current == nil {
+		return
+	}
+	guid := strings.ToLower(r.PathValue("guid"))
+	if !strings.HasPrefix(guid, "0x") {
+		guid = "0x" + guid
+	}
+	key := fmt.Sprintf("%s_%s", guid, r.PathValue("port"))
+	port, exists := current.Ports[key]
+	if !exists {
+		writeApiError(w, http.StatusNotFound, fmt.Sprintf("port %s %s not found", guid, r.PathValue("port")))
+		return
+	}
+	counters := current.Counters[key]
+	if counters == nil {
+		counters = make(map[string]float64)
+	}
+	writeApiJSON(w, http.StatusOK, apiPort{newApiLink(current, port), counters})
+}
+
+func newApiLink(current *ibdiagnet2.Fabric, port *ibdiagnet2.FabricPort) apiLink {
+	link := apiLink{FabricPort: port}
+	if peer, exists := current.Nodes[port.PeerGuid]; exists {
+		link.PeerName = peer.Name
+	}
+	return link
+}
+
+func sortedNodes(current *ibdiagnet2.Fabric) []*ibdiagnet2.FabricNode {
+	nodes := make([]*ibdiagnet2.FabricNode, 0, len(current.Nodes))
+	for _, node := range current.Nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Guid < nodes[j].Guid
+	})
+	return nodes
+}
+
+// comparePorts orders ports by GUID, then by port number.
+func comparePorts(a, b *ibdiagnet2.FabricPort) bool {
+	if a.Guid != b.Guid {
+		return a.Guid < b.Guid
+	}
+	aPort, aErr := strconv.Atoi(a.Port)
+	bPort, bErr := strconv.Atoi(b.Port)
+	if aErr != nil || bErr != nil {
+		return a.Port < b.Port
+	}
+	return aPort < bPort
+}
+
+// writeApiPage writes the items matching the query filters, one per JSON
+// field of itemType, e.g. ?state=DOWN, with a comma separating the values
+// any of which matches. limit and offset page through them.
+func writeApiPage(w http.ResponseWriter, r *http.Request, current *ibdiagnet2.Fabric, items []any, itemType any) {
+	query := r.URL.Query()
+	page := apiPage{RunTime: current.RunTime, Limit: apiDefaultLimit, Items: []any{}}
+	for _, param := range []struct {
+		name  string
+		value *int
+		max   int
+	}{
+		{"limit", &page.Limit, apiMaxLimit},
+		{"offset", &page.Offset, -1},
+	} {
+		if !query.Has(param.name) {
+			continue
+		}
+		value, err := strconv.Atoi(query.Get(param.name))
+		if err != nil || value < 0 {
+			writeApiError(w, http.StatusBadRequest, fmt.Sprintf("%s: %q is not a non negative number", param.name, query.Get(param.name)))
+			return
+		}
+		if param.max >= 0 && value > param.max {
+			writeApiError(w, http.StatusBadRequest, fmt.Sprintf("%s: %d is above %d", param.name, value, param.max))
+			return
+		}
+		*param.value = value
+	}
+	fields := jsonFields(reflect.TypeOf(itemType))
+	filters := make(map[string][]string)
+	for name, values := range query {
+		if name == "limit" || name == "offset" {
+			continue
+		}
+		if !fields[name] {
+			writeApiError(w, http.StatusBadRequest, fmt.Sprintf("unknown filter %s", name))
+			return
+		}
+		for _, value := range values {
+			filters[name] = append(filters[name], strings.Split(value, ",")...)
+		}
+	}
+	var matched []any
+	for _, item := range items {
+		if matchFilters(item, filters) {
+			matched = append(matched, item)
+		}
+	}
+	page.Total = len(matched)
+	if page.Offset < len(matched) {
+		page.Items = append(page.Items, matched[page.Offset:min(page.Offset+page.Limit, len(matched))]...)
+	}
+	writeApiJSON(w, http.StatusOK, page)
+}
+
+// matchFilters tells whether every filtered JSON field of item holds one of
+// the filter values.
+func matchFilters(item any, filters map[string][]string) bool {
+	if len(filters) == 0 {
+		return true
+	}
+	content, err := json.Marshal(item)
+	if err != nil {
+		return false
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(content, &fields); err != nil {
+		return false
+	}
+	for name, values := range filters {
+		value, exists := fields[name]
+		if !exists {
+			return false
+		}
+		matched := false
+		for _, filterValue := range values {
+			if fmt.Sprint(value) == filterValue {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// jsonFields returns the JSON field names of t, including the ones of its
+// embedded structs.
+func jsonFields(t reflect.Type) map[string]bool {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	fields := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous {
+			for name := range jsonFields(field.Type) {
+				fields[name] = true
+			}
+			continue
+		}
+		if name := strings.Split(field.Tag.Get("json"), ",")[0]; name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}
+
+func writeApiError(w http.ResponseWriter, status int, message string) {
+	writeApiJSON(w, status, map[string]string{"error": message})
+}
+
+func writeApiJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		iblog.GetLogger().Error(fmt.Sprintf("Write API response error: %s", err))
+	}
+}
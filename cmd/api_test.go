@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"encoding/json"
+	"infiniband_exporter/ibdiagnet2"
+	iblog "infiniband_exporter/log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	iblog.InitNopLogger()
+	os.Exit(m.Run())
+}
+
+// loadTestFabric serves the sample run on /api/v1.
+func loadTestFabric(t *testing.T) *ibdiagnet2.Fabric {
+	t.Helper()
+	loaded, err := ibdiagnet2.LoadFabric("../data/ibdiagnet2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fabricLock.Lock()
+	fabric = loaded
+	fabricLock.Unlock()
+	t.Cleanup(func() {
+		fabricLock.Lock()
+		fabric = nil
+		fabricLock.Unlock()
+	})
+	return loaded
+}
+
+func TestWriteApiPage(t *testing.T) {
+	current := loadTestFabric(t)
+	var switches, downPorts int
+	for _, node := range current.Nodes {
+		if node.Component == "sw" {
+			switches++
+		}
+	}
+	for _, port := range current.Ports {
+		if port.State == "DOWN" {
+			downPorts++
+		}
+	}
+	for _, test := range []struct {
+		name    string
+		handler http.HandlerFunc
+		query   string
+		status  int
+		total   int
+		items   int
+		offset  int
+		error   string
+	}{
+		{"default limit", apiLinksHandler, "", http.StatusOK, len(current.Ports), apiDefaultLimit, 0, ""},
+		{"limit", apiNodesHandler, "?limit=5", http.StatusOK, len(current.Nodes), 5, 0, ""},
+		{"offset", apiNodesHandler, "?limit=10&offset=" + strconv.Itoa(len(current.Nodes)-3), http.StatusOK, len(current.Nodes), 3, len(current.Nodes) - 3, ""},
+		{"offset past the end", apiNodesHandler, "?offset=100000", http.StatusOK, len(current.Nodes), 0, 100000, ""},
+		{"limit 0", apiNodesHandler, "?limit=0", http.StatusOK, len(current.Nodes), 0, 0, ""},
+		{"filter", apiLinksHandler, "?state=DOWN&limit=1000", http.StatusOK, downPorts, downPorts, 0, ""},
+		{"filter any of", apiSwitchesHandler, "?component=sw,ca", http.StatusOK, switches, switches, 0, ""},
+		{"filter no match", apiNodesHandler, "?name=nowhere", http.StatusOK, 0, 0, 0, ""},
+		{"limit not a number", apiNodesHandler, "?limit=ten", http.StatusBadRequest, 0, 0, 0, `limit: "ten" is not a non negative number`},
+		{"negative offset", apiNodesHandler, "?offset=-1", http.StatusBadRequest, 0, 0, 0, `offset: "-1" is not a non negative number`},
+		{"limit above max", apiNodesHandler, "?limit=1001", http.StatusBadRequest, 0, 0, 0, "limit: 1001 is above 1000"},
+		{"unknown filter", apiNodesHandler, "?firmwre=31.2012.1024", http.StatusBadRequest, 0, 0, 0, "unknown filter firmwre"},
+		{"filter of another item", apiNodesHandler, "?activePorts=8", http.StatusBadRequest, 0, 0, 0, "unknown filter activePorts"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			test.handler(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/test"+test.query, nil))
+			if recorder.Code != test.status {
+				t.Fatalf("status %d, expected %d: %s", recorder.Code, test.status, recorder.Body)
+			}
+			if test.error != "" {
+				var body map[string]string
+				if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+					t.Fatal(err)
+				}
+				if body["error"] != test.error {
+					t.Errorf("error %q, expected %q", body["error"], test.error)
+				}
+				return
+			}
+			var page apiPage
+			if err := json.Unmarshal(recorder.Body.Bytes(), &page); err != nil {
+				t.Fatal(err)
+			}
+			if page.Total != test.total || len(page.Items) != test.items || page.Offset != test.offset {
+				t.Errorf("total %d items %d offset %d, expected %d %d %d", page.Total, len(page.Items), page.Offset, test.total, test.items, test.offset)
+			}
+			if !page.RunTime.Equal(current.RunTime) {
+				t.Errorf("runTime %s, expected %s", page.RunTime, current.RunTime)
+			}
+		})
+	}
+}
+
+func TestApiPortHandler(t *testing.T) {
+	loadTestFabric(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/ports/{guid}/{port}", apiPortHandler)
+	for _, test := range []struct {
+		path   string
+		status int
+	}{
+		{"/api/v1/ports/0xb0cf0e0300d33fc0/1", http.StatusOK},
+		{"/api/v1/ports/B0CF0E0300D33FC0/1", http.StatusOK},
+		{"/api/v1/ports/0xb0cf0e0300d33fc0/999", http.StatusNotFound},
+	} {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, test.path, nil))
+		if recorder.Code != test.status {
+			t.Errorf("%s: status %d, expected %d", test.path, recorder.Code, test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		var port struct {
+			Guid     string             `json:"guid"`
+			Counters map[string]float64 `json:"counters"`
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &port); err != nil {
+			t.Fatal(err)
+		}
+		if port.Guid != "0xb0cf0e0300d33fc0" || port.Counters["port_xmit_data_extended"] != 0x00000045a9712343 {
+			t.Errorf("%s: unexpected port %+v", test.path, port)
+		}
+	}
+}
+
+func TestApiNoCollection(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	apiNodesHandler(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/nodes", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d before any collection, expected 503", recorder.Code)
+	}
+}
+
+// TestUpdateFabricWithoutPm serves a run made with --skip pm, whose ports have
+// no counters.
+func TestUpdateFabricWithoutPm(t *testing.T) {
+	t.Cleanup(func() {
+		fabricLock.Lock()
+		fabric = nil
+		fabricLock.Unlock()
+	})
+	updateFabric(&ibdiagnet2.CollectorContext{DataDir: "../data/ibdiagnet2/infiniband-default", Fabric: true})
+	recorder := httptest.NewRecorder()
+	apiLinksHandler(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/links", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status %d, expected 200: %s", recorder.Code, recorder.Body)
+	}
+	var page apiPage
+	if err := json.Unmarshal(recorder.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Total == 0 {
+		t.Error("no link served")
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/ports/{guid}/{port}", apiPortHandler)
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/ports/0xb0cf0e0300d33fc0/1", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("port status %d, expected 200: %s", recorder.Code, recorder.Body)
+	}
+	var port struct {
+		State    string             `json:"state"`
+		Counters map[string]float64 `json:"counters"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &port); err != nil {
+		t.Fatal(err)
+	}
+	if port.State == "" || len(port.Counters) != 0 {
+		t.Errorf("unexpected port %+v", port)
+	}
+}
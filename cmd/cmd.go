@@ -2,55 +2,137 @@ package cmd
 
 import (
 	"fmt"
+	"infiniband_exporter/archive"
+	"infiniband_exporter/config"
 	"infiniband_exporter/ibdiagnet2"
 	iblog "infiniband_exporter/log"
+	"infiniband_exporter/store"
 	"infiniband_exporter/util"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
+	"github.com/spf13/pflag"
 )
 
 var (
-	LogPath   string
-	HttpPort  int
-	RunMode   string
-	WorkDir   string
-	GetConfig bool
-	IsMapName bool
-	SyncData  = new(ibdiagnet2.SyncSwitchData)
+	ConfigFile      string
+	LogPath         string
+	HttpPort        int
+	RunMode         string
+	WorkDir         string
+	GetConfig       bool
+	IsMapName       bool
+	PkeyPolicy      string
+	ArchiveEnabled  bool
+	ArchiveDir      string
+	ArchiveMaxCount int
+	ArchiveMaxAge   time.Duration
+	ArchiveMaxSize  int64
+	ReplaySpeed     float64
+	ReloadInterval  time.Duration
+	ApiEnabled      bool
+	Collectors      = config.Default().Collectors
+	Metrics         = config.Default().Metrics
+	SyncData        = new(ibdiagnet2.SyncSwitchData)
 )
 
+// legacyFlags maps the flags of the releases before the configuration file
+// to the keys they set.
+var legacyFlags = map[string]string{
+	"port":            "server.port",
+	"log":             "logging.file",
+	"isMapName":       "naming.mapName",
+	"pkeyPolicy":      "collectors.pkey.policy",
+	"archive":         "sources.archive.enabled",
+	"archiveDir":      "sources.archive.dir",
+	"archiveMaxCount": "sources.archive.maxCount",
+	"archiveMaxAge":   "sources.archive.maxAge",
+	"archiveMaxSize":  "sources.archive.maxSize",
+	"replaySpeed":     "sources.replay.speed",
+	"reloadInterval":  "server.reloadInterval",
+}
+
 func NewInfinibandExporterCommand() *cobra.Command {
+	var flagConfig *config.Config
 	var rootCmd = &cobra.Command{
-		Use:   "infiniband-exporter",
-		Short: "infiniband-exporter -p 9690 -l /var/log/infiniband-exporter.log",
-		Long:  `infiniband-exporter -port 9690 -log /var/log/infiniband-exporter.log`,
+		Use:          "infiniband-exporter",
+		Short:        "infiniband-exporter -p 9690 -l /var/log/infiniband-exporter.log",
+		Long:         `infiniband-exporter --config.file config/exporter.yaml --server.port 9690`,
+		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			HttpPort, _ = cmd.Flags().GetInt("port")
-			LogPath, _ = cmd.Flags().GetString("log")
-			RunMode, _ = cmd.Flags().GetString("mode")
-			WorkDir, _ = cmd.Flags().GetString("workDir")
-			GetConfig, _ = cmd.Flags().GetBool("getConfig")
-			IsMapName, _ = cmd.Flags().GetBool("isMapName")
-			err := iblog.InitLogger(LogPath)
+			ConfigFile = getConfigFile(cmd.Flags(), flagConfig)
+			rootFlags, rootFlagConfig = cmd.Flags(), flagConfig
+			exporterConfig, err := resolveConfig()
+			if err != nil {
+				return err
+			}
+			HttpPort = exporterConfig.Server.Port
+			LogPath = exporterConfig.Logging.File
+			RunMode = exporterConfig.Mode
+			WorkDir = exporterConfig.WorkDir
+			ArchiveEnabled = exporterConfig.Sources.Archive.Enabled
+			ArchiveDir = exporterConfig.Path(exporterConfig.Sources.Archive.Dir)
+			ArchiveMaxCount = exporterConfig.Sources.Archive.MaxCount
+			ArchiveMaxAge = exporterConfig.Sources.Archive.MaxAge
+			ArchiveMaxSize = exporterConfig.Sources.Archive.MaxSize
+			ReplaySpeed = exporterConfig.Sources.Replay.Speed
+			store.MaxAge = exporterConfig.State.MaxAge
+			ReloadInterval = exporterConfig.Server.ReloadInterval
+			ApiEnabled = exporterConfig.Server.API
+			err = iblog.InitLogger(LogPath)
 			if err != nil {
 				log.Fatalf("Failed to initialize logger: %v", err)
 			}
 			iblog.GetLogger().Info("Starting server......")
-			configPath := fmt.Sprintf("%s/config", WorkDir)
-			if !GetConfig {
-				util.SetCache(filepath.Join(configPath, "config.yaml"))
+			if ConfigFile != "" {
+				iblog.GetLogger().Info(fmt.Sprintf("Loaded config file %s", ConfigFile))
+			}
+			if err := reloadConfig(); err != nil {
+				iblog.GetLogger().Error(fmt.Sprintf("Load config error: %s", err))
+				return err
 			}
 			if RunMode == "local" {
-				SyncData = GetSyncSwitchDataConfig()
 				iblog.GetLogger().Info(fmt.Sprintf("SyncSwitchData: %v", SyncData))
 			}
+			go watchConfig(ReloadInterval)
+			statePath := filepath.Join(WorkDir, "data", "state.json")
+			if RunMode == "replay" {
+				// A replay keeps its own history so old runs never leak into
+				// the live state.
+				replayDir := filepath.Join(WorkDir, "data", "replay")
+				if err := os.MkdirAll(replayDir, 0755); err != nil {
+					return err
+				}
+				replay, err = newReplayer(getArchive(), replayDir, ReplaySpeed)
+				if err != nil {
+					return err
+				}
+				statePath = filepath.Join(replayDir, "state.json")
+				if err := os.Remove(statePath); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+				go replay.Run()
+			}
+			if err := store.Load(statePath); err != nil {
+				iblog.GetLogger().Error(fmt.Sprintf("Load state error, starting empty: %s", err))
+			}
+			if exporterConfig.Push.Interval > 0 {
+				go pushLoop(exporterConfig.Push.Interval)
+			}
 			http.Handle("/metrics", http.HandlerFunc(MetricsHandler))
+			http.Handle("/-/reload", http.HandlerFunc(ReloadHandler))
+			if ApiEnabled {
+				handleApi()
+			}
 			err = http.ListenAndServe(fmt.Sprintf("0.0.0.0:%d", HttpPort), nil)
 			if err != nil {
 				iblog.GetLogger().Error("http.ListenAndServe error")
@@ -60,127 +142,185 @@ func NewInfinibandExporterCommand() *cobra.Command {
 		},
 	}
 
-	rootCmd.Flags().StringVarP(
-		&LogPath,
-		"log",
-		"l",
-		"infiniband_exporter.log", "a string parameter",
-	)
-	rootCmd.Flags().IntVarP(
-		&HttpPort,
-		"port",
-		"p",
-		9690,
-		"an integer parameter",
-	)
-	rootCmd.Flags().StringVarP(
-		&RunMode,
-		"mode",
-		"m",
-		"dev",
-		"an string parameter[local|agent|dev]",
-	)
-	rootCmd.Flags().StringVarP(
-		&WorkDir,
-		"workDir",
-		"w",
-		"./",
-		"an string parameter",
+	rootCmd.Flags().SetNormalizeFunc(func(fs *pflag.FlagSet, name string) pflag.NormalizedName {
+		if key, exists := legacyFlags[name]; exists {
+			name = key
+		}
+		// node_exporter style --collector.<name>
+		if collector, found := strings.CutPrefix(name, "collector."); found {
+			name = fmt.Sprintf("collectors.%s.enabled", collector)
+		}
+		return pflag.NormalizedName(name)
+	})
+	flagConfig = config.AddFlags(rootCmd.Flags())
+	rootCmd.Flags().String(
+		"config.file",
+		"",
+		fmt.Sprintf("exporter configuration file, default <workDir>/config/default.yaml when it exists (env %s)",
+			config.EnvName("config.file")),
 	)
-	rootCmd.Flags().BoolVarP(
-		&GetConfig,
+	rootCmd.Flags().BoolP(
 		"getConfig",
 		"g",
 		false,
 		"an bool parameter",
 	)
-	rootCmd.Flags().BoolVarP(
-		&IsMapName,
-		"isMapName",
-		"i",
-		false,
-		"an bool parameter",
-	)
+	rootCmd.Flags().MarkDeprecated("getConfig", "start without a link map, --sources.linkMap=\"\"; write it with the config generate subcommand")
+	rootCmd.AddCommand(newDiffCommand())
+	rootCmd.AddCommand(newParseCommand())
+	rootCmd.AddCommand(newConfigCommand())
 	return rootCmd
 }
 
+// getConfigFile returns the configuration file named by --config.file or
+// its environment variable, else the legacy default.yaml of the work
+// directory when there is one.
+func getConfigFile(fs *pflag.FlagSet, flagConfig *config.Config) string {
+	if configFile, _ := fs.GetString("config.file"); configFile != "" {
+		return configFile
+	}
+	if configFile := os.Getenv(config.EnvName("config.file")); configFile != "" {
+		return configFile
+	}
+	workDir := config.Default().WorkDir
+	if value, exists := os.LookupEnv(config.EnvName("workDir")); exists {
+		workDir = value
+	}
+	if fs.Changed("workDir") {
+		workDir = flagConfig.WorkDir
+	}
+	legacyFile := filepath.Join(workDir, "config", "default.yaml")
+	if _, err := os.Stat(legacyFile); err == nil {
+		return legacyFile
+	}
+	return ""
+}
+
 func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	gatherer, err := gatherData()
+	if err != nil {
+		iblog.GetLogger().Error(err.Error())
+		return
+	}
+	reloadLock.RLock()
+	metrics, onScrape := Metrics, Push.OnScrape
+	reloadLock.RUnlock()
+	if onScrape {
+		// The scrape feeds the push targets the very snapshot it serves.
+		metricFamilies, _ := gatherer.Gather()
+		queuePush(metricFamilies, time.Now())
+	}
+	promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{
+		ErrorLog:                            promErrorLog{},
+		ErrorHandling:                       promhttp.ContinueOnError,
+		EnableOpenMetrics:                   metrics.OpenMetrics,
+		EnableOpenMetricsTextCreatedSamples: metrics.Created,
+	}).ServeHTTP(w, r)
+}
+
+// collectionLock serialises the collections of the scrapes and the push loop.
+var collectionLock sync.Mutex
+
+// gatherData runs one collection and returns what it gathered, which the
+// collectors are done reading the data directory for. Collections run one at
+// a time, collectData rewriting the data directory another one reads.
+func gatherData() (prometheus.Gatherer, error) {
+	collectionLock.Lock()
+	defer collectionLock.Unlock()
+	context, release, err := collectData()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	reloadLock.RLock()
+	metrics := Metrics
+	reloadLock.RUnlock()
+	var gatherer prometheus.Gatherer = newRegistry(context)
+	if RunMode == "replay" {
+		gatherer = replay.Stamp(gatherer)
+	} else if metrics.RunTimestamp {
+		gatherer = stampRunTime(gatherer, context.GetDbCsv())
+	}
+	metricFamilies, gatherErr := gatherer.Gather()
+	updateFabric(context)
+	if err := store.Save(); err != nil {
+		iblog.GetLogger().Error(fmt.Sprintf("Save state error: %s", err))
+	}
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return metricFamilies, gatherErr
+	}), nil
+}
+
+// collectData brings the ibdiagnet2 output of the run mode up to date and
+// returns the collector context reading it, whose db_csv every reader of the
+// collection shares. release must be called once the collectors have read
+// it.
+func collectData() (*ibdiagnet2.CollectorContext, func(), error) {
+	context := &ibdiagnet2.CollectorContext{DataDir: filepath.Join(WorkDir, "data", "ibdiagnet2")}
 	switch RunMode {
 	case "local":
-		if _, err := SyncData.SyncSwitchData(); err != nil {
-			iblog.GetLogger().Error(fmt.Sprintf("SyncSwitchData error: %s", err))
-			return
+		reloadLock.RLock()
+		syncData := SyncData
+		reloadLock.RUnlock()
+		if _, err := syncData.SyncSwitchData(); err != nil {
+			return nil, nil, fmt.Errorf("SyncSwitchData error: %s", err)
 		} else {
 			_, err := util.ExecCmd(
 				"tar", "-xzvf", fmt.Sprintf("%s/data/ib.tgz", WorkDir), "-C", fmt.Sprintf("%s/data", WorkDir),
 			)
 			if err != nil {
-				iblog.GetLogger().Error(fmt.Sprintf("tar zxvf  ib.tgz error: %s", err))
-				return
+				return nil, nil, fmt.Errorf("tar zxvf  ib.tgz error: %s", err)
 			}
 
 		}
+		archiveData(context)
 	case "agent":
 		_, err := util.ExecCmd(
 			"ibdiagnet",
 		)
 		if err != nil {
-			iblog.GetLogger().Error(fmt.Sprintf("ibdiagent exec error: %s", err))
-			return
+			return nil, nil, fmt.Errorf("ibdiagent exec error: %s", err)
 		}
 		_, err = util.ExecCmd(
 			"cp", "-Rf", "/var/tmp/ibdiagnet2", fmt.Sprintf("%s/data/", WorkDir),
 		)
 		if err != nil {
-			iblog.GetLogger().Error(fmt.Sprintf("ibdiagent exec error: %s", err))
-			return
+			return nil, nil, fmt.Errorf("ibdiagent exec error: %s", err)
 		}
+		archiveData(context)
+	case "replay":
+		replay.Advance()
+		replay.RLock()
+		return &ibdiagnet2.CollectorContext{DataDir: filepath.Join(replay.Dir, "ibdiagnet2")}, replay.RUnlock, nil
 	default:
 		iblog.GetLogger().Info("RunMode is dev, no need to sync data")
 	}
-	linkNetDump := ibdiagnet2.LinkNetDump{
-		FilePath: filepath.Join(
-			fmt.Sprintf("%s/data/ibdiagnet2", WorkDir),
-			"ibdiagnet2.net_dump",
-		),
-		ConfigPath: filepath.Join(
-			fmt.Sprintf("%s/config", WorkDir),
-			"config.yaml",
-		),
-		GetConfig: GetConfig,
-		IsMapName: IsMapName,
-	}
-	var dumper ibdiagnet2.Dumper = &linkNetDump
-	dumper.UpdateMetrics()
+	return context, func() {}, nil
+}
 
-	linkPm := ibdiagnet2.LinkPm{
-		FilePath: filepath.Join(
-			fmt.Sprintf("%s/data/ibdiagnet2", WorkDir),
-			"ibdiagnet2.pm",
-		),
+func getArchive() *archive.Archive {
+	return &archive.Archive{
+		Dir:      ArchiveDir,
+		MaxCount: ArchiveMaxCount,
+		MaxAge:   ArchiveMaxAge,
+		MaxSize:  ArchiveMaxSize,
 	}
-
-	var pmer ibdiagnet2.Pmer = &linkPm
-	pmer.UpdateMetrics()
-
-	promhttp.Handler().ServeHTTP(w, r)
 }
 
-func GetSyncSwitchDataConfig() *ibdiagnet2.SyncSwitchData {
-	type Config struct {
-		SyncDataConfig ibdiagnet2.SyncSwitchData `yaml:"syncDataConfig"`
-	}
-	viper.SetConfigName("default")
-	viper.SetConfigType("yaml")
-	viper.AddConfigPath(fmt.Sprintf("%s/config", WorkDir))
-	if err := viper.ReadInConfig(); err != nil {
-		iblog.GetLogger().Error(fmt.Sprintf("Error reading sync data config file, %s", err))
-		os.Exit(1)
-	}
-	var config Config
-	if err := viper.Unmarshal(&config); err != nil {
-		iblog.GetLogger().Error(fmt.Sprintf("Unable to decode into struct, %v", err))
-		os.Exit(1)
-	}
-	return &config.SyncDataConfig
+// archiveData keeps a copy of the collected ibdiagnet2 output when archiving
+// is enabled. A failure is logged but never fails the scrape.
+func archiveData(context *ibdiagnet2.CollectorContext) {
+	if !ArchiveEnabled {
+		return
+	}
+	runTime, err := ibdiagnet2.GetRunTime(context.GetDbCsv())
+	if err != nil {
+		runTime = time.Now()
+	}
+	snapshotPath, err := getArchive().Save(context.DataDir, runTime)
+	if err != nil {
+		iblog.GetLogger().Error(fmt.Sprintf("Archive ibdiagnet2 output error: %s", err))
+		return
+	}
+	iblog.GetLogger().Info(fmt.Sprintf("Archived ibdiagnet2 output to %s", snapshotPath))
 }
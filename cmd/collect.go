@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"fmt"
+	"infiniband_exporter/config"
+	"infiniband_exporter/ibdiagnet2"
+	iblog "infiniband_exporter/log"
+	"infiniband_exporter/util"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var collectorDurationDesc = prometheus.NewDesc(
+	"infiniband_exporter_collector_duration_seconds",
+	"Time the collector took to read the ibdiagnet2 output of the scrape",
+	[]string{"collector"},
+	nil,
+)
+
+// exporterCollector runs the enabled ibdiagnet2 collectors of one scrape one
+// after the other, in name order, timing each.
+type exporterCollector struct {
+	names      []string
+	collectors []ibdiagnet2.Collector
+}
+
+func (e *exporterCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, collector := range e.collectors {
+		collector.Describe(ch)
+	}
+	ch <- collectorDurationDesc
+}
+
+func (e *exporterCollector) Collect(ch chan<- prometheus.Metric) {
+	for i, collector := range e.collectors {
+		start := time.Now()
+		collector.Collect(ch)
+		ch <- prometheus.MustNewConstMetric(
+			collectorDurationDesc, prometheus.GaugeValue, time.Since(start).Seconds(), e.names[i],
+		)
+	}
+}
+
+// newRegistry returns a registry reading the ibdiagnet2 output of context,
+// set up from the running configuration, with every enabled collector, along
+// with the exporter's own metrics. It holds no Go runtime metrics, and a
+// registry per scrape keeps concurrent scrapes apart.
+func newRegistry(context *ibdiagnet2.CollectorContext) *prometheus.Registry {
+	reloadLock.RLock()
+	context.GetConfig = GetConfig
+	context.IsMapName = IsMapName
+	context.PkeyPolicy = PkeyPolicy
+	context.PmMode = Collectors.Pm.Mode
+	context.PmCounters = Collectors.Pm.Counters
+	context.PmSupported = Collectors.Pm.Supported
+	context.Created = Metrics.Created
+	context.Fabric = ApiEnabled
+	enabled := Collectors.Enabled()
+	reloadLock.RUnlock()
+	exporter := &exporterCollector{}
+	for _, name := range ibdiagnet2.CollectorNames() {
+		if !enabled[name] {
+			continue
+		}
+		collector, err := ibdiagnet2.NewCollector(name, context)
+		if err != nil {
+			iblog.GetLogger().Error(fmt.Sprintf("Collector %s error: %s", name, err))
+			continue
+		}
+		exporter.names = append(exporter.names, name)
+		exporter.collectors = append(exporter.collectors, collector)
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(exporter, lastReloadGauge, lastReloadTimeGauge, lastPushGauge, pushQueueGauge, pushDroppedCount)
+	return registry
+}
+
+// promErrorLog hands the errors of promhttp to the exporter log.
+type promErrorLog struct{}
+
+func (promErrorLog) Println(v ...interface{}) {
+	iblog.GetLogger().Error(fmt.Sprint(v...))
+}
+
+// checkCollectors checks the collector selection of the configuration loaded
+// from path against the registered collectors.
+func checkCollectors(path string, c *config.Config) error {
+	var problems []string
+	enabled := c.Collectors.Enabled()
+	for _, name := range ibdiagnet2.CollectorNames() {
+		if _, exists := enabled[name]; !exists {
+			problems = append(problems, fmt.Sprintf("collectors.%s: collector missing from the configuration", name))
+		}
+	}
+	switch c.Collectors.Pm.Mode {
+	case ibdiagnet2.PmModeKnown:
+		counters := ibdiagnet2.PmCounterNames()
+		for _, counter := range c.Collectors.Pm.Counters {
+			if !slices.Contains(counters, counter) {
+				problems = append(problems, fmt.Sprintf("collectors.pm.counters: unknown counter %q", counter))
+			}
+		}
+	case ibdiagnet2.PmModeAll:
+		// Any counter ibdiagnet writes can be kept.
+	default:
+		problems = append(problems, fmt.Sprintf("collectors.pm.mode: %q is not one of %s, %s",
+			c.Collectors.Pm.Mode, ibdiagnet2.PmModeKnown, ibdiagnet2.PmModeAll))
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	if path == "" {
+		path = "configuration"
+	}
+	return &config.ValidationError{Path: path, Problems: problems}
+}
+
+// stampRunTime wraps gatherer, stamping the fabric samples with the time
+// ibdiagnet ran, from the RUN_INFO of dbCsv, so that they land when they
+// were measured. The exporter's own metrics, and every sample when the run
+// time is unknown, keep the scrape time.
+func stampRunTime(gatherer prometheus.Gatherer, dbCsv *util.DbCsv) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		metricFamilies, err := gatherer.Gather()
+		runTime, runTimeErr := ibdiagnet2.GetRunTime(dbCsv)
+		if runTimeErr != nil {
+			iblog.GetLogger().Error(fmt.Sprintf("Get run time error: %s", runTimeErr))
+			return metricFamilies, err
+		}
+		timestampMs := runTime.UnixMilli()
+		for _, metricFamily := range metricFamilies {
+			if strings.HasPrefix(metricFamily.GetName(), "infiniband_exporter_") {
+				continue
+			}
+			for _, metric := range metricFamily.Metric {
+				metric.TimestampMs = &timestampMs
+			}
+		}
+		return metricFamilies, err
+	})
+}
@@ -0,0 +1,232 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"infiniband_exporter/config"
+	"infiniband_exporter/ibdiagnet2"
+	iblog "infiniband_exporter/log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+func newConfigCommand() *cobra.Command {
+	var configCmd = &cobra.Command{
+		Use:   "config",
+		Short: "Manage the exporter configuration and the link map",
+	}
+	configCmd.AddCommand(newConfigGenerateCommand())
+	configCmd.AddCommand(newConfigValidateCommand())
+	return configCmd
+}
+
+func newConfigValidateCommand() *cobra.Command {
+	var linkMapPath, pkeyPolicyPath string
+	flagConfig := new(config.Config)
+	var validateCmd = &cobra.Command{
+		Use:   "validate",
+		Short: "infiniband-exporter config validate --config.file config/exporter.yaml",
+		Long: `Check the exporter configuration, with the environment applied, and the link
+map and partition policy it references, printing every problem found. The
+configuration file is looked up as at startup, config/default.yaml of the
+work directory being used when there is one. Files left at their default
+path are skipped when missing. The exporter refuses to start with the same
+errors.`,
+		Args:          cobra.NoArgs,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := iblog.InitCliLogger(); err != nil {
+				return err
+			}
+			var failed bool
+			report := func(path string, err error) {
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					failed = true
+					return
+				}
+				fmt.Printf("%s: ok\n", path)
+			}
+			configPath := getConfigFile(cmd.Flags(), flagConfig)
+			exporterConfig, err := config.Resolve(configPath, cmd.Flags(), flagConfig)
+			if err == nil {
+				err = checkCollectors(configPath, exporterConfig)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return errors.New("invalid configuration")
+			}
+			if configPath != "" {
+				report(configPath, nil)
+			}
+			loaders := []struct {
+				path     string
+				explicit bool
+				load     func(string) error
+			}{
+				{
+					exporterConfig.Path(exporterConfig.Sources.LinkMap),
+					exporterConfig.Sources.LinkMap != config.Default().Sources.LinkMap,
+					func(path string) error { _, err := config.LoadLinkMap(path); return err },
+				},
+				{
+					exporterConfig.Path(exporterConfig.Collectors.Pkey.Policy),
+					true,
+					func(path string) error { _, err := config.LoadPkeyPolicy(path); return err },
+				},
+			}
+			if cmd.Flags().Changed("linkMap") {
+				loaders[0].path, loaders[0].explicit = linkMapPath, true
+			}
+			if cmd.Flags().Changed("pkeyPolicy") {
+				loaders[1].path = pkeyPolicyPath
+			}
+			for _, loader := range loaders {
+				if loader.path == "" {
+					continue
+				}
+				err := loader.load(loader.path)
+				if errors.Is(err, os.ErrNotExist) && !loader.explicit {
+					continue
+				}
+				report(loader.path, err)
+			}
+			if failed {
+				return errors.New("invalid configuration")
+			}
+			return nil
+		},
+	}
+	validateCmd.Flags().SetNormalizeFunc(func(fs *pflag.FlagSet, name string) pflag.NormalizedName {
+		if name == "defaultConfig" {
+			name = "config.file"
+		}
+		return pflag.NormalizedName(name)
+	})
+	validateCmd.Flags().StringP(
+		"config.file",
+		"d",
+		"",
+		"an string parameter, exporter configuration file, default config/default.yaml of the work directory",
+	)
+	validateCmd.Flags().StringVar(
+		&flagConfig.WorkDir,
+		"workDir",
+		config.Default().WorkDir,
+		"an string parameter, work directory the configuration file is looked up in",
+	)
+	validateCmd.Flags().StringVarP(
+		&linkMapPath,
+		"linkMap",
+		"c",
+		"",
+		"an string parameter, link map, default sources.linkMap of the configuration",
+	)
+	validateCmd.Flags().StringVarP(
+		&pkeyPolicyPath,
+		"pkeyPolicy",
+		"k",
+		"",
+		"an string parameter, partition policy file, default collectors.pkey.policy of the configuration",
+	)
+	return validateCmd
+}
+
+func newConfigGenerateCommand() *cobra.Command {
+	var linkMapPath string
+	var write bool
+	var generateCmd = &cobra.Command{
+		Use:   "generate <dir>",
+		Short: "infiniband-exporter config generate data/ibdiagnet2 -c config/config.yaml",
+		Long: `Build the link map from an ibdiagnet2 output, a directory or a tarball, merge it
+with the existing one, keeping the names set by hand and marking the links no
+longer seen as removed, and print what changes. The file is written after
+confirmation, or right away with --write.`,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := iblog.InitCliLogger(); err != nil {
+				return err
+			}
+			dataDir, cleanup, err := openDataDir(args[0])
+			if err != nil {
+				return err
+			}
+			defer cleanup()
+			netDump := ibdiagnet2.LinkNetDump{
+				FilePath:  filepath.Join(dataDir, "ibdiagnet2.net_dump"),
+				IsMapName: IsMapName,
+			}
+			generated, err := netDump.GetLinkMap()
+			if err != nil {
+				return err
+			}
+			existing, err := config.LoadLinkMap(linkMapPath)
+			if errors.Is(err, os.ErrNotExist) {
+				existing = make(config.LinkMap)
+			} else if err != nil {
+				return err
+			}
+			merged := config.Merge(existing, generated)
+			lines := config.Diff(existing, merged)
+			if len(lines) == 0 {
+				fmt.Printf("%s is up to date\n", linkMapPath)
+				return nil
+			}
+			fmt.Println(strings.Join(lines, "\n"))
+			if !write && !confirm(fmt.Sprintf("Write %d changes to %s?", len(lines), linkMapPath)) {
+				return nil
+			}
+			content, err := merged.Marshal()
+			if err != nil {
+				return err
+			}
+			if err := os.WriteFile(linkMapPath, content, 0644); err != nil {
+				return err
+			}
+			fmt.Printf("Wrote %s\n", linkMapPath)
+			return nil
+		},
+	}
+	generateCmd.Flags().StringVarP(
+		&linkMapPath,
+		"linkMap",
+		"c",
+		"config/config.yaml",
+		"an string parameter, link map to merge with and write",
+	)
+	generateCmd.Flags().BoolVar(
+		&write,
+		"write",
+		false,
+		"an bool parameter, write without asking",
+	)
+	generateCmd.Flags().BoolVarP(
+		&IsMapName,
+		"isMapName",
+		"i",
+		false,
+		"an bool parameter",
+	)
+	return generateCmd
+}
+
+// confirm asks a yes/no question on the terminal, answering no when stdin is
+// not one.
+func confirm(question string) bool {
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		fmt.Println("Not a terminal, use --write to write the changes")
+		return false
+	}
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
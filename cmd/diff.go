@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"fmt"
+	"infiniband_exporter/diff"
+	"infiniband_exporter/ibdiagnet2"
+	iblog "infiniband_exporter/log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+func newDiffCommand() *cobra.Command {
+	var format string
+	var thresholds []string
+	var diffCmd = &cobra.Command{
+		Use:   "diff <old> <new>",
+		Short: "infiniband-exporter diff data/old data/ibdiagnet2 -f markdown",
+		Long: `Compare two ibdiagnet2 outputs, directories or tarballs, and print the nodes
+added or removed, link state, peer, width and speed changes, firmware changes
+and error counters that grew by at least their threshold.`,
+		Args:         cobra.ExactArgs(2),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := iblog.InitCliLogger(); err != nil {
+				return err
+			}
+			counterThresholds := make(map[string]float64)
+			for counter, threshold := range diff.DefaultThresholds {
+				counterThresholds[counter] = threshold
+			}
+			for _, threshold := range thresholds {
+				counter, value, found := strings.Cut(threshold, "=")
+				parsed, err := strconv.ParseFloat(value, 64)
+				if !found || err != nil {
+					return fmt.Errorf("invalid threshold %s, expected <counter>=<value>", threshold)
+				}
+				counterThresholds[counter] = parsed
+			}
+			var fabrics []*ibdiagnet2.Fabric
+			for _, path := range args {
+				dataDir, cleanup, err := openDataDir(path)
+				if err != nil {
+					return err
+				}
+				fabric, err := ibdiagnet2.LoadFabric(dataDir)
+				cleanup()
+				if err != nil {
+					return fmt.Errorf("load %s: %w", path, err)
+				}
+				fabrics = append(fabrics, fabric)
+			}
+			report := diff.Compare(fabrics[0], fabrics[1], counterThresholds)
+			return report.Write(os.Stdout, format)
+		},
+	}
+	diffCmd.Flags().StringVarP(
+		&format,
+		"format",
+		"f",
+		"text",
+		"an string parameter[text|json|markdown]",
+	)
+	diffCmd.Flags().StringSliceVarP(
+		&thresholds,
+		"threshold",
+		"t",
+		nil,
+		"an string parameter, <counter>=<value> minimum increase to report, adds to or overrides the defaults",
+	)
+	return diffCmd
+}
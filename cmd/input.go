@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"fmt"
+	"infiniband_exporter/archive"
+	"os"
+	"path/filepath"
+)
+
+// openDataDir resolves an ibdiagnet2 output given as a directory, a directory
+// holding an ibdiagnet2 directory, or a tarball such as ib.tgz or an archive
+// snapshot. The returned cleanup removes what was extracted.
+func openDataDir(path string) (string, func(), error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", nil, err
+	}
+	if info.IsDir() {
+		if _, err := os.Stat(filepath.Join(path, "ibdiagnet2.db_csv")); err != nil {
+			path = filepath.Join(path, "ibdiagnet2")
+		}
+		return path, func() {}, nil
+	}
+	tmpDir, err := os.MkdirTemp("", "ibdiagnet2")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(tmpDir) }
+	if err := archive.Extract(path, tmpDir); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("extract %s: %w", path, err)
+	}
+	return filepath.Join(tmpDir, "ibdiagnet2"), cleanup, nil
+}
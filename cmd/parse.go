@@ -0,0 +1,181 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"infiniband_exporter/config"
+	"infiniband_exporter/ibdiagnet2"
+	iblog "infiniband_exporter/log"
+	"infiniband_exporter/push"
+	"infiniband_exporter/util"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/spf13/cobra"
+)
+
+type seriesFilter struct {
+	guids []string
+	names []string
+	ports []string
+}
+
+func newParseCommand() *cobra.Command {
+	var format, linkMapPath string
+	var filter seriesFilter
+	var parseCmd = &cobra.Command{
+		Use:   "parse <dir>",
+		Short: "infiniband-exporter parse data/ibdiagnet2 -f table --guid 0xb0cf0e0300d33fc0",
+		Long: `Run every collector against an ibdiagnet2 output, a directory or a tarball,
+and print the series the exporter would serve. Exits non-zero when a collector
+reported an error.`,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := iblog.InitCliLogger(); err != nil {
+				return err
+			}
+			if linkMapPath != "" {
+				linkMap, err := config.LoadLinkMap(linkMapPath)
+				if err != nil {
+					return err
+				}
+				util.SetCache(linkMap.Cache())
+			}
+			dataDir, cleanup, err := openDataDir(args[0])
+			if err != nil {
+				return err
+			}
+			defer cleanup()
+			// Never let a parse rewrite the link map, see --getConfig.
+			GetConfig = false
+			metricFamilies, err := newRegistry(&ibdiagnet2.CollectorContext{DataDir: dataDir}).Gather()
+			if err != nil {
+				return err
+			}
+			metricFamilies = filter.apply(metricFamilies)
+			if err := writeSeries(os.Stdout, metricFamilies, format); err != nil {
+				return err
+			}
+			if errorCount := iblog.ErrorCount(); errorCount > 0 {
+				return fmt.Errorf("%d errors while parsing %s", errorCount, args[0])
+			}
+			return nil
+		},
+	}
+	parseCmd.Flags().StringVarP(
+		&format,
+		"format",
+		"f",
+		"text",
+		"an string parameter[text|json|table]",
+	)
+	parseCmd.Flags().StringVarP(
+		&linkMapPath,
+		"linkMap",
+		"c",
+		"",
+		"an string parameter, link map used to name the ports, e.g. config/config.yaml, the ports are labelled with their own GUID and port without it",
+	)
+	parseCmd.Flags().StringVarP(
+		&PkeyPolicy,
+		"pkeyPolicy",
+		"k",
+		"",
+		"an string parameter, partition policy file",
+	)
+	parseCmd.Flags().BoolVarP(
+		&IsMapName,
+		"isMapName",
+		"i",
+		false,
+		"an bool parameter",
+	)
+	parseCmd.Flags().StringSliceVar(&filter.guids, "guid", nil, "an string parameter, keep series with this GUID")
+	parseCmd.Flags().StringSliceVar(&filter.names, "name", nil, "an string parameter, keep series whose name contains it")
+	parseCmd.Flags().StringSliceVar(&filter.ports, "port", nil, "an string parameter, keep series with this port")
+	return parseCmd
+}
+
+// apply keeps the infiniband series matching every given filter. A filter
+// matches when any guid, name or port label, local or remote, matches.
+func (f *seriesFilter) apply(metricFamilies []*dto.MetricFamily) []*dto.MetricFamily {
+	var filtered []*dto.MetricFamily
+	for _, metricFamily := range metricFamilies {
+		if !strings.HasPrefix(metricFamily.GetName(), "infiniband_") {
+			continue
+		}
+		var metrics []*dto.Metric
+		for _, metric := range metricFamily.Metric {
+			if f.match(metric, "guid", f.guids, slices.Contains[[]string]) &&
+				f.match(metric, "name", f.names, containsAny) &&
+				f.match(metric, "port", f.ports, slices.Contains[[]string]) {
+				metrics = append(metrics, metric)
+			}
+		}
+		if len(metrics) > 0 {
+			metricFamily.Metric = metrics
+			filtered = append(filtered, metricFamily)
+		}
+	}
+	return filtered
+}
+
+func (f *seriesFilter) match(metric *dto.Metric, suffix string, values []string, matches func([]string, string) bool) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, label := range metric.Label {
+		if strings.HasSuffix(strings.ToLower(label.GetName()), suffix) && label.GetValue() != "" &&
+			matches(values, label.GetValue()) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAny(values []string, s string) bool {
+	for _, value := range values {
+		if strings.Contains(s, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeSeries(w io.Writer, metricFamilies []*dto.MetricFamily, format string) error {
+	switch format {
+	case "text":
+		encoder := expfmt.NewEncoder(w, expfmt.NewFormat(expfmt.TypeTextPlain))
+		for _, metricFamily := range metricFamilies {
+			if err := encoder.Encode(metricFamily); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(push.ToSeries(metricFamilies))
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tLABELS\tVALUE")
+		for _, series := range push.ToSeries(metricFamilies) {
+			var labels []string
+			for name, value := range series.Labels {
+				labels = append(labels, fmt.Sprintf("%s=%s", name, value))
+			}
+			sort.Strings(labels)
+			fmt.Fprintf(tw, "%s\t%s\t%g\n", series.Name, strings.Join(labels, ","), series.Value)
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown format %s, expected text, json or table", format)
+	}
+}
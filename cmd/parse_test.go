@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"infiniband_exporter/ibdiagnet2"
+	"testing"
+)
+
+// TestParseWithoutLinkMap checks that the ports of a run parsed without a
+// link map each get their own series, which --guid and --port then find.
+func TestParseWithoutLinkMap(t *testing.T) {
+	getConfig := GetConfig
+	GetConfig = false
+	t.Cleanup(func() { GetConfig = getConfig })
+	metricFamilies, err := newRegistry(&ibdiagnet2.CollectorContext{DataDir: "../data/ibdiagnet2"}).Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	series := make(map[string]int)
+	for _, metricFamily := range metricFamilies {
+		series[metricFamily.GetName()] = len(metricFamily.Metric)
+	}
+	if series["infiniband_port_xmit_data"] != 542 {
+		t.Errorf("%d infiniband_port_xmit_data series, expected one per port of ibdiagnet2.pm, 542", series["infiniband_port_xmit_data"])
+	}
+	filter := seriesFilter{guids: []string{"0xb0cf0e0300d33fc0"}, ports: []string{"3"}}
+	for _, metricFamily := range filter.apply(metricFamilies) {
+		if metricFamily.GetName() != "infiniband_port_xmit_data" {
+			continue
+		}
+		if len(metricFamily.Metric) != 1 {
+			t.Fatalf("%d series of 0xb0cf0e0300d33fc0 port 3, expected 1", len(metricFamily.Metric))
+		}
+		return
+	}
+	t.Error("no infiniband_port_xmit_data of 0xb0cf0e0300d33fc0 port 3")
+}
@@ -0,0 +1,196 @@
+package cmd
+
+import (
+	"fmt"
+	"infiniband_exporter/config"
+	"infiniband_exporter/ibdiagnet2"
+	iblog "infiniband_exporter/log"
+	"infiniband_exporter/push"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	Push = config.Default().Push
+
+	lastPushGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "infiniband_exporter_push_last_success_timestamp_seconds",
+			Help: "Time of the last successful push, by target",
+		},
+		[]string{"target"},
+	)
+	pushQueueGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "infiniband_exporter_push_queue_length",
+			Help: "Snapshots waiting in the remote write queue",
+		},
+	)
+)
+
+// pushLoop collects and pushes every interval, whether or not anything
+// scrapes /metrics.
+func pushLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		pushData()
+	}
+}
+
+// pushData runs one collection and sends it to the push targets.
+func pushData() {
+	gatherer, err := gatherData()
+	if err != nil {
+		iblog.GetLogger().Error(err.Error())
+		return
+	}
+	metricFamilies, err := gatherer.Gather()
+	if err != nil {
+		iblog.GetLogger().Error(fmt.Sprintf("Gather error: %s", err))
+	}
+	sendToTargets(metricFamilies, time.Now())
+}
+
+// pushSnapshot is a collection waiting for pushWorker.
+type pushSnapshot struct {
+	metricFamilies []*dto.MetricFamily
+	now            time.Time
+}
+
+var (
+	// pushSnapshots holds the latest scrape not pushed yet, so that the
+	// scrapes do not wait for slow targets nor pile up behind them.
+	pushSnapshots    = make(chan pushSnapshot, 1)
+	pushWorkerOnce   sync.Once
+	pushDroppedCount = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "infiniband_exporter_push_dropped_total",
+			Help: "Scrapes not pushed, replaced by a newer one while the targets were busy",
+		},
+	)
+)
+
+// queuePush hands a scrape to pushWorker, replacing the one still waiting.
+func queuePush(metricFamilies []*dto.MetricFamily, now time.Time) {
+	pushWorkerOnce.Do(func() {
+		go pushWorker()
+	})
+	snapshot := pushSnapshot{metricFamilies, now}
+	for {
+		select {
+		case pushSnapshots <- snapshot:
+			return
+		default:
+		}
+		select {
+		case <-pushSnapshots:
+			pushDroppedCount.Inc()
+		default:
+		}
+	}
+}
+
+// pushWorker sends the queued scrapes one after the other.
+func pushWorker() {
+	for snapshot := range pushSnapshots {
+		sendToTargets(snapshot.metricFamilies, snapshot.now)
+	}
+}
+
+// pushTarget is a push.Sink and the name it is logged and reported by.
+type pushTarget struct {
+	name string
+	sink push.Sink
+}
+
+// pushLock lets one collection reach every target before the next one.
+var pushLock sync.Mutex
+
+// sendToTargets sends metricFamilies to every configured target, logging the
+// ones that fail.
+func sendToTargets(metricFamilies []*dto.MetricFamily, now time.Time) {
+	reloadLock.RLock()
+	pushConfig := Push
+	reloadLock.RUnlock()
+	pushLock.Lock()
+	defer pushLock.Unlock()
+	var writer *push.RemoteWriter
+	for _, target := range newPushTargets(pushConfig) {
+		err := target.sink.Send(metricFamilies, now)
+		if remoteWriter, ok := target.sink.(*push.RemoteWriter); ok {
+			writer = remoteWriter
+		}
+		if err != nil {
+			iblog.GetLogger().Error(fmt.Sprintf("Push to %s error: %s", target.name, err))
+			continue
+		}
+		lastPushGauge.WithLabelValues(target.name).Set(float64(now.Unix()))
+	}
+	if writer != nil {
+		queued, err := writer.Queued()
+		if err != nil {
+			iblog.GetLogger().Error(fmt.Sprintf("Remote write queue error: %s", err))
+		}
+		pushQueueGauge.Set(float64(queued))
+	}
+}
+
+// newPushTargets builds the targets pushConfig sets.
+func newPushTargets(pushConfig config.Push) []pushTarget {
+	hostname, _ := os.Hostname()
+	fabric := pushConfig.Fabric
+	if fabric == "" {
+		fabric = hostname
+	}
+	labels := map[string]string{"fabric": fabric}
+	var targets []pushTarget
+	if pushConfig.Pushgateway.URL != "" {
+		targets = append(targets, pushTarget{"pushgateway", &push.Pushgateway{
+			URL:      pushConfig.Pushgateway.URL,
+			Job:      pushConfig.Pushgateway.Job,
+			Grouping: labels,
+			Timeout:  pushConfig.Pushgateway.Timeout,
+		}})
+	}
+	if pushConfig.Otlp.Endpoint != "" {
+		targets = append(targets, pushTarget{"otlp", &push.OtlpExporter{
+			Endpoint:  pushConfig.Otlp.Endpoint,
+			Protocol:  pushConfig.Otlp.Protocol,
+			Timeout:   pushConfig.Otlp.Timeout,
+			Resource:  map[string]string{"fabric": fabric, "host.name": hostname, "service.name": "infiniband_exporter"},
+			Monotonic: ibdiagnet2.IsPmCounterMetric,
+		}})
+	}
+	if pushConfig.Influx.URL != "" || pushConfig.Influx.File != "" {
+		targets = append(targets, pushTarget{"influx", &push.InfluxSink{
+			URL:     pushConfig.Influx.URL,
+			Token:   pushConfig.Influx.Token,
+			Timeout: pushConfig.Influx.Timeout,
+			File:    pushConfig.Influx.File,
+			Labels:  labels,
+		}})
+	}
+	if pushConfig.JSON.File != "" {
+		targets = append(targets, pushTarget{"json", &push.JSONSink{
+			File:   pushConfig.JSON.File,
+			Labels: labels,
+		}})
+	}
+	// Remote write goes last, its retries may take a while.
+	if pushConfig.RemoteWrite.URL != "" {
+		targets = append(targets, pushTarget{"remoteWrite", &push.RemoteWriter{
+			URL:      pushConfig.RemoteWrite.URL,
+			Timeout:  pushConfig.RemoteWrite.Timeout,
+			Retries:  pushConfig.RemoteWrite.Retries,
+			QueueDir: pushConfig.RemoteWrite.QueueDir,
+			MaxQueue: pushConfig.RemoteWrite.MaxQueue,
+			Labels:   labels,
+		}})
+	}
+	return targets
+}
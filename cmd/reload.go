@@ -0,0 +1,197 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"infiniband_exporter/config"
+	"infiniband_exporter/ibdiagnet2"
+	iblog "infiniband_exporter/log"
+	"infiniband_exporter/util"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/pflag"
+)
+
+var (
+	// reloadLock keeps a scrape from seeing half of a reload.
+	reloadLock      sync.RWMutex
+	lastReloadGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "infiniband_exporter_config_last_reload_successful",
+			Help: "Whether the last configuration reload attempt was successful",
+		},
+	)
+	lastReloadTimeGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "infiniband_exporter_config_last_reload_success_timestamp_seconds",
+			Help: "Timestamp of the last successful configuration reload",
+		},
+	)
+)
+
+var (
+	// rootFlags and rootFlagConfig are the command line the configuration is
+	// resolved from again on every reload.
+	rootFlags      *pflag.FlagSet
+	rootFlagConfig *config.Config
+	// configFiles are the files in use, the ones watched for changes.
+	configFiles []string
+)
+
+// resolveConfig builds the configuration from the defaults, ConfigFile, the
+// environment and the command line.
+func resolveConfig() (*config.Config, error) {
+	exporterConfig, err := config.Resolve(ConfigFile, rootFlags, rootFlagConfig)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCollectors(ConfigFile, exporterConfig); err != nil {
+		return nil, err
+	}
+	if rootFlags != nil {
+		if getConfig, _ := rootFlags.GetBool("getConfig"); getConfig {
+			exporterConfig.Sources.LinkMap = ""
+		}
+	}
+	return exporterConfig, nil
+}
+
+// reloadConfig validates the configuration and every file it references and
+// only then swaps in the new link map, sync data config, naming and pkey
+// policy, keeping the running ones on error. The server, mode, work directory
+// and sources other than the link map only change on restart.
+func reloadConfig() (err error) {
+	defer func() {
+		if err != nil {
+			lastReloadGauge.Set(0)
+			return
+		}
+		lastReloadGauge.Set(1)
+		lastReloadTimeGauge.SetToCurrentTime()
+	}()
+	exporterConfig, err := resolveConfig()
+	if err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+	var files []string
+	if ConfigFile != "" {
+		files = append(files, ConfigFile)
+	}
+	linkMap := make(config.LinkMap)
+	linkMapPath := exporterConfig.Path(exporterConfig.Sources.LinkMap)
+	if linkMapPath != "" {
+		if linkMap, err = config.LoadLinkMap(linkMapPath); err != nil {
+			return fmt.Errorf("load link map: %w", err)
+		}
+		files = append(files, linkMapPath)
+	}
+	var syncData *ibdiagnet2.SyncSwitchData
+	if exporterConfig.Mode == "local" {
+		syncData = (*ibdiagnet2.SyncSwitchData)(&exporterConfig.SyncDataConfig)
+	}
+	// The policy is read on every scrape, it is only checked here.
+	pkeyPolicy := exporterConfig.Path(exporterConfig.Collectors.Pkey.Policy)
+	if pkeyPolicy != "" {
+		if _, err = config.LoadPkeyPolicy(pkeyPolicy); err != nil {
+			return fmt.Errorf("load pkey policy: %w", err)
+		}
+		files = append(files, pkeyPolicy)
+	}
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	util.SetCache(linkMap.Cache())
+	GetConfig = linkMapPath == ""
+	if syncData != nil {
+		SyncData = syncData
+	}
+	IsMapName = exporterConfig.Naming.MapName
+	Collectors = exporterConfig.Collectors
+	Metrics = exporterConfig.Metrics
+	Push = exporterConfig.Push
+	Push.RemoteWrite.QueueDir = exporterConfig.Path(Push.RemoteWrite.QueueDir)
+	Push.Influx.File = exporterConfig.Path(Push.Influx.File)
+	if Push.JSON.File != "-" {
+		Push.JSON.File = exporterConfig.Path(Push.JSON.File)
+	}
+	PkeyPolicy = pkeyPolicy
+	configFiles = files
+	return nil
+}
+
+// getConfigFiles returns the files in use by the running configuration.
+func getConfigFiles() []string {
+	reloadLock.RLock()
+	defer reloadLock.RUnlock()
+	return configFiles
+}
+
+// watchConfig reloads the configuration on SIGHUP and, when interval is not
+// zero, whenever one of the files changes.
+func watchConfig(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.NewTicker(interval).C
+	}
+	files := getConfigFiles()
+	modTimes := getModTimes(files)
+	for {
+		select {
+		case <-hup:
+			iblog.GetLogger().Info("Received SIGHUP, reloading config")
+		case <-tick:
+			current := getModTimes(getConfigFiles())
+			if current == modTimes {
+				continue
+			}
+			modTimes = current
+			iblog.GetLogger().Info("Config files changed, reloading config")
+		}
+		if err := reloadConfig(); err != nil {
+			iblog.GetLogger().Error(fmt.Sprintf("Reload config error, keeping the running config: %s", err))
+			continue
+		}
+		iblog.GetLogger().Info("Reloaded config")
+	}
+}
+
+// getModTimes summarizes the modification times and sizes of the files.
+func getModTimes(files []string) string {
+	var summary string
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			summary += fmt.Sprintf("%s:missing;", file)
+			continue
+		}
+		summary += fmt.Sprintf("%s:%d:%d;", file, info.ModTime().UnixNano(), info.Size())
+	}
+	return summary
+}
+
+// ReloadHandler serves POST /-/reload like Prometheus.
+func ReloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		w.Header().Set("Allow", "POST, PUT")
+		http.Error(w, "Only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := reloadConfig(); err != nil {
+		iblog.GetLogger().Error(fmt.Sprintf("Reload config error, keeping the running config: %s", err))
+		var validationError *config.ValidationError
+		status := http.StatusInternalServerError
+		if errors.As(err, &validationError) {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	iblog.GetLogger().Info("Reloaded config")
+}
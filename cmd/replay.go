@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"fmt"
+	"infiniband_exporter/archive"
+	iblog "infiniband_exporter/log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// replayer walks the archive, extracting one snapshot at a time into Dir
+// where MetricsHandler reads it instead of the live data directory.
+type replayer struct {
+	sync.RWMutex
+	Dir       string
+	Speed     float64
+	snapshots []archive.Snapshot
+	index     int
+	advance   sync.Mutex
+	served    bool
+}
+
+var replay *replayer
+
+func newReplayer(a *archive.Archive, dir string, speed float64) (*replayer, error) {
+	snapshots, err := a.List()
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) == 0 {
+		return nil, fmt.Errorf("no snapshot in archive %s", a.Dir)
+	}
+	r := &replayer{Dir: dir, Speed: speed, snapshots: snapshots, index: -1}
+	if err := r.next(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Run advances through the snapshots, waiting the time that separated the
+// original ibdiagnet runs divided by Speed. With Speed 0 every scrape
+// advances one snapshot instead, see Advance.
+func (r *replayer) Run() {
+	if r.Speed <= 0 {
+		return
+	}
+	for r.index+1 < len(r.snapshots) {
+		gap := r.snapshots[r.index+1].Time.Sub(r.snapshots[r.index].Time)
+		time.Sleep(time.Duration(float64(gap) / r.Speed))
+		if err := r.next(); err != nil {
+			iblog.GetLogger().Error(fmt.Sprintf("Replay snapshot error: %s", err))
+		}
+	}
+	iblog.GetLogger().Info("Replay finished, serving the last snapshot")
+}
+
+// Advance moves to the next snapshot when replaying scrape by scrape.
+func (r *replayer) Advance() {
+	r.advance.Lock()
+	defer r.advance.Unlock()
+	if !r.served {
+		r.served = true
+		return
+	}
+	if r.Speed > 0 || r.index+1 >= len(r.snapshots) {
+		return
+	}
+	if err := r.next(); err != nil {
+		iblog.GetLogger().Error(fmt.Sprintf("Replay snapshot error: %s", err))
+	}
+}
+
+// next extracts the following snapshot aside and swaps it in, so a scrape
+// never reads a half extracted directory.
+func (r *replayer) next() error {
+	snapshot := r.snapshots[r.index+1]
+	tmpDir, err := os.MkdirTemp(r.Dir, "extract")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := archive.Extract(snapshot.Path, tmpDir); err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
+	dataDir := filepath.Join(r.Dir, "ibdiagnet2")
+	if err := os.RemoveAll(dataDir); err != nil {
+		return err
+	}
+	if err := os.Rename(filepath.Join(tmpDir, "ibdiagnet2"), dataDir); err != nil {
+		return err
+	}
+	r.index++
+	iblog.GetLogger().Info(fmt.Sprintf("Replaying snapshot %s", snapshot.Path))
+	return nil
+}
+
+// RunTime returns the time of the ibdiagnet run being replayed.
+func (r *replayer) RunTime() time.Time {
+	return r.snapshots[r.index].Time
+}
+
+// Stamp wraps gatherer, stamping every sample with the time of the replayed
+// run.
+func (r *replayer) Stamp(gatherer prometheus.Gatherer) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		metricFamilies, err := gatherer.Gather()
+		timestampMs := r.RunTime().UnixMilli()
+		for _, metricFamily := range metricFamilies {
+			for _, metric := range metricFamily.Metric {
+				metric.TimestampMs = &timestampMs
+			}
+		}
+		return metricFamilies, err
+	})
+}
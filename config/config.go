@@ -0,0 +1,367 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the exporter configuration file, see config/exporter.yaml. The
+// legacy default.yaml, holding only syncDataConfig, is a valid one. Every key
+// can be overridden by the flag of the same dotted name, e.g.
+// --server.port, and by INFINIBAND_EXPORTER_<KEY>, e.g.
+// INFINIBAND_EXPORTER_SERVER_PORT.
+type Config struct {
+	Server         Server     `yaml:"server"`
+	Metrics        Metrics    `yaml:"metrics"`
+	Logging        Logging    `yaml:"logging"`
+	Mode           string     `yaml:"mode" short:"m" help:"collection mode [local|agent|dev|replay]"`
+	WorkDir        string     `yaml:"workDir" short:"w" help:"directory holding config and data, relative data files are resolved against it"`
+	Sources        Sources    `yaml:"sources"`
+	State          State      `yaml:"state"`
+	Collectors     Collectors `yaml:"collectors"`
+	Naming         Naming     `yaml:"naming"`
+	Push           Push       `yaml:"push"`
+	SyncDataConfig SyncData   `yaml:"syncDataConfig"`
+}
+
+type Server struct {
+	Port           int           `yaml:"port" short:"p" help:"port serving /metrics"`
+	ReloadInterval time.Duration `yaml:"reloadInterval" help:"how often config files are checked for changes, 0 to only reload on SIGHUP or POST /-/reload"`
+	API            bool          `yaml:"api" help:"serve the fabric state of the last collection as JSON on /api/v1"`
+}
+
+// Metrics shapes the /metrics responses.
+type Metrics struct {
+	OpenMetrics bool `yaml:"openMetrics" help:"serve OpenMetrics to the scrapers asking for it"`
+	// Created needs the previous value of every pm counter in the state file.
+	Created      bool `yaml:"created" help:"expose _created for counters, the ibdiagnet run they were found reset at"`
+	RunTimestamp bool `yaml:"runTimestamp" help:"stamp the fabric samples with the ibdiagnet run time instead of the scrape time"`
+}
+
+type Logging struct {
+	File string `yaml:"file" short:"l" help:"log file, empty to only log to stdout"`
+}
+
+type Sources struct {
+	LinkMap string  `yaml:"linkMap" help:"link map naming the ports, empty for none"`
+	Archive Archive `yaml:"archive"`
+	Replay  Replay  `yaml:"replay"`
+}
+
+// State is what the exporter remembers between restarts, in
+// <workDir>/data/state.json.
+type State struct {
+	MaxAge time.Duration `yaml:"maxAge" help:"forget the nodes and ports no ibdiagnet run saw for longer, e.g. 720h, 0 to keep them"`
+}
+
+type Archive struct {
+	Enabled  bool          `yaml:"enabled" help:"archive every collected ibdiagnet2 output"`
+	Dir      string        `yaml:"dir" help:"archive directory"`
+	MaxCount int           `yaml:"maxCount" help:"snapshots to keep, 0 for no limit"`
+	MaxAge   time.Duration `yaml:"maxAge" help:"snapshot age to keep, e.g. 168h, 0 for no limit"`
+	MaxSize  int64         `yaml:"maxSize" help:"archive size in bytes, 0 for no limit"`
+}
+
+type Replay struct {
+	Speed float64 `yaml:"speed" help:"replay speed factor, 0 to advance one snapshot per scrape"`
+}
+
+// Collectors enables the ibdiagnet2 collectors, keyed by the collector name.
+// Every collector is enabled by default; --collector.<name>=false is short
+// for --collectors.<name>.enabled=false.
+type Collectors struct {
+	Flap       Collector     `yaml:"flap"`
+	NetDump    Collector     `yaml:"netDump"`
+	NetDumpExt Collector     `yaml:"netDumpExt"`
+	Pkey       PkeyCollector `yaml:"pkey"`
+	Pm         PmCollector   `yaml:"pm"`
+	Routing    Collector     `yaml:"routing"`
+	Sm         Collector     `yaml:"sm"`
+	Vl         Collector     `yaml:"vl"`
+	VPorts     Collector     `yaml:"vports"`
+}
+
+type Collector struct {
+	Enabled bool `yaml:"enabled" help:"run the collector"`
+}
+
+type PkeyCollector struct {
+	Enabled bool   `yaml:"enabled" help:"run the collector"`
+	Policy  string `yaml:"policy" short:"k" help:"partition policy file"`
+}
+
+type PmCollector struct {
+	Enabled bool   `yaml:"enabled" help:"run the collector"`
+	Mode    string `yaml:"mode" help:"known to export the known pm counters, all to export every pm counter as infiniband_pm_<name>, with _total for the known counters"`
+	// Counters keeps series cardinality down on large fabrics.
+	Counters []string `yaml:"counters" help:"pm counters to export, e.g. port_xmit_data_extended, empty for all"`
+	// Supported tells ports whose firmware lacks a counter from idle ones.
+	Supported bool `yaml:"supported" help:"export infiniband_pm_counter_supported, 0 for the counters a port reports as NA"`
+}
+
+// Enabled tells, by collector name, whether the collector runs.
+func (c *Collectors) Enabled() map[string]bool {
+	enabled := make(map[string]bool)
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := strings.Split(v.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		enabled[name] = v.Field(i).FieldByName("Enabled").Bool()
+	}
+	return enabled
+}
+
+// Push sends every collection to the configured targets, for fabrics whose
+// Prometheus cannot scrape the exporter and for the tools that do not speak
+// Prometheus.
+type Push struct {
+	Interval time.Duration `yaml:"interval" help:"collect and push every interval, 0 to not push"`
+	// OnScrape saves an ibdiagnet run when the targets want what Prometheus
+	// scrapes anyway.
+	OnScrape    bool        `yaml:"onScrape" help:"push the collection of every /metrics scrape"`
+	Fabric      string      `yaml:"fabric" help:"fabric label of the pushed series and Pushgateway group, the hostname when empty"`
+	RemoteWrite RemoteWrite `yaml:"remoteWrite"`
+	Pushgateway Pushgateway `yaml:"pushgateway"`
+	Otlp        Otlp        `yaml:"otlp"`
+	Influx      Influx      `yaml:"influx"`
+	JSON        JSON        `yaml:"json"`
+}
+
+type RemoteWrite struct {
+	URL      string        `yaml:"url" help:"remote write endpoint, e.g. http://prometheus:9090/api/v1/write, empty for none"`
+	Timeout  time.Duration `yaml:"timeout" help:"timeout of one remote write request"`
+	Retries  int           `yaml:"retries" help:"retries of a failed remote write, with a doubling backoff from 1s up to 30s, given up 2m into a push"`
+	QueueDir string        `yaml:"queueDir" help:"directory queueing the snapshots not sent yet, empty to drop them"`
+	MaxQueue int           `yaml:"maxQueue" help:"queued snapshots to keep, the oldest are dropped first, 0 for no limit"`
+}
+
+type Pushgateway struct {
+	URL     string        `yaml:"url" help:"Pushgateway, e.g. http://pushgateway:9091, empty for none"`
+	Job     string        `yaml:"job" help:"Pushgateway job"`
+	Timeout time.Duration `yaml:"timeout" help:"timeout of one push"`
+}
+
+type Otlp struct {
+	Endpoint string        `yaml:"endpoint" help:"OpenTelemetry collector, e.g. http://otel-collector:4318, empty for none"`
+	Protocol string        `yaml:"protocol" help:"OTLP protocol [http|grpc]"`
+	Timeout  time.Duration `yaml:"timeout" help:"timeout of one export"`
+}
+
+type Influx struct {
+	URL     string        `yaml:"url" help:"InfluxDB write endpoint, e.g. http://influxdb:8086/api/v2/write?org=hpc&bucket=fabric, empty for none"`
+	Token   string        `yaml:"token" help:"InfluxDB API token, empty for none"`
+	Timeout time.Duration `yaml:"timeout" help:"timeout of one write"`
+	File    string        `yaml:"file" help:"file the line protocol is appended to, empty for none"`
+}
+
+type JSON struct {
+	File string `yaml:"file" help:"file the NDJSON series are appended to, - for stdout, empty for none"`
+}
+
+// Targets tells whether any push target is configured.
+func (p *Push) Targets() bool {
+	return p.RemoteWrite.URL != "" || p.Pushgateway.URL != "" || p.Otlp.Endpoint != "" ||
+		p.Influx.URL != "" || p.Influx.File != "" || p.JSON.File != ""
+}
+
+type Naming struct {
+	MapName bool `yaml:"mapName" short:"i" help:"name leaf switches after the HCA plugged into them"`
+}
+
+// Default returns the configuration used for keys set nowhere.
+func Default() *Config {
+	return &Config{
+		Server:  Server{Port: 9690, ReloadInterval: 10 * time.Second},
+		Logging: Logging{File: "infiniband_exporter.log"},
+		Mode:    "dev",
+		WorkDir: "./",
+		Sources: Sources{
+			LinkMap: "config/config.yaml",
+			Archive: Archive{Dir: "data/archive"},
+			Replay:  Replay{Speed: 1},
+		},
+		State: State{MaxAge: 30 * 24 * time.Hour},
+		Push: Push{
+			RemoteWrite: RemoteWrite{
+				Timeout:  30 * time.Second,
+				Retries:  3,
+				QueueDir: "data/push",
+				MaxQueue: 1000,
+			},
+			Pushgateway: Pushgateway{Job: "infiniband_exporter", Timeout: 30 * time.Second},
+			Otlp:        Otlp{Protocol: "http", Timeout: 30 * time.Second},
+			Influx:      Influx{Timeout: 30 * time.Second},
+		},
+		Collectors: Collectors{
+			Flap:       Collector{Enabled: true},
+			NetDump:    Collector{Enabled: true},
+			NetDumpExt: Collector{Enabled: true},
+			Pkey:       PkeyCollector{Enabled: true},
+			Pm:         PmCollector{Enabled: true, Mode: "known"},
+			Routing:    Collector{Enabled: true},
+			Sm:         Collector{Enabled: true},
+			Vl:         Collector{Enabled: true},
+			VPorts:     Collector{Enabled: true},
+		},
+	}
+}
+
+// Path resolves a data file path of the configuration against WorkDir.
+func (c *Config) Path(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(c.WorkDir, path)
+}
+
+type SyncData struct {
+	IpAddress     string `yaml:"ipAddress" help:"switch running ibdiagnet in the local mode"`
+	User          string `yaml:"user" help:"switch user"`
+	Password      string `yaml:"password" help:"switch password"`
+	HostUser      string `yaml:"hostUser" help:"user of the host receiving the ibdiagnet2 output"`
+	HostPassword  string `yaml:"hostPassword" help:"host password"`
+	HostIpAddress string `yaml:"hostIpAddress" help:"host receiving the ibdiagnet2 output"`
+	HostFilePath  string `yaml:"hostFilePath" help:"absolute path of the ibdiagnet2 tarball on the host"`
+}
+
+// PkeyPolicy lists, per partition, hosts that must or must not be members.
+// Hosts are matched by host name (the first element of the node description)
+// or by port GUID.
+type PkeyPolicy struct {
+	Partitions map[string]PkeyRule `yaml:"partitions"`
+}
+
+type PkeyRule struct {
+	MustInclude []string `yaml:"mustInclude"`
+	MustExclude []string `yaml:"mustExclude"`
+}
+
+// LoadConfig reads the configuration file over the defaults.
+func LoadConfig(path string) (*Config, error) {
+	config := Default()
+	file, err := load(path, config)
+	if err != nil {
+		return nil, err
+	}
+	return config, file.check(config.Validate())
+}
+
+func LoadPkeyPolicy(path string) (*PkeyPolicy, error) {
+	var policy PkeyPolicy
+	file, err := load(path, &policy)
+	if err != nil {
+		return nil, err
+	}
+	return &policy, file.check(policy.Validate())
+}
+
+func (c *Config) Validate() []string {
+	var problems []string
+	if !slices.Contains([]string{"local", "agent", "dev", "replay"}, c.Mode) {
+		problems = append(problems, fmt.Sprintf("mode: %q is not one of local, agent, dev, replay", c.Mode))
+	}
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("server.port: %d is not a port", c.Server.Port))
+	}
+	for _, field := range []struct {
+		key      string
+		negative bool
+	}{
+		{"server.reloadInterval", c.Server.ReloadInterval < 0},
+		{"sources.archive.maxCount", c.Sources.Archive.MaxCount < 0},
+		{"sources.archive.maxAge", c.Sources.Archive.MaxAge < 0},
+		{"sources.archive.maxSize", c.Sources.Archive.MaxSize < 0},
+		{"sources.replay.speed", c.Sources.Replay.Speed < 0},
+		{"state.maxAge", c.State.MaxAge < 0},
+		{"push.interval", c.Push.Interval < 0},
+		{"push.remoteWrite.timeout", c.Push.RemoteWrite.Timeout < 0},
+		{"push.remoteWrite.retries", c.Push.RemoteWrite.Retries < 0},
+		{"push.remoteWrite.maxQueue", c.Push.RemoteWrite.MaxQueue < 0},
+		{"push.pushgateway.timeout", c.Push.Pushgateway.Timeout < 0},
+		{"push.otlp.timeout", c.Push.Otlp.Timeout < 0},
+		{"push.influx.timeout", c.Push.Influx.Timeout < 0},
+	} {
+		if field.negative {
+			problems = append(problems, fmt.Sprintf("%s: must not be negative", field.key))
+		}
+	}
+	if (c.Push.Interval > 0 || c.Push.OnScrape) && !c.Push.Targets() {
+		problems = append(problems, "push: interval or onScrape set without a remoteWrite, pushgateway, otlp, influx or json target")
+	}
+	if !slices.Contains([]string{"http", "grpc"}, c.Push.Otlp.Protocol) {
+		problems = append(problems, fmt.Sprintf("push.otlp.protocol: %q is not one of http, grpc", c.Push.Otlp.Protocol))
+	}
+	// The sync data is only needed by the local mode, but a half filled one
+	// is a mistake anyway.
+	sync := c.SyncDataConfig
+	if c.Mode != "local" && sync == (SyncData{}) {
+		return problems
+	}
+	for _, field := range [][2]string{
+		{"ipAddress", sync.IpAddress},
+		{"user", sync.User},
+		{"hostIpAddress", sync.HostIpAddress},
+		{"hostUser", sync.HostUser},
+		{"hostFilePath", sync.HostFilePath},
+	} {
+		if field[1] == "" {
+			problems = append(problems, fmt.Sprintf("syncDataConfig.%s: missing", field[0]))
+		}
+	}
+	if sync.HostFilePath != "" && !filepath.IsAbs(sync.HostFilePath) {
+		problems = append(problems, fmt.Sprintf("syncDataConfig.hostFilePath: %q is not an absolute path", sync.HostFilePath))
+	}
+	return problems
+}
+
+func (p *PkeyPolicy) Validate() []string {
+	var problems []string
+	for _, pkey := range sortedKeys(p.Partitions) {
+		_, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(pkey), "0x"), 16, 16)
+		if !strings.HasPrefix(strings.ToLower(pkey), "0x") || err != nil {
+			problems = append(problems, fmt.Sprintf("partitions.%s: not a 16 bit hex partition key", pkey))
+		}
+		rule := p.Partitions[pkey]
+		for _, host := range rule.MustInclude {
+			for _, excluded := range rule.MustExclude {
+				if host == excluded {
+					problems = append(problems, fmt.Sprintf("partitions.%s: %s is both in mustInclude and mustExclude", pkey, host))
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// load decodes a YAML file strictly, unknown and duplicate keys are errors.
+func load(path string, v any) (*configFile, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	file := &configFile{path: path, lines: keyLines(content)}
+	err = yaml.UnmarshalStrict(content, v)
+	if err == nil {
+		return file, nil
+	}
+	typeError, ok := err.(*yaml.TypeError)
+	if !ok {
+		return nil, &ValidationError{Path: path, Problems: []string{err.Error()}}
+	}
+	// Unknown keys and values of the wrong type are reported with the
+	// problems Validate finds in the rest of the file, decoded leniently.
+	file.problems = typeError.Errors
+	if err := yaml.Unmarshal(content, v); err != nil {
+		if _, ok := err.(*yaml.TypeError); !ok {
+			return nil, &ValidationError{Path: path, Problems: []string{err.Error()}}
+		}
+	}
+	return file, nil
+}
@@ -0,0 +1,164 @@
+package config
+
+import (
+	"fmt"
+	"infiniband_exporter/util"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// EnvPrefix prefixes the environment variables overriding the configuration.
+const EnvPrefix = "INFINIBAND_EXPORTER_"
+
+type field struct {
+	key   string
+	value reflect.Value
+	short string
+	help  string
+}
+
+// fields lists the leaves of the configuration with their dotted keys.
+func fields(v reflect.Value, prefix string) []field {
+	var leaves []field
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		structField := t.Field(i)
+		key := strings.Split(structField.Tag.Get("yaml"), ",")[0]
+		if prefix != "" {
+			key = fmt.Sprintf("%s.%s", prefix, key)
+		}
+		value := v.Field(i)
+		if value.Kind() == reflect.Struct {
+			leaves = append(leaves, fields(value, key)...)
+			continue
+		}
+		leaves = append(leaves, field{
+			key:   key,
+			value: value,
+			short: structField.Tag.Get("short"),
+			help:  structField.Tag.Get("help"),
+		})
+	}
+	return leaves
+}
+
+// EnvName returns the environment variable of a key, e.g. server.port gives
+// INFINIBAND_EXPORTER_SERVER_PORT.
+func EnvName(key string) string {
+	return EnvPrefix + strings.ToUpper(util.CamelToSnake(strings.ReplaceAll(key, ".", "_")))
+}
+
+// AddFlags defines a flag for every key of the configuration. The returned
+// configuration receives the flag values; only the flags set on the command
+// line override the file and the environment, see Resolve.
+func AddFlags(fs *pflag.FlagSet) *Config {
+	flagConfig := Default()
+	for _, f := range fields(reflect.ValueOf(flagConfig).Elem(), "") {
+		help := fmt.Sprintf("%s (env %s)", f.help, EnvName(f.key))
+		if f.help == "" {
+			help = fmt.Sprintf("env %s", EnvName(f.key))
+		}
+		switch pointer := f.value.Addr().Interface().(type) {
+		case *string:
+			fs.StringVarP(pointer, f.key, f.short, *pointer, help)
+		case *int:
+			fs.IntVarP(pointer, f.key, f.short, *pointer, help)
+		case *int64:
+			fs.Int64VarP(pointer, f.key, f.short, *pointer, help)
+		case *float64:
+			fs.Float64VarP(pointer, f.key, f.short, *pointer, help)
+		case *bool:
+			fs.BoolVarP(pointer, f.key, f.short, *pointer, help)
+		case *time.Duration:
+			fs.DurationVarP(pointer, f.key, f.short, *pointer, help)
+		case *[]string:
+			fs.StringSliceVarP(pointer, f.key, f.short, *pointer, help)
+		default:
+			panic(fmt.Sprintf("config key %s has an unsupported type %T", f.key, pointer))
+		}
+	}
+	return flagConfig
+}
+
+// Resolve builds the configuration from, by increasing precedence, the
+// defaults, the file at path when not empty, the environment and the flags
+// changed on the command line, and validates the result.
+func Resolve(path string, fs *pflag.FlagSet, flagConfig *Config) (*Config, error) {
+	config := Default()
+	file := &configFile{path: "configuration"}
+	if path != "" {
+		var err error
+		if file, err = load(path, config); err != nil {
+			return nil, err
+		}
+	}
+	configFields := fields(reflect.ValueOf(config).Elem(), "")
+	var problems []string
+	for _, f := range configFields {
+		if value, exists := os.LookupEnv(EnvName(f.key)); exists {
+			if err := setString(f.value, value); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %s", EnvName(f.key), err))
+			}
+		}
+	}
+	if fs != nil && flagConfig != nil {
+		for i, f := range fields(reflect.ValueOf(flagConfig).Elem(), "") {
+			if fs.Changed(f.key) {
+				configFields[i].value.Set(f.value)
+			}
+		}
+	}
+	problems = append(problems, config.Validate()...)
+	return config, file.check(problems)
+}
+
+func setString(value reflect.Value, s string) error {
+	switch value.Interface().(type) {
+	case time.Duration:
+		duration, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		value.SetInt(int64(duration))
+		return nil
+	}
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(s)
+	case reflect.Int, reflect.Int64:
+		number, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		value.SetInt(number)
+	case reflect.Float64:
+		number, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		value.SetFloat(number)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		value.SetBool(b)
+	case reflect.Slice:
+		// Comma separated, like the flag.
+		var items []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		value.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", value.Type())
+	}
+	return nil
+}
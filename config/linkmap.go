@@ -0,0 +1,158 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Link is one entry of the link map, config.yaml, keyed by
+// <remoteGuid>_<remotePort>: the switch port and what is plugged into it.
+// Fields are in the order yaml.v2 used to write the generated maps.
+type Link struct {
+	LocalGuid  string `yaml:"localGuid"`
+	LocalName  string `yaml:"localName"`
+	LocalPort  string `yaml:"localPort"`
+	RemoteGuid string `yaml:"remoteGuid"`
+	RemoteName string `yaml:"remoteName"`
+	RemotePort string `yaml:"remotePort"`
+	State      string `yaml:"state"`
+	// Removed marks a link no longer seen by ibdiagnet, kept so that its
+	// names survive until someone deletes it on purpose.
+	Removed bool `yaml:"removed,omitempty"`
+}
+
+type LinkMap map[string]*Link
+
+// LoadLinkMap reads and validates a link map, returning a ValidationError
+// listing every problem found.
+func LoadLinkMap(path string) (LinkMap, error) {
+	linkMap := make(LinkMap)
+	file, err := load(path, &linkMap)
+	if err != nil {
+		return nil, err
+	}
+	return linkMap, file.check(linkMap.Validate())
+}
+
+// Cache returns the link map in the form util.SetCache expects. The links
+// marked removed are left out, a decommissioned port is not reported DOWN.
+func (m LinkMap) Cache() map[string]map[string]string {
+	cache := make(map[string]map[string]string, len(m))
+	for key, link := range m {
+		if link == nil || link.Removed {
+			continue
+		}
+		cache[key] = map[string]string{}
+		for _, field := range link.fields() {
+			if field[0] != "removed" {
+				cache[key][field[0]] = field[1]
+			}
+		}
+	}
+	return cache
+}
+
+// Marshal writes the link map with sorted keys, so that regenerating an
+// unchanged fabric gives the same file.
+func (m LinkMap) Marshal() ([]byte, error) {
+	return yaml.Marshal(map[string]*Link(m))
+}
+
+func (m LinkMap) Keys() []string {
+	return sortedKeys(m)
+}
+
+// Merge returns the generated link map updated with the existing one: names
+// set by hand are kept as long as the same peer is plugged in, and links that
+// disappeared are kept and marked removed.
+func Merge(existing LinkMap, generated LinkMap) LinkMap {
+	merged := make(LinkMap, len(generated))
+	for key, link := range generated {
+		link := *link
+		if previous, exists := existing[key]; exists {
+			if previous.RemoteName != "" {
+				link.RemoteName = previous.RemoteName
+			}
+			// A down port has no peer in the run, keep the one we knew.
+			if link.LocalGuid == "" || link.LocalGuid == previous.LocalGuid {
+				link.LocalGuid = previous.LocalGuid
+				if previous.LocalName != "" {
+					link.LocalName = previous.LocalName
+				}
+				if previous.LocalPort != "" {
+					link.LocalPort = previous.LocalPort
+				}
+			}
+		}
+		merged[key] = &link
+	}
+	for key, link := range existing {
+		if _, exists := merged[key]; !exists {
+			removed := *link
+			removed.Removed = true
+			merged[key] = &removed
+		}
+	}
+	return merged
+}
+
+// Diff describes, one line per link and sorted by key, what changes from
+// oldMap to newMap: + added, - deleted, ~ changed fields.
+func Diff(oldMap LinkMap, newMap LinkMap) []string {
+	keys := newMap.Keys()
+	for _, key := range oldMap.Keys() {
+		if _, exists := newMap[key]; !exists {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var lines []string
+	for _, key := range keys {
+		oldLink, newLink := oldMap[key], newMap[key]
+		switch {
+		case oldLink == nil:
+			lines = append(lines, fmt.Sprintf("+ %s %s", key, newLink))
+		case newLink == nil:
+			lines = append(lines, fmt.Sprintf("- %s %s", key, oldLink))
+		default:
+			var changes []string
+			oldFields, newFields := oldLink.fields(), newLink.fields()
+			for i, field := range oldFields {
+				if field[1] != newFields[i][1] {
+					changes = append(changes, fmt.Sprintf("%s: %q -> %q", field[0], field[1], newFields[i][1]))
+				}
+			}
+			if len(changes) > 0 {
+				lines = append(lines, fmt.Sprintf("~ %s %s", key, strings.Join(changes, ", ")))
+			}
+		}
+	}
+	return lines
+}
+
+func (l *Link) fields() [][2]string {
+	return [][2]string{
+		{"localGuid", l.LocalGuid},
+		{"localName", l.LocalName},
+		{"localPort", l.LocalPort},
+		{"remoteGuid", l.RemoteGuid},
+		{"remoteName", l.RemoteName},
+		{"remotePort", l.RemotePort},
+		{"state", l.State},
+		{"removed", fmt.Sprint(l.Removed)},
+	}
+}
+
+func (l *Link) String() string {
+	var fields []string
+	for _, field := range l.fields() {
+		if field[0] == "removed" && !l.Removed {
+			continue
+		}
+		fields = append(fields, fmt.Sprintf("%s=%q", field[0], field[1]))
+	}
+	return strings.Join(fields, " ")
+}
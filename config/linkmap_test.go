@@ -0,0 +1,140 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+const (
+	spineGuid = "0xb0cf0e0300d34100"
+	leafGuid  = "0xb0cf0e0300e5a0c0"
+	hostGuid  = "0x946dae0300a1b2c4"
+)
+
+func TestMerge(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		existing  *Link
+		generated *Link
+		merged    Link
+	}{
+		{
+			"new link",
+			nil,
+			&Link{LocalGuid: leafGuid, LocalName: "LEAF01", RemoteGuid: spineGuid, RemoteName: "SPAN01", RemotePort: "1", State: "ACT"},
+			Link{LocalGuid: leafGuid, LocalName: "LEAF01", RemoteGuid: spineGuid, RemoteName: "SPAN01", RemotePort: "1", State: "ACT"},
+		},
+		{
+			"names set by hand kept",
+			&Link{LocalGuid: leafGuid, LocalName: "leaf-a1", RemoteGuid: spineGuid, RemoteName: "spine-a", RemotePort: "1", State: "ACT"},
+			&Link{LocalGuid: leafGuid, LocalName: "LEAF01", RemoteGuid: spineGuid, RemoteName: "SPAN01", RemotePort: "1", State: "ACT"},
+			Link{LocalGuid: leafGuid, LocalName: "leaf-a1", RemoteGuid: spineGuid, RemoteName: "spine-a", RemotePort: "1", State: "ACT"},
+		},
+		{
+			"down port keeps its peer",
+			&Link{LocalGuid: hostGuid, LocalName: "node01 HCA-1", LocalPort: "1", RemoteGuid: spineGuid, RemoteName: "SPAN01", RemotePort: "1", State: "ACT"},
+			&Link{RemoteGuid: spineGuid, RemoteName: "SPAN01", RemotePort: "1", State: "DOWN"},
+			Link{LocalGuid: hostGuid, LocalName: "node01 HCA-1", LocalPort: "1", RemoteGuid: spineGuid, RemoteName: "SPAN01", RemotePort: "1", State: "DOWN"},
+		},
+		{
+			"another peer plugged in",
+			&Link{LocalGuid: hostGuid, LocalName: "node01 HCA-1", LocalPort: "1", RemoteGuid: spineGuid, RemoteName: "spine-a", RemotePort: "1", State: "ACT"},
+			&Link{LocalGuid: leafGuid, LocalName: "LEAF01", RemoteGuid: spineGuid, RemoteName: "SPAN01", RemotePort: "1", State: "ACT"},
+			Link{LocalGuid: leafGuid, LocalName: "LEAF01", RemoteGuid: spineGuid, RemoteName: "spine-a", RemotePort: "1", State: "ACT"},
+		},
+		{
+			"link gone marked removed",
+			&Link{LocalGuid: leafGuid, LocalName: "leaf-a1", RemoteGuid: spineGuid, RemoteName: "spine-a", RemotePort: "1", State: "ACT"},
+			nil,
+			Link{LocalGuid: leafGuid, LocalName: "leaf-a1", RemoteGuid: spineGuid, RemoteName: "spine-a", RemotePort: "1", State: "ACT", Removed: true},
+		},
+		{
+			"removed link back",
+			&Link{LocalGuid: leafGuid, LocalName: "leaf-a1", RemoteGuid: spineGuid, RemoteName: "spine-a", RemotePort: "1", State: "ACT", Removed: true},
+			&Link{LocalGuid: leafGuid, LocalName: "LEAF01", RemoteGuid: spineGuid, RemoteName: "SPAN01", RemotePort: "1", State: "ACT"},
+			Link{LocalGuid: leafGuid, LocalName: "leaf-a1", RemoteGuid: spineGuid, RemoteName: "spine-a", RemotePort: "1", State: "ACT"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			key := spineGuid + "_1"
+			existing, generated := make(LinkMap), make(LinkMap)
+			if test.existing != nil {
+				existing[key] = test.existing
+			}
+			if test.generated != nil {
+				generated[key] = test.generated
+			}
+			merged := Merge(existing, generated)
+			if len(merged) != 1 || !reflect.DeepEqual(*merged[key], test.merged) {
+				t.Errorf("merged %v, expected %v", merged[key], &test.merged)
+			}
+		})
+	}
+}
+
+// TestMergeUnchanged merges the sample link maps with themselves, which must
+// leave them as they are.
+func TestMergeUnchanged(t *testing.T) {
+	for _, path := range []string{"cherry_config.yaml", "sequoia_config.yaml"} {
+		linkMap, err := LoadLinkMap(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		merged := Merge(linkMap, linkMap)
+		if lines := Diff(linkMap, merged); len(lines) > 0 {
+			t.Errorf("%s changed by merging it with itself: %v", path, lines)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	oldMap := LinkMap{
+		spineGuid + "_1": {LocalGuid: leafGuid, LocalName: "LEAF01", RemoteGuid: spineGuid, RemoteName: "SPAN01", RemotePort: "1", State: "ACT"},
+		spineGuid + "_2": {RemoteGuid: spineGuid, RemoteName: "SPAN01", RemotePort: "2", State: "DOWN"},
+	}
+	newMap := LinkMap{
+		spineGuid + "_1": {LocalGuid: leafGuid, LocalName: "leaf-a1", RemoteGuid: spineGuid, RemoteName: "SPAN01", RemotePort: "1", State: "ACT"},
+		spineGuid + "_3": {RemoteGuid: spineGuid, RemoteName: "SPAN01", RemotePort: "3", State: "DOWN"},
+	}
+	expected := []string{
+		`~ 0xb0cf0e0300d34100_1 localName: "LEAF01" -> "leaf-a1"`,
+		`- 0xb0cf0e0300d34100_2 localGuid="" localName="" localPort="" remoteGuid="0xb0cf0e0300d34100" remoteName="SPAN01" remotePort="2" state="DOWN"`,
+		`+ 0xb0cf0e0300d34100_3 localGuid="" localName="" localPort="" remoteGuid="0xb0cf0e0300d34100" remoteName="SPAN01" remotePort="3" state="DOWN"`,
+	}
+	if lines := Diff(oldMap, newMap); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("diff %q, expected %q", lines, expected)
+	}
+}
+
+func TestCache(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		link  *Link
+		cache map[string]map[string]string
+	}{
+		{
+			"link",
+			&Link{LocalGuid: leafGuid, LocalName: "LEAF01", RemoteGuid: spineGuid, RemoteName: "SPAN01", RemotePort: "1", State: "ACT"},
+			map[string]map[string]string{spineGuid + "_1": {
+				"localGuid": leafGuid, "localName": "LEAF01", "localPort": "",
+				"remoteGuid": spineGuid, "remoteName": "SPAN01", "remotePort": "1", "state": "ACT",
+			}},
+		},
+		{
+			"removed link left out",
+			&Link{LocalGuid: leafGuid, RemoteGuid: spineGuid, RemoteName: "SPAN01", RemotePort: "1", State: "ACT", Removed: true},
+			map[string]map[string]string{},
+		},
+		{
+			"empty link left out",
+			nil,
+			map[string]map[string]string{},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if cache := (LinkMap{spineGuid + "_1": test.link}).Cache(); !reflect.DeepEqual(cache, test.cache) {
+				t.Errorf("cache %v, expected %v", cache, test.cache)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	guidExpr    = regexp.MustCompile(`^0x[0-9a-fA-F]{16}$`)
+	linkKeyExpr = regexp.MustCompile(`^(0x[0-9a-fA-F]{16})_(\d+)$`)
+	portExpr    = regexp.MustCompile(`^\d*$`)
+	keyLineExpr = regexp.MustCompile(`^( *)("[^"]*"|'[^']*'|[^\s#'"-][^:#]*?):(\s|$)`)
+)
+
+// ValidationError lists every problem found in a configuration file, one per
+// line prefixed with the file path.
+type ValidationError struct {
+	Path     string
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	lines := make([]string, len(e.Problems))
+	for i, problem := range e.Problems {
+		lines[i] = fmt.Sprintf("%s: %s", e.Path, problem)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// configFile is a decoded configuration file with the problems found
+// decoding it and the line of every key, for the problems found later to
+// point at.
+type configFile struct {
+	path     string
+	lines    map[string]int
+	problems []string
+}
+
+// check returns a ValidationError listing the decoding problems of the file
+// followed by problems, each prefixed with the line of the key it starts
+// with when the file has it.
+func (f *configFile) check(problems []string) error {
+	all := f.problems
+	for _, problem := range problems {
+		key, _, _ := strings.Cut(problem, ": ")
+		if line, exists := f.lines[key]; exists {
+			problem = fmt.Sprintf("line %d: %s", line, problem)
+		}
+		all = append(all, problem)
+	}
+	if len(all) == 0 {
+		return nil
+	}
+	return &ValidationError{Path: f.path, Problems: all}
+}
+
+// keyLines maps the dotted path of every key of a block style YAML document,
+// e.g. push.remoteWrite.url, to the line it is on.
+func keyLines(content []byte) map[string]int {
+	type key struct {
+		indent int
+		name   string
+	}
+	lines := make(map[string]int)
+	var parents []key
+	for i, line := range strings.Split(string(content), "\n") {
+		match := keyLineExpr.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		indent := len(match[1])
+		for len(parents) > 0 && parents[len(parents)-1].indent >= indent {
+			parents = parents[:len(parents)-1]
+		}
+		parents = append(parents, key{indent, strings.Trim(match[2], `"'`)})
+		names := make([]string, len(parents))
+		for j, parent := range parents {
+			names[j] = parent.name
+		}
+		if path := strings.Join(names, "."); lines[path] == 0 {
+			lines[path] = i + 1
+		}
+	}
+	return lines
+}
+
+// Validate checks every link of the map: the key is <remoteGuid>_<remotePort>
+// of the link, GUIDs are 0x followed by 16 hex digits, and no peer port is
+// plugged into two switch ports. Switches reached over several links are
+// only reported when their port is known.
+func (m LinkMap) Validate() []string {
+	var problems []string
+	switches := make(map[string]bool)
+	for _, link := range m {
+		if link != nil {
+			switches[link.RemoteGuid] = true
+		}
+	}
+	peers := make(map[string]string)
+	for _, key := range m.Keys() {
+		link := m[key]
+		if link == nil {
+			problems = append(problems, fmt.Sprintf("%s: empty link", key))
+			continue
+		}
+		match := linkKeyExpr.FindStringSubmatch(key)
+		if match == nil {
+			problems = append(problems, fmt.Sprintf("%s: key is not <guid>_<port>", key))
+		} else {
+			if !strings.EqualFold(match[1], link.RemoteGuid) {
+				problems = append(problems, fmt.Sprintf("%s: remoteGuid %q does not match the key", key, link.RemoteGuid))
+			}
+			if match[2] != link.RemotePort {
+				problems = append(problems, fmt.Sprintf("%s: remotePort %q does not match the key", key, link.RemotePort))
+			}
+		}
+		if !guidExpr.MatchString(link.RemoteGuid) {
+			problems = append(problems, fmt.Sprintf("%s: remoteGuid %q is not a GUID", key, link.RemoteGuid))
+		}
+		if link.LocalGuid != "" && !guidExpr.MatchString(link.LocalGuid) {
+			problems = append(problems, fmt.Sprintf("%s: localGuid %q is not a GUID", key, link.LocalGuid))
+		}
+		if !portExpr.MatchString(link.LocalPort) {
+			problems = append(problems, fmt.Sprintf("%s: localPort %q is not a port number", key, link.LocalPort))
+		}
+		if link.LocalGuid == "" || link.Removed || (link.LocalPort == "" && switches[link.LocalGuid]) {
+			continue
+		}
+		peer := fmt.Sprintf("%s_%s", strings.ToLower(link.LocalGuid), link.LocalPort)
+		if other, exists := peers[peer]; exists {
+			problems = append(problems, fmt.Sprintf("%s: peer %s is also linked by %s", key, strings.TrimSuffix(peer, "_"), other))
+		} else {
+			peers[peer] = key
+		}
+	}
+	return problems
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
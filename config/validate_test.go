@@ -0,0 +1,174 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLinkMapValidate(t *testing.T) {
+	otherLeafGuid := "0xb0cf0e0300e59a00"
+	for _, test := range []struct {
+		name     string
+		linkMap  LinkMap
+		problems []string
+	}{
+		{
+			"valid",
+			LinkMap{
+				spineGuid + "_1": {LocalGuid: leafGuid, RemoteGuid: spineGuid, RemotePort: "1"},
+				spineGuid + "_2": {LocalGuid: hostGuid, LocalPort: "1", RemoteGuid: spineGuid, RemotePort: "2"},
+				spineGuid + "_3": {RemoteGuid: spineGuid, RemotePort: "3", State: "DOWN"},
+			},
+			nil,
+		},
+		{
+			"empty link",
+			LinkMap{spineGuid + "_1": nil},
+			[]string{spineGuid + "_1: empty link"},
+		},
+		{
+			"key not guid_port",
+			LinkMap{"SPAN01_1": {RemoteGuid: spineGuid, RemotePort: "1"}},
+			[]string{"SPAN01_1: key is not <guid>_<port>"},
+		},
+		{
+			"key mismatch",
+			LinkMap{spineGuid + "_1": {RemoteGuid: leafGuid, RemotePort: "2"}},
+			[]string{
+				spineGuid + `_1: remoteGuid "` + leafGuid + `" does not match the key`,
+				spineGuid + `_1: remotePort "2" does not match the key`,
+			},
+		},
+		{
+			"bad GUIDs and port",
+			LinkMap{spineGuid + "_1": {LocalGuid: "0x123", LocalPort: "a", RemoteGuid: spineGuid, RemotePort: "1"}},
+			[]string{
+				spineGuid + `_1: localGuid "0x123" is not a GUID`,
+				spineGuid + `_1: localPort "a" is not a port number`,
+			},
+		},
+		{
+			"peer port linked twice",
+			LinkMap{
+				spineGuid + "_1": {LocalGuid: hostGuid, LocalPort: "1", RemoteGuid: spineGuid, RemotePort: "1"},
+				spineGuid + "_2": {LocalGuid: hostGuid, LocalPort: "1", RemoteGuid: spineGuid, RemotePort: "2"},
+			},
+			[]string{spineGuid + "_2: peer " + hostGuid + "_1 is also linked by " + spineGuid + "_1"},
+		},
+		{
+			"peer linked twice without a port",
+			LinkMap{
+				spineGuid + "_1": {LocalGuid: hostGuid, RemoteGuid: spineGuid, RemotePort: "1"},
+				spineGuid + "_2": {LocalGuid: hostGuid, RemoteGuid: spineGuid, RemotePort: "2"},
+			},
+			[]string{spineGuid + "_2: peer " + hostGuid + " is also linked by " + spineGuid + "_1"},
+		},
+		{
+			"switch reached over several links",
+			LinkMap{
+				spineGuid + "_1":     {LocalGuid: leafGuid, RemoteGuid: spineGuid, RemotePort: "1"},
+				spineGuid + "_2":     {LocalGuid: leafGuid, RemoteGuid: spineGuid, RemotePort: "2"},
+				leafGuid + "_1":      {LocalGuid: spineGuid, RemoteGuid: leafGuid, RemotePort: "1"},
+				otherLeafGuid + "_1": {LocalGuid: spineGuid, RemoteGuid: otherLeafGuid, RemotePort: "1"},
+			},
+			nil,
+		},
+		{
+			"removed link ignored",
+			LinkMap{
+				spineGuid + "_1": {LocalGuid: hostGuid, LocalPort: "1", RemoteGuid: spineGuid, RemotePort: "1", Removed: true},
+				spineGuid + "_2": {LocalGuid: hostGuid, LocalPort: "1", RemoteGuid: spineGuid, RemotePort: "2"},
+			},
+			nil,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if problems := test.linkMap.Validate(); !reflect.DeepEqual(problems, test.problems) {
+				t.Errorf("problems %q, expected %q", problems, test.problems)
+			}
+		})
+	}
+}
+
+func TestLoadLinkMap(t *testing.T) {
+	for _, path := range []string{"cherry_config.yaml", "sequoia_config.yaml"} {
+		if _, err := LoadLinkMap(path); err != nil {
+			t.Errorf("%s: %s", path, err)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := spineGuid + "_1:\n  remoteGuid: \"" + spineGuid + "\"\n  remotePort: \"1\"\n  remoteNmae: SPAN01\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := LoadLinkMap(path)
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || validationErr.Path != path || len(validationErr.Problems) != 1 {
+		t.Errorf("expected a ValidationError for the misspelt field, got %v", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		change   func(c *Config)
+		problems []string
+	}{
+		{"default", func(c *Config) {}, nil},
+		{"mode", func(c *Config) { c.Mode = "prod" }, []string{`mode: "prod" is not one of local, agent, dev, replay`}},
+		{"port", func(c *Config) { c.Server.Port = 70000 }, []string{"server.port: 70000 is not a port"}},
+		{"negative", func(c *Config) { c.Push.RemoteWrite.Retries = -1 }, []string{"push.remoteWrite.retries: must not be negative"}},
+		{
+			"push without target",
+			func(c *Config) { c.Push.OnScrape = true },
+			[]string{"push: interval or onScrape set without a remoteWrite, pushgateway, otlp, influx or json target"},
+		},
+		{
+			"otlp protocol",
+			func(c *Config) { c.Push.Otlp.Protocol = "udp" },
+			[]string{`push.otlp.protocol: "udp" is not one of http, grpc`},
+		},
+		{
+			"half filled sync data",
+			func(c *Config) {
+				c.SyncDataConfig = SyncData{IpAddress: "10.4.101.1", User: "admin", HostIpAddress: "10.4.254.250", HostFilePath: "data/ib.tgz"}
+			},
+			[]string{"syncDataConfig.hostUser: missing", `syncDataConfig.hostFilePath: "data/ib.tgz" is not an absolute path`},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := Default()
+			test.change(c)
+			if problems := c.Validate(); !reflect.DeepEqual(problems, test.problems) {
+				t.Errorf("problems %q, expected %q", problems, test.problems)
+			}
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "exporter.yaml")
+	content := "mode: prod\nserver:\n  port: 70000\n  hots: 0.0.0.0\npush:\n  remoteWrite:\n    retries: -1\n    timeout: soon\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := LoadConfig(path)
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("expected a ValidationError, got %v", err)
+	}
+	// The unknown key does not hide the problems found past it.
+	expected := []string{
+		"line 4: field hots not found in type config.Server",
+		"line 8: cannot unmarshal !!str `soon` into time.Duration",
+		`line 1: mode: "prod" is not one of local, agent, dev, replay`,
+		"line 3: server.port: 70000 is not a port",
+		"line 7: push.remoteWrite.retries: must not be negative",
+	}
+	if !reflect.DeepEqual(validationErr.Problems, expected) {
+		t.Errorf("problems %q, expected %q", validationErr.Problems, expected)
+	}
+}
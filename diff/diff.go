@@ -0,0 +1,336 @@
+package diff
+
+import (
+	"encoding/json"
+	"fmt"
+	"infiniband_exporter/ibdiagnet2"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// DefaultThresholds are the counters reported by default, with the smallest
+// increase worth reporting. Traffic counters are left out as they always move.
+var DefaultThresholds = map[string]float64{
+	"symbol_error_counter_extended":            1,
+	"link_error_recovery_counter_extended":     1,
+	"link_downed_counter_extended":             1,
+	"port_rcv_errors_extended":                 1,
+	"port_rcv_remote_physical_errors_extended": 1,
+	"port_xmit_discards_extended":              1,
+	"local_link_integrity_errors_extended":     1,
+	"excessive_buffer_overrun_errors_extended": 1,
+	"port_local_physical_errors":               1,
+}
+
+type Report struct {
+	OldRunTime      time.Time        `json:"oldRunTime"`
+	NewRunTime      time.Time        `json:"newRunTime"`
+	NodesAdded      []NodeChange     `json:"nodesAdded"`
+	NodesRemoved    []NodeChange     `json:"nodesRemoved"`
+	LinkChanges     []LinkChange     `json:"linkChanges"`
+	FirmwareChanges []FirmwareChange `json:"firmwareChanges"`
+	CounterDeltas   []CounterDelta   `json:"counterDeltas"`
+}
+
+type NodeChange struct {
+	Guid      string `json:"guid"`
+	Name      string `json:"name"`
+	Component string `json:"component"`
+}
+
+// LinkChange is a port whose state, peer, width or speed changed. A port
+// missing on one side has an empty Old or New.
+type LinkChange struct {
+	Guid  string `json:"guid"`
+	Name  string `json:"name"`
+	Port  string `json:"port"`
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+type FirmwareChange struct {
+	Guid string `json:"guid"`
+	Name string `json:"name"`
+	Old  string `json:"old"`
+	New  string `json:"new"`
+}
+
+type CounterDelta struct {
+	Guid    string  `json:"guid"`
+	Name    string  `json:"name"`
+	Port    string  `json:"port"`
+	Counter string  `json:"counter"`
+	Old     float64 `json:"old"`
+	New     float64 `json:"new"`
+	Delta   float64 `json:"delta"`
+}
+
+// Compare returns what changed from oldFabric to newFabric. Counters are only
+// reported when they grew by at least their threshold; a counter that went
+// backwards was reset and is reported with its new value as delta.
+func Compare(oldFabric *ibdiagnet2.Fabric, newFabric *ibdiagnet2.Fabric, thresholds map[string]float64) *Report {
+	report := &Report{
+		OldRunTime:      oldFabric.RunTime,
+		NewRunTime:      newFabric.RunTime,
+		NodesAdded:      []NodeChange{},
+		NodesRemoved:    []NodeChange{},
+		LinkChanges:     []LinkChange{},
+		FirmwareChanges: []FirmwareChange{},
+		CounterDeltas:   []CounterDelta{},
+	}
+	for guid, node := range newFabric.Nodes {
+		if _, exists := oldFabric.Nodes[guid]; !exists {
+			report.NodesAdded = append(report.NodesAdded, NodeChange{node.Guid, node.Name, node.Component})
+		}
+	}
+	for guid, node := range oldFabric.Nodes {
+		newNode, exists := newFabric.Nodes[guid]
+		if !exists {
+			report.NodesRemoved = append(report.NodesRemoved, NodeChange{node.Guid, node.Name, node.Component})
+			continue
+		}
+		// NODES_INFO is missing from the runs skipping nodes_info, an unknown
+		// firmware is not a change.
+		if node.Firmware != newNode.Firmware && node.Firmware != "" && newNode.Firmware != "" {
+			report.FirmwareChanges = append(report.FirmwareChanges, FirmwareChange{
+				Guid: guid, Name: newNode.Name, Old: node.Firmware, New: newNode.Firmware,
+			})
+		}
+	}
+
+	for _, key := range unionKeys(oldFabric.Ports, newFabric.Ports) {
+		oldPort, newPort := oldFabric.Ports[key], newFabric.Ports[key]
+		port := newPort
+		if port == nil {
+			port = oldPort
+		}
+		var oldValues, newValues [4]string
+		if oldPort != nil {
+			oldValues = [4]string{oldPort.State, peer(oldPort), oldPort.Width, oldPort.Speed}
+		}
+		if newPort != nil {
+			newValues = [4]string{newPort.State, peer(newPort), newPort.Width, newPort.Speed}
+		}
+		for i, field := range []string{"state", "peer", "width", "speed"} {
+			if oldValues[i] == newValues[i] {
+				continue
+			}
+			// net_dump only knows the peer GUID of a down port, and width and
+			// speed are unknown for it, neither is a change on its own.
+			if field == "peer" && oldPort != nil && newPort != nil && oldPort.PeerGuid == newPort.PeerGuid &&
+				(oldPort.PeerPort == "" || newPort.PeerPort == "") {
+				continue
+			}
+			if (field == "width" || field == "speed") && (oldValues[i] == "" || newValues[i] == "") {
+				continue
+			}
+			report.LinkChanges = append(report.LinkChanges, LinkChange{
+				Guid: port.Guid, Name: port.Name, Port: port.Port, Field: field, Old: oldValues[i], New: newValues[i],
+			})
+		}
+	}
+
+	for key, newCounters := range newFabric.Counters {
+		oldCounters, exists := oldFabric.Counters[key]
+		if !exists {
+			continue
+		}
+		guid, port, _ := strings.Cut(key, "_")
+		var name string
+		if node, exists := newFabric.Nodes[guid]; exists {
+			name = node.Name
+		}
+		for counter, threshold := range thresholds {
+			newValue, newExists := newCounters[counter]
+			oldValue, oldExists := oldCounters[counter]
+			if !newExists || !oldExists {
+				continue
+			}
+			delta := newValue - oldValue
+			if delta < 0 {
+				delta = newValue
+			}
+			if delta == 0 || delta < threshold {
+				continue
+			}
+			report.CounterDeltas = append(report.CounterDeltas, CounterDelta{
+				Guid: guid, Name: name, Port: port, Counter: counter, Old: oldValue, New: newValue, Delta: delta,
+			})
+		}
+	}
+	report.sort()
+	return report
+}
+
+func (r *Report) sort() {
+	sort.Slice(r.NodesAdded, func(i, j int) bool { return r.NodesAdded[i].Guid < r.NodesAdded[j].Guid })
+	sort.Slice(r.NodesRemoved, func(i, j int) bool { return r.NodesRemoved[i].Guid < r.NodesRemoved[j].Guid })
+	sort.Slice(r.FirmwareChanges, func(i, j int) bool { return r.FirmwareChanges[i].Guid < r.FirmwareChanges[j].Guid })
+	sort.Slice(r.LinkChanges, func(i, j int) bool {
+		a, b := r.LinkChanges[i], r.LinkChanges[j]
+		if a.Guid != b.Guid {
+			return a.Guid < b.Guid
+		}
+		if a.Port != b.Port {
+			return portLess(a.Port, b.Port)
+		}
+		return a.Field < b.Field
+	})
+	sort.Slice(r.CounterDeltas, func(i, j int) bool {
+		a, b := r.CounterDeltas[i], r.CounterDeltas[j]
+		if a.Guid != b.Guid {
+			return a.Guid < b.Guid
+		}
+		if a.Port != b.Port {
+			return portLess(a.Port, b.Port)
+		}
+		return a.Counter < b.Counter
+	})
+}
+
+// Empty tells whether nothing changed.
+func (r *Report) Empty() bool {
+	return len(r.NodesAdded)+len(r.NodesRemoved)+len(r.LinkChanges)+len(r.FirmwareChanges)+len(r.CounterDeltas) == 0
+}
+
+// Write renders the report as text, json or markdown.
+func (r *Report) Write(w io.Writer, format string) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(r)
+	case "markdown":
+		return r.writeTables(w, true)
+	case "text":
+		return r.writeTables(w, false)
+	default:
+		return fmt.Errorf("unknown format %s, expected text, json or markdown", format)
+	}
+}
+
+func (r *Report) writeTables(w io.Writer, markdown bool) error {
+	var sections []section
+	sections = append(sections, section{"Nodes added", []string{"GUID", "Name", "Component"}, nodeRows(r.NodesAdded)})
+	sections = append(sections, section{"Nodes removed", []string{"GUID", "Name", "Component"}, nodeRows(r.NodesRemoved)})
+	var rows [][]string
+	for _, change := range r.LinkChanges {
+		rows = append(rows, []string{change.Guid, change.Name, change.Port, change.Field, orNone(change.Old), orNone(change.New)})
+	}
+	sections = append(sections, section{"Link changes", []string{"GUID", "Name", "Port", "Field", "Old", "New"}, rows})
+	rows = nil
+	for _, change := range r.FirmwareChanges {
+		rows = append(rows, []string{change.Guid, change.Name, orNone(change.Old), orNone(change.New)})
+	}
+	sections = append(sections, section{"Firmware changes", []string{"GUID", "Name", "Old", "New"}, rows})
+	rows = nil
+	for _, delta := range r.CounterDeltas {
+		rows = append(rows, []string{
+			delta.Guid, delta.Name, delta.Port, delta.Counter,
+			formatValue(delta.Old), formatValue(delta.New), formatValue(delta.Delta),
+		})
+	}
+	sections = append(sections, section{"Counter deltas", []string{"GUID", "Name", "Port", "Counter", "Old", "New", "Delta"}, rows})
+
+	layout := time.RFC3339
+	if markdown {
+		fmt.Fprintf(w, "# Fabric diff\n\n%s → %s\n", r.OldRunTime.Format(layout), r.NewRunTime.Format(layout))
+	} else {
+		fmt.Fprintf(w, "Fabric diff %s -> %s\n", r.OldRunTime.Format(layout), r.NewRunTime.Format(layout))
+	}
+	for _, s := range sections {
+		if markdown {
+			s.writeMarkdown(w)
+		} else if err := s.writeText(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type section struct {
+	title   string
+	headers []string
+	rows    [][]string
+}
+
+func (s section) writeText(w io.Writer) error {
+	fmt.Fprintf(w, "\n%s (%d)\n", s.title, len(s.rows))
+	if len(s.rows) == 0 {
+		return nil
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "  %s\n", strings.Join(s.headers, "\t"))
+	for _, row := range s.rows {
+		fmt.Fprintf(tw, "  %s\n", strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+func (s section) writeMarkdown(w io.Writer) {
+	fmt.Fprintf(w, "\n## %s (%d)\n\n", s.title, len(s.rows))
+	if len(s.rows) == 0 {
+		fmt.Fprintln(w, "None.")
+		return
+	}
+	fmt.Fprintf(w, "| %s |\n", strings.Join(s.headers, " | "))
+	fmt.Fprintf(w, "|%s\n", strings.Repeat(" --- |", len(s.headers)))
+	for _, row := range s.rows {
+		cells := make([]string, len(row))
+		for i, cell := range row {
+			cells[i] = strings.ReplaceAll(cell, "|", `\|`)
+		}
+		fmt.Fprintf(w, "| %s |\n", strings.Join(cells, " | "))
+	}
+}
+
+func nodeRows(nodes []NodeChange) [][]string {
+	var rows [][]string
+	for _, node := range nodes {
+		rows = append(rows, []string{node.Guid, node.Name, node.Component})
+	}
+	return rows
+}
+
+func peer(port *ibdiagnet2.FabricPort) string {
+	if port.PeerGuid == "" || port.PeerPort == "" {
+		return port.PeerGuid
+	}
+	return fmt.Sprintf("%s/%s", port.PeerGuid, port.PeerPort)
+}
+
+func unionKeys(a map[string]*ibdiagnet2.FabricPort, b map[string]*ibdiagnet2.FabricPort) []string {
+	var keys []string
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, exists := a[key]; !exists {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// portLess orders port numbers numerically when they are numbers.
+func portLess(a string, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func formatValue(value float64) string {
+	return fmt.Sprintf("%.0f", value)
+}
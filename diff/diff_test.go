@@ -0,0 +1,207 @@
+package diff
+
+import (
+	"bytes"
+	"encoding/json"
+	"infiniband_exporter/ibdiagnet2"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	spineGuid = "0xb0cf0e0300d33fc0"
+	leafGuid  = "0xfc6a1c030091cf00"
+	hostGuid  = "0x5c25730300c09c80"
+)
+
+// testFabric returns a spine whose port 1 links a leaf and port 2 a host.
+func testFabric() *ibdiagnet2.Fabric {
+	return &ibdiagnet2.Fabric{
+		RunTime: time.Date(2025, 3, 31, 23, 43, 18, 0, time.UTC),
+		Nodes: map[string]*ibdiagnet2.FabricNode{
+			spineGuid: {Guid: spineGuid, Name: "SPAN01", Component: "sw", Firmware: "31.2012.1024"},
+			leafGuid:  {Guid: leafGuid, Name: "LEAF01", Component: "sw", Firmware: "31.2012.1024"},
+			hostGuid:  {Guid: hostGuid, Name: "node01 HCA-1", Component: "ca", Firmware: "28.40.1000"},
+		},
+		Ports: map[string]*ibdiagnet2.FabricPort{
+			spineGuid + "_1": {Guid: spineGuid, Name: "SPAN01", Port: "1", State: "ACT", PeerGuid: leafGuid, PeerPort: "1", Width: "4x", Speed: "NDR"},
+			spineGuid + "_2": {Guid: spineGuid, Name: "SPAN01", Port: "2", State: "ACT", PeerGuid: hostGuid, PeerPort: "1", Width: "4x", Speed: "NDR"},
+		},
+		Counters: map[string]map[string]float64{
+			spineGuid + "_1": {"symbol_error_counter_extended": 10, "port_xmit_data_extended": 1000},
+		},
+	}
+}
+
+func TestCompare(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		change func(old *ibdiagnet2.Fabric, new *ibdiagnet2.Fabric)
+		report Report
+	}{
+		{
+			"unchanged",
+			func(old *ibdiagnet2.Fabric, new *ibdiagnet2.Fabric) {},
+			Report{},
+		},
+		{
+			"node added",
+			func(old *ibdiagnet2.Fabric, new *ibdiagnet2.Fabric) {
+				new.Nodes["0x5c25730300c09c81"] = &ibdiagnet2.FabricNode{Guid: "0x5c25730300c09c81", Name: "node02 HCA-1", Component: "ca"}
+			},
+			Report{NodesAdded: []NodeChange{{"0x5c25730300c09c81", "node02 HCA-1", "ca"}}},
+		},
+		{
+			"node removed",
+			func(old *ibdiagnet2.Fabric, new *ibdiagnet2.Fabric) {
+				delete(new.Nodes, hostGuid)
+			},
+			Report{NodesRemoved: []NodeChange{{hostGuid, "node01 HCA-1", "ca"}}},
+		},
+		{
+			"link down",
+			func(old *ibdiagnet2.Fabric, new *ibdiagnet2.Fabric) {
+				// net_dump only knows the peer GUID of a down port.
+				new.Ports[spineGuid+"_2"] = &ibdiagnet2.FabricPort{Guid: spineGuid, Name: "SPAN01", Port: "2", State: "DOWN", PeerGuid: hostGuid}
+			},
+			Report{LinkChanges: []LinkChange{{spineGuid, "SPAN01", "2", "state", "ACT", "DOWN"}}},
+		},
+		{
+			"link moved to another peer",
+			func(old *ibdiagnet2.Fabric, new *ibdiagnet2.Fabric) {
+				new.Ports[spineGuid+"_1"].PeerPort = "2"
+			},
+			Report{LinkChanges: []LinkChange{{spineGuid, "SPAN01", "1", "peer", leafGuid + "/1", leafGuid + "/2"}}},
+		},
+		{
+			"link width and speed",
+			func(old *ibdiagnet2.Fabric, new *ibdiagnet2.Fabric) {
+				new.Ports[spineGuid+"_1"].Width = "2x"
+				new.Ports[spineGuid+"_2"].Speed = ""
+			},
+			Report{LinkChanges: []LinkChange{{spineGuid, "SPAN01", "1", "width", "4x", "2x"}}},
+		},
+		{
+			"link added",
+			func(old *ibdiagnet2.Fabric, new *ibdiagnet2.Fabric) {
+				new.Ports[spineGuid+"_10"] = &ibdiagnet2.FabricPort{Guid: spineGuid, Name: "SPAN01", Port: "10", State: "ACT", PeerGuid: leafGuid, PeerPort: "2", Width: "4x"}
+			},
+			Report{LinkChanges: []LinkChange{
+				{spineGuid, "SPAN01", "10", "peer", "", leafGuid + "/2"},
+				{spineGuid, "SPAN01", "10", "state", "", "ACT"},
+			}},
+		},
+		{
+			"link removed",
+			func(old *ibdiagnet2.Fabric, new *ibdiagnet2.Fabric) {
+				delete(new.Ports, spineGuid+"_2")
+			},
+			Report{LinkChanges: []LinkChange{
+				{spineGuid, "SPAN01", "2", "peer", hostGuid + "/1", ""},
+				{spineGuid, "SPAN01", "2", "state", "ACT", ""},
+			}},
+		},
+		{
+			"without lst",
+			func(old *ibdiagnet2.Fabric, new *ibdiagnet2.Fabric) {
+				for _, port := range old.Ports {
+					port.PeerPort, port.Width, port.Speed = "", "", ""
+				}
+			},
+			Report{},
+		},
+		{
+			"firmware",
+			func(old *ibdiagnet2.Fabric, new *ibdiagnet2.Fabric) {
+				new.Nodes[spineGuid].Firmware = "31.2014.1000"
+				old.Nodes[hostGuid].Firmware = ""
+			},
+			Report{FirmwareChanges: []FirmwareChange{{spineGuid, "SPAN01", "31.2012.1024", "31.2014.1000"}}},
+		},
+		{
+			"counter grew",
+			func(old *ibdiagnet2.Fabric, new *ibdiagnet2.Fabric) {
+				new.Counters[spineGuid+"_1"] = map[string]float64{"symbol_error_counter_extended": 15, "port_xmit_data_extended": 5000}
+			},
+			Report{CounterDeltas: []CounterDelta{{spineGuid, "SPAN01", "1", "symbol_error_counter_extended", 10, 15, 5}}},
+		},
+		{
+			"counter below threshold",
+			func(old *ibdiagnet2.Fabric, new *ibdiagnet2.Fabric) {
+				new.Counters[spineGuid+"_1"] = map[string]float64{"symbol_error_counter_extended": 10.5}
+			},
+			Report{},
+		},
+		{
+			"counter reset",
+			func(old *ibdiagnet2.Fabric, new *ibdiagnet2.Fabric) {
+				new.Counters[spineGuid+"_1"] = map[string]float64{"symbol_error_counter_extended": 3}
+			},
+			Report{CounterDeltas: []CounterDelta{{spineGuid, "SPAN01", "1", "symbol_error_counter_extended", 10, 3, 3}}},
+		},
+		{
+			"without pm",
+			func(old *ibdiagnet2.Fabric, new *ibdiagnet2.Fabric) {
+				old.Counters = make(map[string]map[string]float64)
+			},
+			Report{},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			oldFabric, newFabric := testFabric(), testFabric()
+			newFabric.RunTime = newFabric.RunTime.Add(time.Hour)
+			test.change(oldFabric, newFabric)
+			report := Compare(oldFabric, newFabric, DefaultThresholds)
+			expected := &Report{
+				OldRunTime:      oldFabric.RunTime,
+				NewRunTime:      newFabric.RunTime,
+				NodesAdded:      append([]NodeChange{}, test.report.NodesAdded...),
+				NodesRemoved:    append([]NodeChange{}, test.report.NodesRemoved...),
+				LinkChanges:     append([]LinkChange{}, test.report.LinkChanges...),
+				FirmwareChanges: append([]FirmwareChange{}, test.report.FirmwareChanges...),
+				CounterDeltas:   append([]CounterDelta{}, test.report.CounterDeltas...),
+			}
+			if !reflect.DeepEqual(report, expected) {
+				t.Errorf("report\n%+v, expected\n%+v", report, expected)
+			}
+			if report.Empty() != reflect.DeepEqual(test.report, Report{}) {
+				t.Errorf("Empty() %v", report.Empty())
+			}
+		})
+	}
+}
+
+func TestReportWrite(t *testing.T) {
+	oldFabric, newFabric := testFabric(), testFabric()
+	newFabric.Ports[spineGuid+"_2"].State = "DOWN"
+	report := Compare(oldFabric, newFabric, DefaultThresholds)
+	for _, test := range []struct {
+		format   string
+		contains string
+	}{
+		{"text", "Link changes (1)"},
+		{"markdown", "| " + spineGuid + " | SPAN01 | 2 | state | ACT | DOWN |"},
+		{"json", `"field": "state"`},
+	} {
+		var buf bytes.Buffer
+		if err := report.Write(&buf, test.format); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(buf.String(), test.contains) {
+			t.Errorf("%s output lacks %q:\n%s", test.format, test.contains, buf.String())
+		}
+	}
+	var buf bytes.Buffer
+	if err := report.Write(&buf, "json"); err != nil {
+		t.Fatal(err)
+	}
+	var decoded Report
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil || len(decoded.LinkChanges) != 1 {
+		t.Errorf("json report %v: %v", decoded, err)
+	}
+	if err := report.Write(&buf, "html"); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
@@ -0,0 +1,99 @@
+package ibdiagnet2
+
+import (
+	"fmt"
+	"infiniband_exporter/util"
+	"path/filepath"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector exports the metrics read from one or more ibdiagnet2 output
+// files. Collect parses the files on every call and sends const metrics, so
+// that each scrape sees one consistent snapshot and ports gone from the
+// fabric disappear.
+type Collector interface {
+	prometheus.Collector
+}
+
+// CollectorContext is what the collectors of one scrape are built from.
+type CollectorContext struct {
+	DataDir string
+	// DbCsv is the db_csv of DataDir, parsed once for every collector.
+	DbCsv      *util.DbCsv
+	GetConfig  bool
+	IsMapName  bool
+	PkeyPolicy string
+	// PmMode is PmModeKnown or PmModeAll, see LinkPm.
+	PmMode string
+	// PmCounters restricts the counters exported by the pm collector, all of
+	// them when empty.
+	PmCounters []string
+	// PmSupported adds infiniband_pm_counter_supported to the pm collector.
+	PmSupported bool
+	// Created sets the start time of the counters that have one, see
+	// metricSet.setCounterCreated.
+	Created bool
+	// Fabric makes the collectors keep the files they parse for
+	// BuildFabric.
+	Fabric bool
+	parsed *fabricFiles
+}
+
+// Path returns the ibdiagnet2 output file with the given extension, e.g.
+// Path("pm") for ibdiagnet2.pm.
+func (c *CollectorContext) Path(extension string) string {
+	return filepath.Join(c.DataDir, fmt.Sprintf("ibdiagnet2.%s", extension))
+}
+
+// GetDbCsv returns DbCsv, opening the db_csv of DataDir when it is not set.
+func (c *CollectorContext) GetDbCsv() *util.DbCsv {
+	if c.DbCsv == nil {
+		c.DbCsv = util.NewDbCsv(c.Path("db_csv"))
+	}
+	return c.DbCsv
+}
+
+// getParsed returns where the collectors keep the files they parse, nil
+// unless Fabric is set.
+func (c *CollectorContext) getParsed() *fabricFiles {
+	if !c.Fabric {
+		return nil
+	}
+	if c.parsed == nil {
+		c.parsed = new(fabricFiles)
+	}
+	return c.parsed
+}
+
+var collectorFactories = make(map[string]func(*CollectorContext) Collector)
+
+// registerCollector makes a collector selectable by name, every collector
+// calls it from init().
+func registerCollector(name string, factory func(*CollectorContext) Collector) {
+	if _, exists := collectorFactories[name]; exists {
+		panic(fmt.Sprintf("collector %s registered twice", name))
+	}
+	collectorFactories[name] = factory
+}
+
+// CollectorNames returns the names of the registered collectors, sorted, the
+// order they run in.
+func CollectorNames() []string {
+	var names []string
+	for name := range collectorFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewCollector builds the named collector for one scrape.
+func NewCollector(name string, c *CollectorContext) (Collector, error) {
+	factory, exists := collectorFactories[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown collector %s", name)
+	}
+	return factory(c), nil
+}
@@ -0,0 +1,246 @@
+package ibdiagnet2
+
+import (
+	"errors"
+	"fmt"
+	"infiniband_exporter/global"
+	"infiniband_exporter/util"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var pmCounterNameExpr = regexp.MustCompile(`^\w+$`)
+
+// Fabric is the state of the fabric seen by one ibdiagnet run, built with the
+// same parsers the exporter uses so that offline tools agree with the metrics.
+type Fabric struct {
+	RunTime  time.Time
+	Nodes    map[string]*FabricNode
+	Ports    map[string]*FabricPort
+	Counters map[string]map[string]float64
+}
+
+type FabricNode struct {
+	Guid      string `json:"guid"`
+	Name      string `json:"name"`
+	Component string `json:"component"`
+	Firmware  string `json:"firmware,omitempty"`
+}
+
+type FabricPort struct {
+	Guid     string `json:"guid"`
+	Name     string `json:"name"`
+	Port     string `json:"port"`
+	State    string `json:"state"`
+	PeerGuid string `json:"peerGuid,omitempty"`
+	PeerPort string `json:"peerPort,omitempty"`
+	Width    string `json:"width,omitempty"`
+	Speed    string `json:"speed,omitempty"`
+}
+
+// fabricFiles holds the files the collectors of one context parsed, so that
+// BuildFabric does not read them again. A nil fabricFiles keeps nothing.
+type fabricFiles struct {
+	sync.Mutex
+	netDump  *[]NetDump
+	lst      *[]LstLink
+	counters map[string]map[string]float64
+}
+
+func (f *fabricFiles) setNetDump(netDump *[]NetDump) {
+	if f == nil {
+		return
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.netDump = netDump
+}
+
+func (f *fabricFiles) setLst(lst *[]LstLink) {
+	if f == nil {
+		return
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.lst = lst
+}
+
+func (f *fabricFiles) setCounters(counters map[string]map[string]float64) {
+	if f == nil {
+		return
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.counters = counters
+}
+
+// LoadFabric reads the ibdiagnet2 output in dir. Ports and counters are keyed
+// by <guid>_<port>.
+func LoadFabric(dir string) (*Fabric, error) {
+	return BuildFabric(&CollectorContext{DataDir: dir})
+}
+
+// BuildFabric builds the fabric of the ibdiagnet2 output of c, naming the
+// switches and down ports the way the collectors do. It uses the files the
+// collectors of c parsed when c.Fabric is set, reading the ones they left
+// out, e.g. those of a disabled collector.
+func BuildFabric(c *CollectorContext) (*Fabric, error) {
+	parsed := new(fabricFiles)
+	if c.parsed != nil {
+		c.parsed.Lock()
+		parsed.netDump, parsed.lst, parsed.counters = c.parsed.netDump, c.parsed.lst, c.parsed.counters
+		c.parsed.Unlock()
+	}
+	fabric := &Fabric{
+		Nodes:    make(map[string]*FabricNode),
+		Ports:    make(map[string]*FabricPort),
+		Counters: make(map[string]map[string]float64),
+	}
+	dbCsv := c.GetDbCsv()
+	runTime, err := GetRunTime(dbCsv)
+	if err != nil {
+		return nil, err
+	}
+	fabric.RunTime = runTime
+
+	nodes, err := dbCsv.Section("NODES")
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range *nodes {
+		component := global.ComponentCa
+		if row["NodeType"] == "2" {
+			component = global.ComponentSw
+		}
+		fabric.Nodes[row["NodeGUID"]] = &FabricNode{
+			Guid:      row["NodeGUID"],
+			Name:      row["NodeDesc"],
+			Component: component,
+		}
+	}
+	if rows, err := dbCsv.Section("NODES_INFO"); err == nil {
+		for _, row := range *rows {
+			if node, exists := fabric.Nodes[row["NodeGUID"]]; exists {
+				node.Firmware = getFirmware(row)
+			}
+		}
+	}
+
+	// net_dump lists every switch port, including the down ones ibdiagnet2.lst
+	// leaves out, lst adds the CA side and the link width and speed.
+	netDumps := parsed.netDump
+	if netDumps == nil {
+		netDump := LinkNetDump{FilePath: c.Path("net_dump"), GetConfig: c.GetConfig, IsMapName: c.IsMapName}
+		if netDumps, err = netDump.ParseContent(); err != nil {
+			return nil, err
+		}
+	}
+	for _, net := range *netDumps {
+		fabric.Ports[fmt.Sprintf("%s_%s", net.remoteGuid, net.remotePort)] = &FabricPort{
+			Guid:     net.remoteGuid,
+			Name:     net.remoteName,
+			Port:     net.remotePort,
+			State:    net.state,
+			PeerGuid: net.localGuid,
+		}
+	}
+	// ibdiagnet2.lst and ibdiagnet2.pm are missing from the runs skipping
+	// them, e.g. with --skip pm, whose fabric is the topology of net_dump.
+	links := parsed.lst
+	if links == nil && fileExists(c.Path("lst")) {
+		if links, err = ParseLst(c.Path("lst")); err != nil {
+			return nil, err
+		}
+	}
+	if links == nil {
+		links = &[]LstLink{}
+	}
+	for _, link := range *links {
+		for _, side := range [][2]LstPort{{link.Local, link.Remote}, {link.Remote, link.Local}} {
+			local, remote := side[0], side[1]
+			key := fmt.Sprintf("%s_%s", local.NodeGuid, local.Port)
+			port, exists := fabric.Ports[key]
+			if !exists {
+				port = &FabricPort{Guid: local.NodeGuid, Name: local.Name, Port: local.Port, State: link.State}
+				fabric.Ports[key] = port
+			}
+			port.PeerGuid = remote.NodeGuid
+			port.PeerPort = remote.Port
+			port.Width = link.Phy
+			port.Speed = link.Speed
+		}
+	}
+
+	// The link map names the switches, as the pm collector labels them.
+	if !c.GetConfig {
+		for key, port := range fabric.Ports {
+			linkMap, exists := util.GetValueFromCache(key)
+			if !exists || linkMap["remoteName"] == "" {
+				continue
+			}
+			port.Name = linkMap["remoteName"]
+			if node, exists := fabric.Nodes[port.Guid]; exists {
+				node.Name = port.Name
+			}
+		}
+	}
+
+	if parsed.counters != nil {
+		fabric.Counters = parsed.counters
+	} else if fileExists(c.Path("pm")) {
+		if fabric.Counters, err = ParsePmCounters(c.Path("pm")); err != nil {
+			return nil, err
+		}
+	}
+	return fabric, nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return !errors.Is(err, os.ErrNotExist)
+}
+
+// ParsePmCounters returns every name=value counter of ibdiagnet2.pm keyed by
+// <guid>_<port>, leaving out values that are not numbers such as NA.
+func ParsePmCounters(filePath string) (map[string]map[string]float64, error) {
+	counters := make(map[string]map[string]float64)
+	err := ScanPmFile(filePath, func(port *PmPort) {
+		counters[fmt.Sprintf("%s_%s", port.Guid, port.Port)] = getPmPortCounters(port)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counters, nil
+}
+
+// getPmPortCounters returns the counters of port that are numbers, leaving
+// out the per lane ones.
+func getPmPortCounters(port *PmPort) map[string]float64 {
+	portCounters := make(map[string]float64)
+	for _, name := range port.Names {
+		if !pmCounterNameExpr.MatchString(name) {
+			continue
+		}
+		if value := parseCounter(port.Counters[name]); value != nil {
+			portCounters[name] = *value
+		}
+	}
+	return portCounters
+}
+
+// getFirmware formats the extended firmware version of a NODES_INFO row the
+// way mlxfwmanager prints it, e.g. 31.2012.1024.
+func getFirmware(row map[string]string) string {
+	var version []any
+	for _, column := range []string{"FWInfo_Extended_Major", "FWInfo_Extended_Minor", "FWInfo_Extended_SubMinor"} {
+		value, err := strconv.ParseUint(row[column], 0, 64)
+		if err != nil {
+			return ""
+		}
+		version = append(version, value)
+	}
+	return fmt.Sprintf("%d.%d.%d", version...)
+}
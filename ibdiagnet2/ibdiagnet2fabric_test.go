@@ -0,0 +1,21 @@
+package ibdiagnet2
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestLoadFabricWithoutPm loads a run made with --skip pm, whose fabric is
+// the topology alone.
+func TestLoadFabricWithoutPm(t *testing.T) {
+	fabric, err := LoadFabric(filepath.Join(testDataDir, "infiniband-default"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fabric.Nodes) == 0 || len(fabric.Ports) == 0 {
+		t.Errorf("%d nodes and %d ports, expected the topology", len(fabric.Nodes), len(fabric.Ports))
+	}
+	if len(fabric.Counters) != 0 {
+		t.Errorf("%d ports with counters, expected none", len(fabric.Counters))
+	}
+}
@@ -0,0 +1,271 @@
+package ibdiagnet2
+
+import (
+	"fmt"
+	"infiniband_exporter/log"
+	"infiniband_exporter/store"
+	"infiniband_exporter/util"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const maxFlapEvents = 1000
+
+var (
+	FlapWindows = map[string]time.Duration{
+		"1h":  time.Hour,
+		"24h": 24 * time.Hour,
+		"7d":  7 * 24 * time.Hour,
+	}
+
+	flapLabels = []string{"remoteGuid", "remoteName", "remotePort", "localGuid", "localName", "localPort"}
+	// Not infiniband_link_flaps, the OpenMetrics name of
+	// infiniband_link_flaps_total.
+	linkRecentFlapsGauge = prometheus.NewDesc(
+		"infiniband_link_recent_flaps",
+		"Number of link flaps within the window",
+		append(flapLabels, "window"),
+		nil,
+	)
+	linkFlapsTotalCounter = prometheus.NewDesc(
+		"infiniband_link_flaps_total",
+		"Number of link flaps seen since the history was created",
+		flapLabels,
+		nil,
+	)
+	linkLastChangeGauge = prometheus.NewDesc(
+		"infiniband_link_last_state_change_timestamp_seconds",
+		"Unix time of the last link state change",
+		flapLabels,
+		nil,
+	)
+	linkStateDurationGauge = prometheus.NewDesc(
+		"infiniband_link_state_duration_seconds",
+		"Seconds the link has been in its current state",
+		append(flapLabels, "state"),
+		nil,
+	)
+
+	flapHistory = &flapCollection{}
+)
+
+type Flaper interface {
+	prometheus.Collector
+}
+
+// LinkFlap tracks link state transitions across collections from the link
+// state in ibdiagnet2.net_dump and the link downed counters in ibdiagnet2.pm,
+// and keeps a bounded history in the state store so a flapping link stays
+// visible even when it happens to be ACT at scrape time.
+type LinkFlap struct {
+	NetDump *LinkNetDump
+	PmPath  string
+	DbCsv   *util.DbCsv
+	// Created sets _created on infiniband_link_flaps_total, the run the link
+	// history was created at.
+	Created bool
+}
+
+type LinkHistory struct {
+	RemoteGuid string      `json:"remoteGuid"`
+	RemoteName string      `json:"remoteName"`
+	RemotePort string      `json:"remotePort"`
+	LocalGuid  string      `json:"localGuid"`
+	LocalName  string      `json:"localName"`
+	LocalPort  string      `json:"localPort"`
+	State      string      `json:"state"`
+	LastChange time.Time   `json:"lastChange"`
+	LinkDowned *float64    `json:"linkDowned,omitempty"`
+	FlapsTotal float64     `json:"flapsTotal"`
+	Flaps      []time.Time `json:"flaps"`
+	// Created is the run FlapsTotal started from 0 at, zero for the
+	// histories stored before it was kept.
+	Created time.Time `json:"created,omitempty"`
+	// LastSeen is the last run the link was in, zero for the histories
+	// stored before it was kept.
+	LastSeen time.Time `json:"lastSeen,omitempty"`
+}
+
+type flapCollection struct {
+	sync.Mutex `json:"-"`
+	loaded     bool
+	RunTime    time.Time               `json:"runTime"`
+	Links      map[string]*LinkHistory `json:"links"`
+}
+
+func init() {
+	registerCollector("flap", func(c *CollectorContext) Collector {
+		return &LinkFlap{
+			NetDump: &LinkNetDump{FilePath: c.Path("net_dump"), GetConfig: c.GetConfig, IsMapName: c.IsMapName},
+			PmPath:  c.Path("pm"),
+			DbCsv:   c.GetDbCsv(),
+			Created: c.Created,
+		}
+	})
+}
+
+func (f *LinkFlap) Describe(ch chan<- *prometheus.Desc) {
+	describe(ch,
+		linkRecentFlapsGauge,
+		linkFlapsTotalCounter,
+		linkLastChangeGauge,
+		linkStateDurationGauge,
+	)
+}
+
+func (f *LinkFlap) Collect(ch chan<- prometheus.Metric) {
+	metrics := newMetricSet()
+	defer metrics.collect(ch)
+	flapHistory.Lock()
+	defer flapHistory.Unlock()
+	if !flapHistory.loaded {
+		if err := store.GetSection("linkFlap", flapHistory); err != nil {
+			log.GetLogger().Error(fmt.Sprintf("Load link history error: %s", err))
+		}
+		flapHistory.loaded = true
+	}
+	runTime, err := GetRunTime(f.DbCsv)
+	if err != nil {
+		runTime = time.Now()
+	}
+	// The same ibdiagnet run is only accounted once, so re-reading the data
+	// directory in dev mode does not produce fake transitions.
+	if runTime.After(flapHistory.RunTime) {
+		if err := f.update(runTime); err != nil {
+			log.GetLogger().Error(fmt.Sprintf("Update link history error: %s", err))
+		} else if err := store.SetSection("linkFlap", flapHistory); err != nil {
+			log.GetLogger().Error(fmt.Sprintf("Store link history error: %s", err))
+		}
+	}
+	now := time.Now()
+	for _, link := range flapHistory.Links {
+		labelValues := []string{
+			link.RemoteGuid, link.RemoteName, link.RemotePort, link.LocalGuid, link.LocalName, link.LocalPort,
+		}
+		for window, duration := range FlapWindows {
+			var flaps float64
+			for _, flap := range link.Flaps {
+				if now.Sub(flap) <= duration {
+					flaps++
+				}
+			}
+			metrics.set(linkRecentFlapsGauge, flaps, append(labelValues, window)...)
+		}
+		if f.Created && !link.Created.IsZero() {
+			metrics.setCounterCreated(linkFlapsTotalCounter, link.FlapsTotal, link.Created, labelValues...)
+		} else {
+			metrics.setCounter(linkFlapsTotalCounter, link.FlapsTotal, labelValues...)
+		}
+		metrics.set(linkLastChangeGauge, float64(link.LastChange.Unix()), labelValues...)
+		metrics.set(linkStateDurationGauge, now.Sub(link.LastChange).Seconds(), append(labelValues, link.State)...)
+	}
+}
+
+func (f *LinkFlap) update(runTime time.Time) error {
+	netDump := *f.NetDump
+	netDump.GetConfig = false
+	netDumps, err := netDump.ParseContent()
+	if err != nil {
+		return err
+	}
+	linkDowns, err := getLinkDowns(f.PmPath)
+	if err != nil {
+		return err
+	}
+	if flapHistory.Links == nil {
+		flapHistory.Links = make(map[string]*LinkHistory)
+	}
+	for _, net := range *netDumps {
+		key := fmt.Sprintf("%s_%s", net.remoteGuid, net.remotePort)
+		link, exists := flapHistory.Links[key]
+		if !exists {
+			link = &LinkHistory{State: net.state, LastChange: runTime, Created: runTime}
+			flapHistory.Links[key] = link
+		}
+		link.RemoteGuid, link.RemoteName, link.RemotePort = net.remoteGuid, net.remoteName, net.remotePort
+		link.LocalGuid, link.LocalName, link.LocalPort = net.localGuid, net.localName, net.localPort
+		link.LastSeen = runTime
+
+		var flaps float64
+		if link.State != net.state {
+			if link.State == "ACT" {
+				flaps = 1
+			}
+			link.State = net.state
+			link.LastChange = runTime
+		}
+		if linkDowned, exists := linkDowns[key]; exists {
+			// A counter that went backwards was reset, only rebase it.
+			if link.LinkDowned != nil && linkDowned > *link.LinkDowned {
+				flaps = max(flaps, linkDowned-*link.LinkDowned)
+				link.LastChange = runTime
+			}
+			link.LinkDowned = &linkDowned
+		}
+		for i := 0; i < int(flaps); i++ {
+			link.Flaps = append(link.Flaps, runTime)
+		}
+		link.FlapsTotal += flaps
+		link.prune(runTime)
+	}
+	flapHistory.expire(runTime)
+	flapHistory.RunTime = runTime
+	return nil
+}
+
+// expire drops the histories of the links gone from the fabric for longer
+// than the longest window, e.g. after a cable was moved to another port.
+func (c *flapCollection) expire(now time.Time) {
+	longest := longestFlapWindow()
+	for key, link := range c.Links {
+		lastSeen := link.LastSeen
+		if lastSeen.IsZero() {
+			lastSeen = link.LastChange
+		}
+		if now.Sub(lastSeen) > longest {
+			delete(c.Links, key)
+		}
+	}
+}
+
+// prune drops flaps older than the longest window and bounds the history.
+func (l *LinkHistory) prune(now time.Time) {
+	longest := longestFlapWindow()
+	first := 0
+	for first < len(l.Flaps) && now.Sub(l.Flaps[first]) > longest {
+		first++
+	}
+	first = max(first, len(l.Flaps)-maxFlapEvents)
+	l.Flaps = l.Flaps[first:]
+}
+
+func longestFlapWindow() time.Duration {
+	var longest time.Duration
+	for _, duration := range FlapWindows {
+		longest = max(longest, duration)
+	}
+	return longest
+}
+
+// getLinkDowns maps <guid>_<port> to the link downed counter of the port.
+func getLinkDowns(pmPath string) (map[string]float64, error) {
+	linkDowns := make(map[string]float64)
+	err := ScanPmFile(pmPath, func(port *PmPort) {
+		counter, exists := port.Counters["link_downed_counter_extended"]
+		if !exists {
+			counter, exists = port.Counters["link_down_counter"]
+		}
+		if !exists {
+			return
+		}
+		if value := parseCounter(counter); value != nil {
+			linkDowns[fmt.Sprintf("%s_%s", port.Guid, port.Port)] = *value
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return linkDowns, nil
+}
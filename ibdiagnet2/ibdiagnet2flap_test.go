@@ -0,0 +1,31 @@
+package ibdiagnet2
+
+import (
+	"slices"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestFlapCollectionExpire(t *testing.T) {
+	now := time.Date(2025, 4, 8, 12, 0, 0, 0, time.UTC)
+	week := 7 * 24 * time.Hour
+	collection := &flapCollection{Links: map[string]*LinkHistory{
+		"seen":                {LastSeen: now, LastChange: now.Add(-30 * 24 * time.Hour)},
+		"gone for a day":      {LastSeen: now.Add(-24 * time.Hour)},
+		"gone for the window": {LastSeen: now.Add(-week)},
+		"gone for longer":     {LastSeen: now.Add(-week - time.Hour), Flaps: []time.Time{now.Add(-week - time.Hour)}},
+		"stored unchanged":    {LastChange: now.Add(-24 * time.Hour)},
+		"stored long ago":     {LastChange: now.Add(-30 * 24 * time.Hour)},
+	}}
+	collection.expire(now)
+	var kept []string
+	for key := range collection.Links {
+		kept = append(kept, key)
+	}
+	sort.Strings(kept)
+	expected := []string{"gone for a day", "gone for the window", "seen", "stored unchanged"}
+	if !slices.Equal(kept, expected) {
+		t.Errorf("kept %q, expected %q", kept, expected)
+	}
+}
@@ -0,0 +1,86 @@
+package ibdiagnet2
+
+import (
+	"fmt"
+	"infiniband_exporter/log"
+	"infiniband_exporter/util"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	lstLinkExpr = regexp.MustCompile(`(?m)^(\{.*?\}\s+LID:\w+\s+PN:\w+\s+\})\s+(\{.*?\}\s+LID:\w+\s+PN:\w+\s+\})\s+PHY=(\S+)\s+LOG=(\S+)\s+SPD=(\S+)`)
+	lstNodeExpr = regexp.MustCompile(`\{\s+(SW|CA)\s+Ports:(\w+)\s+SystemGUID:(\w+)\s+NodeGUID:(\w+)\s+PortGUID:(\w+)\s+VenID:(\w+)\s+DevID:(\w+)\s+Rev:(\w+)\s+\{(.*)\}\s+LID:(\w+)\s+PN:(\w+)\s+\}`)
+)
+
+// LstLink is one line of ibdiagnet2.lst, a link between two ports.
+type LstLink struct {
+	Local  LstPort
+	Remote LstPort
+	Phy    string
+	State  string
+	Speed  string
+}
+
+type LstPort struct {
+	Component string
+	NodeGuid  string
+	PortGuid  string
+	DeviceId  string
+	Name      string
+	Lid       string
+	Port      string
+}
+
+func ParseLst(filePath string) (*[]LstLink, error) {
+	fileContent, err := util.ReadFileContent(filePath)
+	if err != nil {
+		log.GetLogger().Error("Read lst file error")
+		return nil, err
+	}
+	var links []LstLink
+	for _, match := range lstLinkExpr.FindAllStringSubmatch(fileContent, -1) {
+		local, err := parseLstPort(match[1])
+		if err != nil {
+			return nil, err
+		}
+		remote, err := parseLstPort(match[2])
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, LstLink{
+			Local:  *local,
+			Remote: *remote,
+			Phy:    match[3],
+			State:  match[4],
+			Speed:  match[5],
+		})
+	}
+	return &links, nil
+}
+
+func parseLstPort(s string) (*LstPort, error) {
+	match := lstNodeExpr.FindStringSubmatch(s)
+	if match == nil {
+		return nil, fmt.Errorf("invalid lst port: %s", s)
+	}
+	component := strings.ToLower(match[1])
+	return &LstPort{
+		Component: component,
+		NodeGuid:  fmt.Sprintf("0x%s", match[4]),
+		PortGuid:  fmt.Sprintf("0x%s", match[5]),
+		DeviceId:  match[7],
+		Name:      match[9],
+		Lid:       hexToDecimal(match[10]),
+		Port:      hexToDecimal(match[11]),
+	}, nil
+}
+
+func hexToDecimal(s string) string {
+	value, err := strconv.ParseUint(strings.TrimPrefix(s, "0x"), 16, 64)
+	if err != nil {
+		return s
+	}
+	return strconv.FormatUint(value, 10)
+}
@@ -2,52 +2,67 @@ package ibdiagnet2
 
 import (
 	"fmt"
+	"infiniband_exporter/config"
 	"infiniband_exporter/global"
 	"infiniband_exporter/log"
+	"infiniband_exporter/store"
 	"infiniband_exporter/util"
-	"os"
 	"regexp"
+	"slices"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/exp/maps"
-	"gopkg.in/yaml.v2"
 )
 
 var (
 	netDumpLabels          = util.GetFieldNames(NetDump{})
-	netDumpLinkInfoCounter = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "infiniband_link_info_total",
-			Help: "Total infiniband link info",
-		},
+	netDumpLinkInfoCounter = prometheus.NewDesc(
+		"infiniband_link_info_total",
+		"Total infiniband link info",
 		netDumpLabels,
+		nil,
 	)
-	netDumpLinkInfoGauge = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_link_info_state",
-			Help: "Gauge infiniband link info",
-		},
+	netDumpLinkInfoGauge = prometheus.NewDesc(
+		"infiniband_link_info_state",
+		"Gauge infiniband link info",
 		netDumpLabels,
+		nil,
 	)
-	netDumpSwitchInfoGauge = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_switch_info_state",
-			Help: "Gauge infiniband switch info",
-		},
+	netDumpSwitchInfoGauge = prometheus.NewDesc(
+		"infiniband_switch_info_state",
+		"Gauge infiniband switch info",
 		netDumpLabels,
+		nil,
+	)
+	netDumpNodeLastSeenGauge = prometheus.NewDesc(
+		"infiniband_node_last_seen_timestamp_seconds",
+		"Unix time the node was last seen in the fabric",
+		[]string{"guid", "name", "component"},
+		nil,
+	)
+	netDumpNodeFirstSeenGauge = prometheus.NewDesc(
+		"infiniband_node_first_seen_timestamp_seconds",
+		"Unix time the node was first seen in the fabric",
+		[]string{"guid", "name", "component"},
+		nil,
 	)
 )
 
 type Dumper interface {
 	ParseContent() (*[]NetDump, error)
-	UpdateMetrics()
+	prometheus.Collector
 }
 
+// LinkNetDump parses ibdiagnet2.net_dump. Down ports have no peer in the
+// file, it is taken from the link map unless GetConfig is set.
 type LinkNetDump struct {
-	FilePath   string
-	ConfigPath string
-	GetConfig  bool
-	IsMapName  bool
+	FilePath  string
+	GetConfig bool
+	IsMapName bool
+	// DbCsv gives the run time the nodes and ports are recorded as seen at.
+	DbCsv  *util.DbCsv
+	parsed *fabricFiles
 }
 
 type NetDump struct {
@@ -61,14 +76,13 @@ type NetDump struct {
 }
 
 func init() {
-	prometheus.MustRegister(netDumpLinkInfoCounter)
-	prometheus.MustRegister(netDumpLinkInfoGauge)
-	prometheus.MustRegister(netDumpSwitchInfoGauge)
+	registerCollector("netDump", func(c *CollectorContext) Collector {
+		return &LinkNetDump{FilePath: c.Path("net_dump"), GetConfig: c.GetConfig, IsMapName: c.IsMapName, DbCsv: c.GetDbCsv(), parsed: c.getParsed()}
+	})
 }
 
 func (d *LinkNetDump) ParseContent() (*[]NetDump, error) {
 	var netDumps []NetDump
-	configData := make(map[string]any)
 	blocks, err := util.GetContent(d.FilePath, `(?m)(.*),\s(\w+),\s(0x\w{16}),\sLID\s(\d+)`)
 	if err != nil {
 		log.GetLogger().Error("Get content error")
@@ -100,11 +114,8 @@ func (d *LinkNetDump) ParseContent() (*[]NetDump, error) {
 			for _, match := range subActiveMatch {
 				var localName string
 				if len(match) == 15 {
-					hcaOrMlxKey, hostName := match[14], match[13]
-					if value, exists := global.HcaMlxMap[hcaOrMlxKey]; exists {
-						hcaOrMlxKey = value
-					}
-					localName = fmt.Sprintf(`%s %s`, hostName, hcaOrMlxKey)
+					var hcaOrMlxKey string
+					localName, hcaOrMlxKey = getLocalName(match[13], match[14])
 					if remoteLeafName, exists := global.MlxLeafMap[hcaOrMlxKey]; exists {
 						if _, exists := remoteNameMap[remoteGuid]; !exists {
 							remoteNameMap[remoteGuid] = remoteLeafName
@@ -171,47 +182,81 @@ func (d *LinkNetDump) ParseContent() (*[]NetDump, error) {
 			netDumps = append(netDumps, netDump)
 		}
 	}
-	if d.GetConfig {
-		for _, netDump := range netDumps {
-			configDataKey := fmt.Sprintf("%s_%s", netDump.remoteGuid, netDump.remotePort)
-			configData[configDataKey] = map[string]any{
-				"remoteName": netDump.remoteName,
-				"remoteGuid": netDump.remoteGuid,
-				"remotePort": netDump.remotePort,
-				"state":      netDump.state,
-				"localGuid":  netDump.localGuid,
-				"localName":  netDump.localName,
-				"localPort":  netDump.localPort,
-			}
-		}
-		yamlData, err := yaml.Marshal(&configData)
-		if err != nil {
-			log.GetLogger().Error("Yaml marshal error")
-		}
-		err = os.WriteFile(d.ConfigPath, yamlData, 0644)
-		if err != nil {
-			log.GetLogger().Error("Failed to write data into file")
+	return &netDumps, nil
+}
+
+// GetLinkMap returns the link map of the run, ignoring the loaded one, as
+// written by the config generate subcommand.
+func (d *LinkNetDump) GetLinkMap() (config.LinkMap, error) {
+	netDump := *d
+	netDump.GetConfig = true
+	netDumps, err := netDump.ParseContent()
+	if err != nil {
+		return nil, err
+	}
+	linkMap := make(config.LinkMap)
+	for _, net := range *netDumps {
+		linkMap[fmt.Sprintf("%s_%s", net.remoteGuid, net.remotePort)] = &config.Link{
+			LocalGuid:  net.localGuid,
+			LocalName:  net.localName,
+			LocalPort:  net.localPort,
+			RemoteGuid: net.remoteGuid,
+			RemoteName: net.remoteName,
+			RemotePort: net.remotePort,
+			State:      net.state,
 		}
 	}
-	return &netDumps, nil
+	return linkMap, nil
+}
+
+// getLocalName builds the "<host> <mlx device>" name of a CA port, mapping
+// HCA-N descriptions through global.HcaMlxMap.
+func getLocalName(hostName string, hcaOrMlxKey string) (string, string) {
+	if value, exists := global.HcaMlxMap[hcaOrMlxKey]; exists {
+		hcaOrMlxKey = value
+	}
+	return fmt.Sprintf(`%s %s`, hostName, hcaOrMlxKey), hcaOrMlxKey
+}
+
+func (d *LinkNetDump) Describe(ch chan<- *prometheus.Desc) {
+	describe(ch,
+		netDumpLinkInfoCounter,
+		netDumpLinkInfoGauge,
+		netDumpSwitchInfoGauge,
+		netDumpNodeLastSeenGauge,
+		netDumpNodeFirstSeenGauge,
+	)
 }
 
-func (d *LinkNetDump) UpdateMetrics() {
-	netDumpLinkInfoCounter.Reset()
-	netDumpLinkInfoGauge.Reset()
-	netDumpSwitchInfoGauge.Reset()
+func (d *LinkNetDump) Collect(ch chan<- prometheus.Metric) {
+	metrics := newMetricSet()
+	defer metrics.collect(ch)
 	netDump, err := d.ParseContent()
 	if err != nil {
 		log.GetLogger().Error("Parse content error")
 		return
 	}
+	d.parsed.setNetDump(netDump)
 	var value float64
 	netDumpSwitches := make(map[string]string)
+	// A replayed or archived run is seen when ibdiagnet ran, not now.
+	runTime := time.Now()
+	if d.DbCsv != nil {
+		if t, err := GetRunTime(d.DbCsv); err == nil {
+			runTime = t
+		}
+	}
 	for _, net := range *netDump {
 		if _, exists := netDumpSwitches[net.remoteGuid]; !exists {
 			netDumpSwitches[net.remoteGuid] = net.remoteName
 		}
-		netDumpLinkInfoCounter.WithLabelValues(
+		store.TouchNode(net.remoteGuid, net.remoteName, global.ComponentSw, runTime)
+		store.TouchPort(net.remoteGuid, net.remotePort, net.state, runTime)
+		if net.state == "ACT" && net.localGuid != "" {
+			store.TouchNode(net.localGuid, net.localName, global.ComponentCa, runTime)
+		}
+		metrics.incCounter(
+			netDumpLinkInfoCounter,
 			net.remoteGuid,
 			net.remoteName,
 			net.remotePort,
@@ -219,14 +264,16 @@ func (d *LinkNetDump) UpdateMetrics() {
 			net.localGuid,
 			net.localName,
 			net.localPort,
-		).Inc()
+		)
 
 		if net.state == "ACT" {
 			value = 1
 		} else {
 			value = 0
 		}
-		netDumpLinkInfoGauge.WithLabelValues(
+		metrics.set(
+			netDumpLinkInfoGauge,
+			value,
 			net.remoteGuid,
 			net.remoteName,
 			net.remotePort,
@@ -234,22 +281,34 @@ func (d *LinkNetDump) UpdateMetrics() {
 			net.localGuid,
 			net.localName,
 			net.localPort,
-		).Set(value)
+		)
 	}
+	store.Expire(runTime)
 	netDumpSwitchesFromCache, _ := util.GetKeysFromCache("")
 	diffSwitches := util.DifferenceSlice(netDumpSwitchesFromCache, maps.Keys(netDumpSwitches))
 	for _, remoteGuid := range diffSwitches {
 		if linkMap, exists := util.GetValueFromCache(fmt.Sprintf("%s_1", remoteGuid)); exists {
-			netDumpSwitchInfoGauge.WithLabelValues(
+			metrics.set(netDumpSwitchInfoGauge, 0,
 				remoteGuid, linkMap["remoteName"], "-",
 				"DOWN",
-				"-", "-", "-").
-				Set(0)
+				"-", "-", "-")
+		}
+	}
+	// Switches seen by an earlier collection but missing from both this run
+	// and the config are DOWN as well.
+	for guid, node := range store.GetNodes() {
+		if node.Component == global.ComponentSw {
+			if _, exists := netDumpSwitches[guid]; !exists && !slices.Contains(netDumpSwitchesFromCache, guid) {
+				metrics.set(netDumpSwitchInfoGauge, 0,
+					guid, node.Name, "-",
+					"DOWN",
+					"-", "-", "-")
+			}
 		}
+		metrics.set(netDumpNodeLastSeenGauge, float64(node.LastSeen.Unix()), guid, node.Name, node.Component)
+		metrics.set(netDumpNodeFirstSeenGauge, float64(node.FirstSeen.Unix()), guid, node.Name, node.Component)
 	}
 	for remoteGuid, remoteName := range netDumpSwitches {
-		netDumpSwitchInfoGauge.WithLabelValues(
-			remoteGuid, remoteName, "-", "UP", "-", "-", "-").
-			Set(1)
+		metrics.set(netDumpSwitchInfoGauge, 1, remoteGuid, remoteName, "-", "UP", "-", "-", "-")
 	}
 }
@@ -0,0 +1,46 @@
+package ibdiagnet2
+
+import (
+	"infiniband_exporter/config"
+	"path/filepath"
+	"testing"
+)
+
+// TestGetLinkMapMerge generates the link map of the sample run and merges the
+// sample link map into it, as the config generate subcommand does.
+func TestGetLinkMapMerge(t *testing.T) {
+	netDump := LinkNetDump{FilePath: filepath.Join(testDataDir, "ibdiagnet2.net_dump")}
+	generated, err := netDump.GetLinkMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(generated) == 0 {
+		t.Fatal("empty link map generated")
+	}
+	if problems := generated.Validate(); len(problems) > 0 {
+		t.Errorf("generated link map invalid: %v", problems)
+	}
+	existing, err := config.LoadLinkMap("../config/sequoia_config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged := config.Merge(existing, generated)
+	if problems := merged.Validate(); len(problems) > 0 {
+		t.Errorf("merged link map invalid: %v", problems)
+	}
+	for key, link := range merged {
+		previous, known := existing[key]
+		_, seen := generated[key]
+		switch {
+		case !seen && !link.Removed:
+			t.Errorf("%s: gone from the run but not marked removed", key)
+		case seen && link.Removed:
+			t.Errorf("%s: in the run but marked removed", key)
+		case known && previous.RemoteName != "" && link.RemoteName != previous.RemoteName:
+			t.Errorf("%s: remoteName %q replaced by %q", key, previous.RemoteName, link.RemoteName)
+		}
+	}
+	if lines := config.Diff(merged, config.Merge(merged, generated)); len(lines) > 0 {
+		t.Errorf("merging twice changes %v", lines)
+	}
+}
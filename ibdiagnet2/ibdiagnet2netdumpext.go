@@ -0,0 +1,166 @@
+package ibdiagnet2
+
+import (
+	"infiniband_exporter/log"
+	"infiniband_exporter/util"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	rawBerGauge = prometheus.NewDesc(
+		"infiniband_raw_ber",
+		"raw_ber",
+		pmLabels,
+		nil,
+	)
+	effectiveBerGauge = prometheus.NewDesc(
+		"infiniband_effective_ber",
+		"effective_ber",
+		pmLabels,
+		nil,
+	)
+	symbolBerGauge = prometheus.NewDesc(
+		"infiniband_symbol_ber",
+		"symbol_ber",
+		pmLabels,
+		nil,
+	)
+	symbolErrGauge = prometheus.NewDesc(
+		"infiniband_symbol_err",
+		"symbol_err",
+		pmLabels,
+		nil,
+	)
+	effectiveErrGauge = prometheus.NewDesc(
+		"infiniband_effective_err",
+		"effective_err",
+		pmLabels,
+		nil,
+	)
+)
+
+type DumpExter interface {
+	ParseContent() (*[]NetDumpExt, error)
+	prometheus.Collector
+}
+
+type LinkNetDumpExt struct {
+	FilePath string
+}
+
+// NetDumpExt is one port row of ibdiagnet2.net_dump_ext. A nil value means
+// the column was blank, i.e. the port did not report it.
+type NetDumpExt struct {
+	guid         string
+	port         string
+	name         string
+	rawBer       *float64
+	effectiveBer *float64
+	symbolBer    *float64
+	symbolErr    *float64
+	effectiveErr *float64
+}
+
+func init() {
+	registerCollector("netDumpExt", func(c *CollectorContext) Collector {
+		return &LinkNetDumpExt{FilePath: c.Path("net_dump_ext")}
+	})
+}
+
+func (d *LinkNetDumpExt) ParseContent() (*[]NetDumpExt, error) {
+	fileContent, err := util.ReadFileContent(d.FilePath)
+	if err != nil {
+		log.GetLogger().Error("Read net dump ext file error")
+		return nil, err
+	}
+	var netDumpExts []NetDumpExt
+	var columns map[string]int
+	for _, line := range strings.Split(fileContent, "\n") {
+		if strings.HasPrefix(line, "#") || strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Split(line, " : ")
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		if fields[0] == "Ty" {
+			columns = make(map[string]int)
+			for i, field := range fields {
+				columns[field] = i
+			}
+			continue
+		}
+		if columns == nil || len(fields) < len(columns) {
+			continue
+		}
+		getField := func(column string) string {
+			index, exists := columns[column]
+			if !exists {
+				return ""
+			}
+			return fields[index]
+		}
+		netDumpExt := NetDumpExt{
+			guid:         getField("GUID"),
+			port:         getField("#IB"),
+			name:         strings.Trim(getField("Node Desc"), `"`),
+			rawBer:       parseFloat(getField("Raw BER")),
+			effectiveBer: parseFloat(getField("Effective BER")),
+			symbolBer:    parseFloat(getField("Symbol BER")),
+			symbolErr:    parseFloat(getField("Symbol Err")),
+			effectiveErr: parseFloat(getField("Effective Err")),
+		}
+		netDumpExts = append(netDumpExts, netDumpExt)
+	}
+	return &netDumpExts, nil
+}
+
+func (d *LinkNetDumpExt) Describe(ch chan<- *prometheus.Desc) {
+	describe(ch,
+		rawBerGauge,
+		effectiveBerGauge,
+		symbolBerGauge,
+		symbolErrGauge,
+		effectiveErrGauge,
+	)
+}
+
+func (d *LinkNetDumpExt) Collect(ch chan<- prometheus.Metric) {
+	metrics := newMetricSet()
+	defer metrics.collect(ch)
+	netDumpExts, err := d.ParseContent()
+	if err != nil {
+		log.GetLogger().Error("Parse net dump ext content error")
+		return
+	}
+	for _, ext := range *netDumpExts {
+		pm := getPm(ext.guid, ext.port, ext.name)
+		labelValues := []string{pm.remoteGuid, pm.remoteName, pm.remotePort, pm.component, pm.localGuid, pm.localName, pm.localPort}
+		setValue := func(gauge *prometheus.Desc, value *float64) {
+			if value != nil {
+				metrics.set(gauge, *value, labelValues...)
+			}
+		}
+		setValue(rawBerGauge, ext.rawBer)
+		setValue(effectiveBerGauge, ext.effectiveBer)
+		setValue(symbolBerGauge, ext.symbolBer)
+		setValue(symbolErrGauge, ext.symbolErr)
+		setValue(effectiveErrGauge, ext.effectiveErr)
+	}
+}
+
+// parseFloat parses decimal or scientific notation such as 1.5e-254; blank
+// and N/A values yield nil.
+func parseFloat(s string) *float64 {
+	if s == "" || s == "N/A" || s == "NA" {
+		return nil
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil
+	}
+	return &value
+}
@@ -0,0 +1,135 @@
+package ibdiagnet2
+
+import (
+	"infiniband_exporter/global"
+	"infiniband_exporter/util"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	testSwitchGuid = "0xb0cf0e0300d33fc0"
+	testCaGuid     = "0xb0cf0e0300d33fc8"
+	testLeafGuid   = "0xfc6a1c030091cf00"
+)
+
+// setTestCache sets the link map of a switch whose ports 1 and 3 link the two
+// ports of a CA, until the test ends.
+func setTestCache(t testing.TB) {
+	util.SetCache(map[string]map[string]string{
+		testSwitchGuid + "_1": {
+			"localGuid":  testCaGuid,
+			"localName":  "node01",
+			"localPort":  "1",
+			"remoteGuid": testSwitchGuid,
+			"remoteName": "SPAN01",
+			"remotePort": "1",
+		},
+		testSwitchGuid + "_3": {
+			"localGuid":  testCaGuid,
+			"localName":  "node01",
+			"localPort":  "2",
+			"remoteGuid": testSwitchGuid,
+			"remoteName": "SPAN01",
+			"remotePort": "3",
+		},
+	})
+	t.Cleanup(func() {
+		util.SetCache(make(map[string]map[string]string))
+	})
+}
+
+func TestGetPm(t *testing.T) {
+	setTestCache(t)
+	for _, test := range []struct {
+		name string
+		guid string
+		port string
+		pm   Pm
+	}{
+		{
+			"switch port in the link map",
+			testSwitchGuid, "1",
+			Pm{remoteGuid: testSwitchGuid, remoteName: "SPAN01", remotePort: "1", component: global.ComponentSw, localGuid: testCaGuid, localName: "node01", localPort: "1"},
+		},
+		{
+			"switch port missing from the link map",
+			testSwitchGuid, "2",
+			Pm{remoteGuid: testSwitchGuid, remoteName: "ib-switch", remotePort: "2", component: global.ComponentSw},
+		},
+		{
+			"CA in the link map",
+			testCaGuid, "1",
+			Pm{remoteGuid: testCaGuid, remoteName: "SPAN01", remotePort: "1", component: global.ComponentCa, localGuid: testCaGuid, localName: "node01", localPort: "1"},
+		},
+		{
+			"second CA port in the link map",
+			testCaGuid, "2",
+			Pm{remoteGuid: testCaGuid, remoteName: "SPAN01", remotePort: "2", component: global.ComponentCa, localGuid: testCaGuid, localName: "node01", localPort: "2"},
+		},
+		{
+			"CA port missing from the link map",
+			testCaGuid, "3",
+			Pm{remoteGuid: testCaGuid, remoteName: "SPAN01", remotePort: "3", component: global.ComponentCa, localGuid: testCaGuid, localName: "node01", localPort: "1"},
+		},
+		{
+			"node missing from the link map",
+			testLeafGuid, "3",
+			Pm{remoteGuid: testLeafGuid, remoteName: "ib-switch", remotePort: "3", component: global.ComponentCa},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if pm := getPm(test.guid, test.port, "ib-switch"); !reflect.DeepEqual(pm, test.pm) {
+				t.Errorf("labels %+v, expected %+v", pm, test.pm)
+			}
+		})
+	}
+}
+
+// TestLinkNetDumpExtCollect checks that the ports missing from the link map
+// get one series each.
+func TestLinkNetDumpExtCollect(t *testing.T) {
+	setTestCache(t)
+	content := `Ty : #   : #IB : GUID               : Sta  : Raw BER : Effective BER : Symbol BER : Symbol Err : Effective Err : Node Desc
+SW : 1/1 : 1   : 0xb0cf0e0300d33fc0 : ACT  : 1e-12   : 1e-254        : 1e-15      : 0          : 0             : "SPAN01"
+SW : 1/2 : 2   : 0xb0cf0e0300d33fc0 : ACT  : 2e-12   : 1e-254        : 1e-15      : 0          : 0             : "SPAN01"
+SW : 1/1 : 1   : 0xfc6a1c030091cf00 : ACT  : 3e-12   : 1e-254        : 1e-15      : 0          : 0             : "LEAF01"
+SW : 1/2 : 2   : 0xfc6a1c030091cf00 : ACT  : 4e-12   : 1e-254        : 1e-15      : 0          : 0             : "LEAF01"
+`
+	filePath := filepath.Join(t.TempDir(), "ibdiagnet2.net_dump_ext")
+	if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(&LinkNetDumpExt{FilePath: filePath})
+	metricFamilies, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	for _, metricFamily := range metricFamilies {
+		if metricFamily.GetName() != "infiniband_raw_ber" {
+			continue
+		}
+		for _, metric := range metricFamily.Metric {
+			labels := make(map[string]string)
+			for _, label := range metric.Label {
+				labels[label.GetName()] = label.GetValue()
+			}
+			values[labels["remoteGuid"]+"_"+labels["remotePort"]] = metric.GetGauge().GetValue()
+		}
+	}
+	expected := map[string]float64{
+		testSwitchGuid + "_1": 1e-12,
+		testSwitchGuid + "_2": 2e-12,
+		testLeafGuid + "_1":   3e-12,
+		testLeafGuid + "_2":   4e-12,
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("infiniband_raw_ber %v, expected %v", values, expected)
+	}
+}
@@ -0,0 +1,203 @@
+package ibdiagnet2
+
+import (
+	"fmt"
+	"infiniband_exporter/config"
+	"infiniband_exporter/log"
+	"infiniband_exporter/util"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	pkeyLabels       = util.GetFieldNames(Pkey{})
+	pkeyMembersGauge = prometheus.NewDesc(
+		"infiniband_pkey_members",
+		"Number of ports in a partition by membership type",
+		[]string{"pkey", "membership"},
+		nil,
+	)
+	pkeyPortGauge = prometheus.NewDesc(
+		"infiniband_pkey_port_info",
+		"Gauge infiniband port partition membership info",
+		pkeyLabels,
+		nil,
+	)
+	pkeyPolicyViolationGauge = prometheus.NewDesc(
+		"infiniband_pkey_policy_violation",
+		"1 for each host violating the partition policy",
+		[]string{"pkey", "host", "rule"},
+		nil,
+	)
+	pkeyPolicyViolationsGauge = prometheus.NewDesc(
+		"infiniband_pkey_policy_violations",
+		"Number of partition policy violations per partition",
+		[]string{"pkey"},
+		nil,
+	)
+
+	pkeyGroupExpr  = regexp.MustCompile(`(?m)^GROUP\s+PKey:(\w+)\s+Hosts:(\d+)`)
+	pkeyMemberExpr = regexp.MustCompile(`(?m)^\s+(Full|Limited)\s+(\S+)\s+lid=(\w+)\s+guid=(\w{18})`)
+)
+
+type Pkeyer interface {
+	ParseContent() (*[]Pkey, error)
+	prometheus.Collector
+}
+
+// LinkPkey exports partition membership from ibdiagnet2.pkey, or from the
+// per-port PKEY section of ibdiagnet2.db_csv when it is available, and checks
+// it against the optional policy in PolicyPath.
+type LinkPkey struct {
+	FilePath   string
+	DbCsv      *util.DbCsv
+	PolicyPath string
+}
+
+type Pkey struct {
+	guid       string
+	name       string
+	port       string
+	pkey       string
+	membership string
+}
+
+func init() {
+	registerCollector("pkey", func(c *CollectorContext) Collector {
+		return &LinkPkey{FilePath: c.Path("pkey"), DbCsv: c.GetDbCsv(), PolicyPath: c.PkeyPolicy}
+	})
+}
+
+func (p *LinkPkey) ParseContent() (*[]Pkey, error) {
+	rows, err := p.DbCsv.Section("PKEY")
+	if err != nil {
+		log.GetLogger().Info(fmt.Sprintf("PKEY unavailable, using %s: %s", p.FilePath, err))
+		return p.parsePkeyFile()
+	}
+	nodeNames := getNodeNames(p.DbCsv)
+	var pkeys []Pkey
+	for _, row := range *rows {
+		membership := "limited"
+		if row["Membership"] == "1" {
+			membership = "full"
+		}
+		pkeys = append(pkeys, Pkey{
+			guid:       row["PortGUID"],
+			name:       nodeNames[row["NodeGUID"]],
+			port:       row["LocalPortNum"],
+			pkey:       normalizePkey(row["PKey"]),
+			membership: membership,
+		})
+	}
+	return &pkeys, nil
+}
+
+func (p *LinkPkey) parsePkeyFile() (*[]Pkey, error) {
+	fileContent, err := util.ReadFileContent(p.FilePath)
+	if err != nil {
+		log.GetLogger().Error("Read pkey file error")
+		return nil, err
+	}
+	var pkeys []Pkey
+	groups := pkeyGroupExpr.FindAllStringSubmatchIndex(fileContent, -1)
+	for i, group := range groups {
+		end := len(fileContent)
+		if i < len(groups)-1 {
+			end = groups[i+1][0]
+		}
+		pkey := normalizePkey(fileContent[group[2]:group[3]])
+		for _, match := range pkeyMemberExpr.FindAllStringSubmatch(fileContent[group[1]:end], -1) {
+			pkeys = append(pkeys, Pkey{
+				guid:       match[4],
+				name:       match[2],
+				port:       "",
+				pkey:       pkey,
+				membership: strings.ToLower(match[1]),
+			})
+		}
+	}
+	return &pkeys, nil
+}
+
+func (p *LinkPkey) Describe(ch chan<- *prometheus.Desc) {
+	describe(ch,
+		pkeyMembersGauge,
+		pkeyPortGauge,
+		pkeyPolicyViolationGauge,
+		pkeyPolicyViolationsGauge,
+	)
+}
+
+func (p *LinkPkey) Collect(ch chan<- prometheus.Metric) {
+	metrics := newMetricSet()
+	defer metrics.collect(ch)
+	pkeys, err := p.ParseContent()
+	if err != nil {
+		log.GetLogger().Error("Parse pkey content error")
+		return
+	}
+	members := make(map[string][]string)
+	memberGuids := make(map[[3]string]struct{})
+	for _, pkey := range *pkeys {
+		// Switch ports share the switch GUID, so count distinct GUIDs like
+		// the Hosts field of ibdiagnet2.pkey does.
+		memberKey := [3]string{pkey.pkey, pkey.membership, pkey.guid}
+		if _, exists := memberGuids[memberKey]; !exists {
+			memberGuids[memberKey] = struct{}{}
+			metrics.inc(pkeyMembersGauge, pkey.pkey, pkey.membership)
+		}
+		metrics.set(pkeyPortGauge, 1, pkey.guid, pkey.name, pkey.port, pkey.pkey, pkey.membership)
+		members[pkey.pkey] = append(members[pkey.pkey], pkey.guid, pkeyHost(pkey.name))
+	}
+	if p.PolicyPath == "" {
+		return
+	}
+	policy, err := config.LoadPkeyPolicy(p.PolicyPath)
+	if err != nil {
+		log.GetLogger().Error(fmt.Sprintf("Read pkey policy error: %s", err))
+		return
+	}
+	for pkey, rule := range policy.Partitions {
+		pkey = normalizePkey(pkey)
+		var violations float64
+		for _, host := range rule.MustInclude {
+			if !slices.Contains(members[pkey], host) {
+				metrics.set(pkeyPolicyViolationGauge, 1, pkey, host, "must_include")
+				violations++
+			}
+		}
+		for _, host := range rule.MustExclude {
+			if slices.Contains(members[pkey], host) {
+				metrics.set(pkeyPolicyViolationGauge, 1, pkey, host, "must_exclude")
+				violations++
+			}
+		}
+		metrics.set(pkeyPolicyViolationsGauge, violations, pkey)
+	}
+}
+
+// normalizePkey strips the full membership bit so 0xffff and 0x7fff refer to
+// the same partition.
+func normalizePkey(pkey string) string {
+	value, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(pkey), "0x"), 16, 16)
+	if err != nil {
+		return pkey
+	}
+	return fmt.Sprintf("0x%04x", value&0x7fff)
+}
+
+// pkeyHost returns the host part of a node description such as
+// "is-north-7-compute-1/mlx5_8/B134D0F0/0/0/1" or "is-north-7-compute-1 mlx5_8".
+func pkeyHost(name string) string {
+	fields := strings.FieldsFunc(name, func(r rune) bool {
+		return r == '/' || r == ' '
+	})
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
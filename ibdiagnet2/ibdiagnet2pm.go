@@ -1,393 +1,394 @@
 package ibdiagnet2
 
 import (
+	"bufio"
 	"fmt"
 	"infiniband_exporter/global"
 	"infiniband_exporter/log"
+	"infiniband_exporter/store"
 	"infiniband_exporter/util"
-	"regexp"
-	"strconv"
+	"io"
+	"os"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 var (
-	pmLabels      = util.GetFieldNames(Pm{})
-	linkDownGauge = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_link_down_counter",
-			Help: "link_down_counter",
-		},
+	pmModeDescs    = make(map[string]pmModeDesc)
+	pmModeDescLock sync.Mutex
+	pmHistory      = &pmCollection{values: make(map[string]float64), Created: make(map[string]time.Time)}
+	// pmInvalidNames holds the counters a value that is not a number was
+	// logged for, each being logged once rather than for every port.
+	pmInvalidNames    = make(map[string]bool)
+	pmInvalidNameLock sync.Mutex
+
+	pmLabels                = util.GetFieldNames(Pm{})
+	pmCounterSupportedGauge = prometheus.NewDesc(
+		"infiniband_pm_counter_supported",
+		"1 if the port reports the pm counter, 0 if it is NA or missing",
+		append(util.GetFieldNames(Pm{}), "counter"),
+		nil,
+	)
+	linkDownGauge = prometheus.NewDesc(
+		"infiniband_link_down_counter",
+		"link_down_counter",
 		pmLabels,
+		nil,
 	)
 
-	linkErrorRecoveryGauge = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_link_error_recovery_counter",
-			Help: "link_error_recovery_counter",
-		},
+	linkErrorRecoveryGauge = prometheus.NewDesc(
+		"infiniband_link_error_recovery_counter",
+		"link_error_recovery_counter",
 		pmLabels,
+		nil,
 	)
-	symbolErrorCounter = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_symbol_error_counter",
-			Help: "symbol_error_counter",
-		},
+	symbolErrorCounter = prometheus.NewDesc(
+		"infiniband_symbol_error_counter",
+		"symbol_error_counter",
 		pmLabels,
+		nil,
 	)
-	portRcvRemotePhysicalErrors = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_rcv_remote_physical_errors",
-			Help: "port_rcv_remote_physical_errors",
-		},
+	portRcvRemotePhysicalErrors = prometheus.NewDesc(
+		"infiniband_port_rcv_remote_physical_errors",
+		"port_rcv_remote_physical_errors",
 		pmLabels,
+		nil,
 	)
 
-	portRcvErrors = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_rcv_errors",
-			Help: "port_rcv_errors",
-		},
+	portRcvErrors = prometheus.NewDesc(
+		"infiniband_port_rcv_errors",
+		"port_rcv_errors",
 		pmLabels,
+		nil,
 	)
 
-	portXmitDiscard = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_xmit_discard",
-			Help: "port_xmit_discard",
-		},
+	portXmitDiscard = prometheus.NewDesc(
+		"infiniband_port_xmit_discard",
+		"port_xmit_discard",
 		pmLabels,
+		nil,
 	)
 
-	portRcvSwitchRelayErrors = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_rcv_switch_relay_errors",
-			Help: "port_rcv_switch_relay_errors",
-		},
+	portRcvSwitchRelayErrors = prometheus.NewDesc(
+		"infiniband_port_rcv_switch_relay_errors",
+		"port_rcv_switch_relay_errors",
 		pmLabels,
+		nil,
 	)
 
-	excessiveBufferErrors = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_excessive_buffer_errors",
-			Help: "excessive_buffer_errors",
-		},
+	excessiveBufferErrors = prometheus.NewDesc(
+		"infiniband_excessive_buffer_errors",
+		"excessive_buffer_errors",
 		pmLabels,
+		nil,
 	)
 
-	localLinkIntegrityErrors = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_local_link_integrity_errors",
-			Help: "local_link_integrity_errors",
-		},
+	localLinkIntegrityErrors = prometheus.NewDesc(
+		"infiniband_local_link_integrity_errors",
+		"local_link_integrity_errors",
 		pmLabels,
+		nil,
 	)
 
-	portRcvConstraintErrors = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_rcv_constraint_errors",
-			Help: "port_rcv_constraint_errors",
-		},
+	portRcvConstraintErrors = prometheus.NewDesc(
+		"infiniband_port_rcv_constraint_errors",
+		"port_rcv_constraint_errors",
 		pmLabels,
+		nil,
 	)
 
-	portXmitConstraintErrors = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_xmit_constraint_errors",
-			Help: "port_xmit_constraint_errors",
-		},
+	portXmitConstraintErrors = prometheus.NewDesc(
+		"infiniband_port_xmit_constraint_errors",
+		"port_xmit_constraint_errors",
 		pmLabels,
+		nil,
 	)
 
-	vl15Dropped = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_vl15_dropped",
-			Help: "vl15_dropped",
-		},
+	vl15Dropped = prometheus.NewDesc(
+		"infiniband_vl15_dropped",
+		"vl15_dropped",
 		pmLabels,
+		nil,
 	)
-	portXmitData = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_xmit_data",
-			Help: "port_xmit_data",
-		},
+	portXmitData = prometheus.NewDesc(
+		"infiniband_port_xmit_data",
+		"port_xmit_data",
 		pmLabels,
+		nil,
 	)
-	portRcvData = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_rcv_data",
-			Help: "port_rcv_data",
-		},
+	portRcvData = prometheus.NewDesc(
+		"infiniband_port_rcv_data",
+		"port_rcv_data",
 		pmLabels,
+		nil,
 	)
-	portXmitPkts = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_xmit_pkts",
-			Help: "port_xmit_pkts",
-		},
+	portXmitPkts = prometheus.NewDesc(
+		"infiniband_port_xmit_pkts",
+		"port_xmit_pkts",
 		pmLabels,
+		nil,
 	)
-	portRcvPkts = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_rcv_pkts",
-			Help: "port_rcv_pkts",
-		},
+	portRcvPkts = prometheus.NewDesc(
+		"infiniband_port_rcv_pkts",
+		"port_rcv_pkts",
 		pmLabels,
+		nil,
 	)
-	portXmitWait = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_xmit_wait",
-			Help: "port_xmit_wait",
-		},
+	portXmitWait = prometheus.NewDesc(
+		"infiniband_port_xmit_wait",
+		"port_xmit_wait",
 		pmLabels,
+		nil,
 	)
-	portXmitDataExtended = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_xmit_data_extended",
-			Help: "port_xmit_data_extended",
-		},
+	portXmitDataExtended = prometheus.NewDesc(
+		"infiniband_port_xmit_data_extended",
+		"port_xmit_data_extended",
 		pmLabels,
+		nil,
 	)
-	portRcvDataExtended = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_rcv_data_extended",
-			Help: "port_rcv_data_extended",
-		},
+	portRcvDataExtended = prometheus.NewDesc(
+		"infiniband_port_rcv_data_extended",
+		"port_rcv_data_extended",
 		pmLabels,
+		nil,
 	)
-	portXmitPktsExtended = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_xmit_pkts_extended",
-			Help: "port_xmit_pkts_extended",
-		},
+	portXmitPktsExtended = prometheus.NewDesc(
+		"infiniband_port_xmit_pkts_extended",
+		"port_xmit_pkts_extended",
 		pmLabels,
+		nil,
 	)
-	portRcvPktsExtended = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_rcv_pkts_extended",
-			Help: "port_rcv_pkts_extended",
-		},
+	portRcvPktsExtended = prometheus.NewDesc(
+		"infiniband_port_rcv_pkts_extended",
+		"port_rcv_pkts_extended",
 		pmLabels,
+		nil,
 	)
-	portUnicastXmitPkts = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_unicast_xmit_pkts",
-			Help: "port_unicast_xmit_pkts",
-		},
+	portUnicastXmitPkts = prometheus.NewDesc(
+		"infiniband_port_unicast_xmit_pkts",
+		"port_unicast_xmit_pkts",
 		pmLabels,
+		nil,
 	)
-	portUnicastRcvPkts = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_unicast_rcv_pkts",
-			Help: "port_unicast_rcv_pkts",
-		},
+	portUnicastRcvPkts = prometheus.NewDesc(
+		"infiniband_port_unicast_rcv_pkts",
+		"port_unicast_rcv_pkts",
 		pmLabels,
+		nil,
 	)
-	portMulticastXmitPkts = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_multicast_xmit_pkts",
-			Help: "port_multicast_xmit_pkts",
-		},
+	portMulticastXmitPkts = prometheus.NewDesc(
+		"infiniband_port_multicast_xmit_pkts",
+		"port_multicast_xmit_pkts",
 		pmLabels,
+		nil,
 	)
-	portMulticastRcvPkts = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_multicast_rcv_pkts",
-			Help: "port_multicast_rcv_pkts",
-		},
+	portMulticastRcvPkts = prometheus.NewDesc(
+		"infiniband_port_multicast_rcv_pkts",
+		"port_multicast_rcv_pkts",
 		pmLabels,
+		nil,
 	)
-	symbolErrorCounterExtended = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_symbol_error_counter_extended",
-			Help: "symbol_error_counter_extended",
-		},
+	symbolErrorCounterExtended = prometheus.NewDesc(
+		"infiniband_symbol_error_counter_extended",
+		"symbol_error_counter_extended",
 		pmLabels,
+		nil,
 	)
-	linkErrorRecoveryCounterExtended = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_link_error_recovery_counter_extended",
-			Help: "link_error_recovery_counter_extended",
-		},
+	linkErrorRecoveryCounterExtended = prometheus.NewDesc(
+		"infiniband_link_error_recovery_counter_extended",
+		"link_error_recovery_counter_extended",
 		pmLabels,
+		nil,
 	)
-	linkDownedCounterExtended = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_link_downed_counter_extended",
-			Help: "link_downed_counter_extended",
-		},
+	linkDownedCounterExtended = prometheus.NewDesc(
+		"infiniband_link_downed_counter_extended",
+		"link_downed_counter_extended",
 		pmLabels,
+		nil,
 	)
-	portRcvErrorsExtended = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_rcv_errors_extended",
-			Help: "port_rcv_errors_extended",
-		},
+	portRcvErrorsExtended = prometheus.NewDesc(
+		"infiniband_port_rcv_errors_extended",
+		"port_rcv_errors_extended",
 		pmLabels,
+		nil,
 	)
-	portRcvRemotePhysicalErrorsExtended = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_rcv_remote_physical_errors_extended",
-			Help: "port_rcv_remote_physical_errors_extended",
-		},
+	portRcvRemotePhysicalErrorsExtended = prometheus.NewDesc(
+		"infiniband_port_rcv_remote_physical_errors_extended",
+		"port_rcv_remote_physical_errors_extended",
 		pmLabels,
+		nil,
 	)
-	portRcvSwitchRelayErrorsExtended = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_rcv_switch_relay_errors_extended",
-			Help: "port_rcv_switch_relay_errors_extended",
-		},
+	portRcvSwitchRelayErrorsExtended = prometheus.NewDesc(
+		"infiniband_port_rcv_switch_relay_errors_extended",
+		"port_rcv_switch_relay_errors_extended",
 		pmLabels,
+		nil,
 	)
-	portXmitDiscardsExtended = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_xmit_discards_extended",
-			Help: "port_xmit_discards_extended",
-		},
+	portXmitDiscardsExtended = prometheus.NewDesc(
+		"infiniband_port_xmit_discards_extended",
+		"port_xmit_discards_extended",
 		pmLabels,
+		nil,
 	)
-	portXmitConstraintErrorsExtended = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_xmit_constraint_errors_extended",
-			Help: "port_xmit_constraint_errors_extended",
-		},
+	portXmitConstraintErrorsExtended = prometheus.NewDesc(
+		"infiniband_port_xmit_constraint_errors_extended",
+		"port_xmit_constraint_errors_extended",
 		pmLabels,
+		nil,
 	)
-	portRcvConstraintErrorsExtended = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_rcv_constraint_errors_extended",
-			Help: "port_rcv_constraint_errors_extended",
-		},
+	portRcvConstraintErrorsExtended = prometheus.NewDesc(
+		"infiniband_port_rcv_constraint_errors_extended",
+		"port_rcv_constraint_errors_extended",
 		pmLabels,
+		nil,
 	)
-	localLinkIntegrityErrorsExtended = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_local_link_integrity_errors_extended",
-			Help: "local_link_integrity_errors_extended",
-		},
+	localLinkIntegrityErrorsExtended = prometheus.NewDesc(
+		"infiniband_local_link_integrity_errors_extended",
+		"local_link_integrity_errors_extended",
 		pmLabels,
+		nil,
 	)
-	excessiveBufferOverrunErrorsExtended = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_excessive_buffer_overrun_errors_extended",
-			Help: "excessive_buffer_overrun_errors_extended",
-		},
+	excessiveBufferOverrunErrorsExtended = prometheus.NewDesc(
+		"infiniband_excessive_buffer_overrun_errors_extended",
+		"excessive_buffer_overrun_errors_extended",
 		pmLabels,
+		nil,
 	)
-	vl15DroppedExtended = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_vl15_dropped_extended",
-			Help: "vl15_dropped_extended",
-		},
+	vl15DroppedExtended = prometheus.NewDesc(
+		"infiniband_vl15_dropped_extended",
+		"vl15_dropped_extended",
 		pmLabels,
+		nil,
 	)
-	portXmitWaitExtended = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_xmit_wait_extended",
-			Help: "port_xmit_wait_extended",
-		},
+	portXmitWaitExtended = prometheus.NewDesc(
+		"infiniband_port_xmit_wait_extended",
+		"port_xmit_wait_extended",
 		pmLabels,
+		nil,
 	)
-	qp1DroppedExtended = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_qp1_dropped_extended",
-			Help: "qp1_dropped_extended",
-		},
+	qp1DroppedExtended = prometheus.NewDesc(
+		"infiniband_qp1_dropped_extended",
+		"qp1_dropped_extended",
 		pmLabels,
+		nil,
 	)
-	retransmissionPerSec = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_retransmission_per_sec",
-			Help: "retransmission_per_sec",
-		},
+	retransmissionPerSec = prometheus.NewDesc(
+		"infiniband_retransmission_per_sec",
+		"retransmission_per_sec",
 		pmLabels,
+		nil,
 	)
-	maxRetransmissionRate = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_max_retransmission_rate",
-			Help: "max_retransmission_rate",
-		},
+	maxRetransmissionRate = prometheus.NewDesc(
+		"infiniband_max_retransmission_rate",
+		"max_retransmission_rate",
 		pmLabels,
+		nil,
 	)
-	portLocalPhysicalErrors = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_local_physical_errors",
-			Help: "port_local_physical_errors",
-		},
+	portLocalPhysicalErrors = prometheus.NewDesc(
+		"infiniband_port_local_physical_errors",
+		"port_local_physical_errors",
 		pmLabels,
+		nil,
 	)
-	portMalformedPacketErrors = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_malformed_packet_errors",
-			Help: "port_malformed_packet_errors",
-		},
+	portMalformedPacketErrors = prometheus.NewDesc(
+		"infiniband_port_malformed_packet_errors",
+		"port_malformed_packet_errors",
 		pmLabels,
+		nil,
 	)
-	portBufferOverrunErrors = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_buffer_overrun_errors",
-			Help: "port_buffer_overrun_errors",
-		},
+	portBufferOverrunErrors = prometheus.NewDesc(
+		"infiniband_port_buffer_overrun_errors",
+		"port_buffer_overrun_errors",
 		pmLabels,
+		nil,
 	)
-	portDlidMappingErrors = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_dlid_mapping_errors",
-			Help: "port_dlid_mapping_errors",
-		},
+	portDlidMappingErrors = prometheus.NewDesc(
+		"infiniband_port_dlid_mapping_errors",
+		"port_dlid_mapping_errors",
 		pmLabels,
+		nil,
 	)
-	portVlMappingErrors = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_vl_mapping_errors",
-			Help: "port_vl_mapping_errors",
-		},
+	portVlMappingErrors = prometheus.NewDesc(
+		"infiniband_port_vl_mapping_errors",
+		"port_vl_mapping_errors",
 		pmLabels,
+		nil,
 	)
-	portLoopingErrors = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_looping_errors",
-			Help: "port_looping_errors",
-		},
+	portLoopingErrors = prometheus.NewDesc(
+		"infiniband_port_looping_errors",
+		"port_looping_errors",
 		pmLabels,
+		nil,
 	)
-	portInactiveDiscards = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_inactive_discards",
-			Help: "port_inactive_discards",
-		},
+	portInactiveDiscards = prometheus.NewDesc(
+		"infiniband_port_inactive_discards",
+		"port_inactive_discards",
 		pmLabels,
+		nil,
 	)
-	portNeighborMtuDiscards = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_neighbor_mtu_discards",
-			Help: "port_neighbor_mtu_discards",
-		},
+	portNeighborMtuDiscards = prometheus.NewDesc(
+		"infiniband_port_neighbor_mtu_discards",
+		"port_neighbor_mtu_discards",
 		pmLabels,
+		nil,
 	)
-	portSwLifetimeLimitDiscards = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_sw_lifetime_limit_discards",
-			Help: "port_sw_lifetime_limit_discards",
-		},
+	portSwLifetimeLimitDiscards = prometheus.NewDesc(
+		"infiniband_port_sw_lifetime_limit_discards",
+		"port_sw_lifetime_limit_discards",
 		pmLabels,
+		nil,
 	)
-	portSwHoqLifetimeLimitDiscards = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "infiniband_port_sw_hoq_lifetime_limit_discards",
-			Help: "port_sw_hoq_lifetime_limit_discards",
-		},
+	portSwHoqLifetimeLimitDiscards = prometheus.NewDesc(
+		"infiniband_port_sw_hoq_lifetime_limit_discards",
+		"port_sw_hoq_lifetime_limit_discards",
 		pmLabels,
+		nil,
 	)
 )
 
 type Pmer interface {
-	UpdateMetrics()
+	prometheus.Collector
 }
 
+// LinkPm exports the counters of ibdiagnet2.pm. In PmModeKnown it exports
+// the counters of pmCounters under their historical names, in PmModeAll every
+// name=value line of a port block as infiniband_pm_<name>, with the _total
+// suffix OpenMetrics wants on the known counters, so that counters added by a
+// newer ibdiagnet or firmware show up without a release. Either way a counter
+// missing from a port block, or NA because the port does not implement it, is
+// left out rather than set to 0.
 type LinkPm struct {
 	FilePath string
+	Mode     string
+	// Counters restricts the exported counters, all of them when empty.
+	Counters []string
+	// Supported adds infiniband_pm_counter_supported for every counter of
+	// every port.
+	Supported bool
+	// Created sets _created on the counters of PmModeAll found reset, at the
+	// run time of DbCsv, keeping the reset times in pmHistory.
+	Created bool
+	DbCsv   *util.DbCsv
+	parsed  *fabricFiles
+}
+
+// pmCollection remembers the previous value of every counter, keyed by
+// <guid>_<port>_<counter>, so that a counter reset can be told. Only the reset
+// times are stored: the values, about 500k of them on a large fabric, would
+// make most of the state file rewritten by every Save, while the counters
+// that were reset since the exporter started are usually a handful, each
+// costing about 80 bytes. A reset while the exporter is down is missed.
+type pmCollection struct {
+	sync.Mutex `json:"-"`
+	loaded     bool
+	values     map[string]float64
+	RunTime    time.Time `json:"runTime"`
+	// Created holds the ibdiagnet run every counter was last reset at.
+	Created map[string]time.Time `json:"created"`
 }
 
 type Pm struct {
@@ -405,293 +406,381 @@ type Pm struct {
 	localPort  string
 }
 
+type pmCounter struct {
+	name  string
+	gauge *prometheus.Desc
+	help  string
+	// rate marks the values that go up and down, the other ones are counters
+	// in PmModeAll.
+	rate bool
+}
+
+const (
+	PmModeKnown = "known"
+	PmModeAll   = "all"
+)
+
+// pmModeDesc is the desc of a counter in PmModeAll.
+type pmModeDesc struct {
+	desc      *prometheus.Desc
+	valueType prometheus.ValueType
+}
+
+// pmCounters are the counters of ibdiagnet2.pm exported by LinkPm, in file
+// order.
+var pmCounters = []pmCounter{
+	{name: "link_down_counter", gauge: linkDownGauge, help: "Times the link error recovery process failed and the link went down"},
+	{name: "link_error_recovery_counter", gauge: linkErrorRecoveryGauge, help: "Times the link error recovery process completed successfully"},
+	{name: "symbol_error_counter", gauge: symbolErrorCounter, help: "Minor link errors detected on one or more physical lanes"},
+	{name: "port_rcv_remote_physical_errors", gauge: portRcvRemotePhysicalErrors, help: "Packets received marked with the EBP delimiter"},
+	{name: "port_rcv_errors", gauge: portRcvErrors, help: "Packets containing an error received on the port"},
+	{name: "port_xmit_discard", gauge: portXmitDiscard, help: "Outbound packets discarded because the port was down or congested"},
+	{name: "port_rcv_switch_relay_errors", gauge: portRcvSwitchRelayErrors, help: "Packets received that the switch could not forward"},
+	{name: "excessive_buffer_errors", gauge: excessiveBufferErrors, help: "Times consecutive flow control update periods had buffer overruns"},
+	{name: "local_link_integrity_errors", gauge: localLinkIntegrityErrors, help: "Times the local physical errors exceeded their threshold"},
+	{name: "port_rcv_constraint_errors", gauge: portRcvConstraintErrors, help: "Packets received that were discarded by partition or raw filtering"},
+	{name: "port_xmit_constraint_errors", gauge: portXmitConstraintErrors, help: "Packets not transmitted because of partition or raw filtering"},
+	{name: "vl15_dropped", gauge: vl15Dropped, help: "Subnet management packets dropped for lack of buffers"},
+	{name: "port_xmit_data", gauge: portXmitData, help: "Data octets transmitted divided by 4, 32 bit"},
+	{name: "port_rcv_data", gauge: portRcvData, help: "Data octets received divided by 4, 32 bit"},
+	{name: "port_xmit_pkts", gauge: portXmitPkts, help: "Packets transmitted, 32 bit"},
+	{name: "port_rcv_pkts", gauge: portRcvPkts, help: "Packets received, 32 bit"},
+	{name: "port_xmit_wait", gauge: portXmitWait, help: "Ticks during which the port had data to transmit but could not, 32 bit"},
+	{name: "port_xmit_data_extended", gauge: portXmitDataExtended, help: "Data octets transmitted divided by 4"},
+	{name: "port_rcv_data_extended", gauge: portRcvDataExtended, help: "Data octets received divided by 4"},
+	{name: "port_xmit_pkts_extended", gauge: portXmitPktsExtended, help: "Packets transmitted"},
+	{name: "port_rcv_pkts_extended", gauge: portRcvPktsExtended, help: "Packets received"},
+	{name: "port_unicast_xmit_pkts", gauge: portUnicastXmitPkts, help: "Unicast packets transmitted"},
+	{name: "port_unicast_rcv_pkts", gauge: portUnicastRcvPkts, help: "Unicast packets received"},
+	{name: "port_multicast_xmit_pkts", gauge: portMulticastXmitPkts, help: "Multicast packets transmitted"},
+	{name: "port_multicast_rcv_pkts", gauge: portMulticastRcvPkts, help: "Multicast packets received"},
+	{name: "symbol_error_counter_extended", gauge: symbolErrorCounterExtended, help: "Minor link errors detected on one or more physical lanes, 64 bit"},
+	{name: "link_error_recovery_counter_extended", gauge: linkErrorRecoveryCounterExtended, help: "Times the link error recovery process completed successfully, 64 bit"},
+	{name: "link_downed_counter_extended", gauge: linkDownedCounterExtended, help: "Times the link error recovery process failed and the link went down, 64 bit"},
+	{name: "port_rcv_errors_extended", gauge: portRcvErrorsExtended, help: "Packets containing an error received on the port, 64 bit"},
+	{name: "port_rcv_remote_physical_errors_extended", gauge: portRcvRemotePhysicalErrorsExtended, help: "Packets received marked with the EBP delimiter, 64 bit"},
+	{name: "port_rcv_switch_relay_errors_extended", gauge: portRcvSwitchRelayErrorsExtended, help: "Packets received that the switch could not forward, 64 bit"},
+	{name: "port_xmit_discards_extended", gauge: portXmitDiscardsExtended, help: "Outbound packets discarded because the port was down or congested, 64 bit"},
+	{name: "port_xmit_constraint_errors_extended", gauge: portXmitConstraintErrorsExtended, help: "Packets not transmitted because of partition or raw filtering, 64 bit"},
+	{name: "port_rcv_constraint_errors_extended", gauge: portRcvConstraintErrorsExtended, help: "Packets received that were discarded by partition or raw filtering, 64 bit"},
+	{name: "local_link_integrity_errors_extended", gauge: localLinkIntegrityErrorsExtended, help: "Times the local physical errors exceeded their threshold, 64 bit"},
+	{name: "excessive_buffer_overrun_errors_extended", gauge: excessiveBufferOverrunErrorsExtended, help: "Times consecutive flow control update periods had buffer overruns, 64 bit"},
+	{name: "vl15_dropped_extended", gauge: vl15DroppedExtended, help: "Subnet management packets dropped for lack of buffers, 64 bit"},
+	{name: "port_xmit_wait_extended", gauge: portXmitWaitExtended, help: "Ticks during which the port had data to transmit but could not"},
+	{name: "qp1_dropped_extended", gauge: qp1DroppedExtended, help: "General management packets dropped for lack of buffers"},
+	{name: "retransmission_per_sec", gauge: retransmissionPerSec, help: "Link level retransmissions per second", rate: true},
+	{name: "max_retransmission_rate", gauge: maxRetransmissionRate, help: "Highest link level retransmission rate seen", rate: true},
+	{name: "port_local_physical_errors", gauge: portLocalPhysicalErrors, help: "Packets received with a physical error, e.g. a CRC error"},
+	{name: "port_malformed_packet_errors", gauge: portMalformedPacketErrors, help: "Malformed packets received"},
+	{name: "port_buffer_overrun_errors", gauge: portBufferOverrunErrors, help: "Packets received that overran the receive buffer"},
+	{name: "port_dlid_mapping_errors", gauge: portDlidMappingErrors, help: "Packets received whose DLID could not be mapped to an output port"},
+	{name: "port_vl_mapping_errors", gauge: portVlMappingErrors, help: "Packets received whose SL could not be mapped to a VL"},
+	{name: "port_looping_errors", gauge: portLoopingErrors, help: "Packets received that would have looped back through their input port"},
+	{name: "port_inactive_discards", gauge: portInactiveDiscards, help: "Packets discarded because the output port was inactive"},
+	{name: "port_neighbor_mtu_discards", gauge: portNeighborMtuDiscards, help: "Packets discarded because they exceeded the neighbor MTU"},
+	{name: "port_sw_lifetime_limit_discards", gauge: portSwLifetimeLimitDiscards, help: "Packets discarded by the switch lifetime limit"},
+	{name: "port_sw_hoq_lifetime_limit_discards", gauge: portSwHoqLifetimeLimitDiscards, help: "Packets discarded by the switch head of queue lifetime limit"},
+}
+
 func init() {
-	metrics := []prometheus.Collector{
-		linkDownGauge,
-		linkErrorRecoveryGauge,
-		symbolErrorCounter,
-		portRcvRemotePhysicalErrors,
-		portRcvErrors,
-		portXmitDiscard,
-		portRcvSwitchRelayErrors,
-		excessiveBufferErrors,
-		localLinkIntegrityErrors,
-		portRcvConstraintErrors,
-		portXmitConstraintErrors,
-		vl15Dropped,
-		portXmitData,
-		portRcvData,
-		portXmitPkts,
-		portRcvPkts,
-		portXmitWait,
-		portXmitDataExtended,
-		portRcvDataExtended,
-		portXmitPktsExtended,
-		portRcvPktsExtended,
-		portUnicastXmitPkts,
-		portUnicastRcvPkts,
-		portMulticastXmitPkts,
-		portMulticastRcvPkts,
-		symbolErrorCounterExtended,
-		linkErrorRecoveryCounterExtended,
-		linkDownedCounterExtended,
-		portRcvErrorsExtended,
-		portRcvRemotePhysicalErrorsExtended,
-		portRcvSwitchRelayErrorsExtended,
-		portXmitDiscardsExtended,
-		portXmitConstraintErrorsExtended,
-		portRcvConstraintErrorsExtended,
-		localLinkIntegrityErrorsExtended,
-		excessiveBufferOverrunErrorsExtended,
-		vl15DroppedExtended,
-		portXmitWaitExtended,
-		qp1DroppedExtended,
-		retransmissionPerSec,
-		maxRetransmissionRate,
-		portLocalPhysicalErrors,
-		portMalformedPacketErrors,
-		portBufferOverrunErrors,
-		portDlidMappingErrors,
-		portVlMappingErrors,
-		portLoopingErrors,
-		portInactiveDiscards,
-		portNeighborMtuDiscards,
-		portSwLifetimeLimitDiscards,
-		portSwHoqLifetimeLimitDiscards,
+	registerCollector("pm", func(c *CollectorContext) Collector {
+		return &LinkPm{
+			FilePath:  c.Path("pm"),
+			Mode:      c.PmMode,
+			Counters:  c.PmCounters,
+			Supported: c.PmSupported,
+			Created:   c.Created,
+			DbCsv:     c.GetDbCsv(),
+			parsed:    c.getParsed(),
+		}
+	})
+}
+
+// PmCounterNames returns the counters LinkPm can export, e.g.
+// port_xmit_data_extended.
+func PmCounterNames() []string {
+	var names []string
+	for _, counter := range pmCounters {
+		names = append(names, counter.name)
 	}
-	for _, metric := range metrics {
-		prometheus.MustRegister(metric)
+	return names
+}
+
+// IsPmCounterMetric tells whether name is a metric of PmModeKnown,
+// infiniband_<counter>, that only goes up until reset although it is exported
+// as a gauge.
+func IsPmCounterMetric(name string) bool {
+	for _, counter := range pmCounters {
+		if !counter.rate && name == fmt.Sprintf("infiniband_%s", counter.name) {
+			return true
+		}
 	}
+	return false
 }
 
-func (p *LinkPm) UpdateMetrics() {
-	blocks, err := util.GetContent(p.FilePath, `(?m)Port=(\d+)\sLid=(\w+)\sGUID=(\w{18})\sDevice=(\d+)\sPort\sName=(.*)`)
-	if err != nil {
-		log.GetLogger().Error("Get pm content error")
+// getPm returns the labels of the port guid_port, taken from its link map
+// entry. A port missing from the link map is labelled with its own GUID, port
+// and name, so that it does not collapse with the other ones into one series.
+func getPm(guid string, port string, name string) Pm {
+	pm := Pm{
+		remoteGuid: guid,
+		remoteName: name,
+		remotePort: port,
+		component:  global.ComponentCa,
+	}
+	if util.CacheHasGuid(guid) {
+		pm.component = global.ComponentSw
+		linkMap, exists := util.GetValueFromCache(fmt.Sprintf("%s_%s", guid, port))
+		if exists {
+			pm.remoteName = linkMap["remoteName"]
+			pm.localGuid = linkMap["localGuid"]
+			pm.localName = linkMap["localName"]
+			pm.localPort = linkMap["localPort"]
+		}
+		return pm
+	}
+	if linkMap, exists := util.GetLocalFromCache(guid, port); exists {
+		pm.remoteName = linkMap["remoteName"]
+		pm.localGuid = linkMap["localGuid"]
+		pm.localName = linkMap["localName"]
+		pm.localPort = linkMap["localPort"]
+	}
+	return pm
+}
+
+// Describe sends nothing in PmModeAll, whose counters are only known once the
+// file is read, which makes LinkPm an unchecked collector.
+func (p *LinkPm) Describe(ch chan<- *prometheus.Desc) {
+	if p.Mode == PmModeAll {
 		return
 	}
-	for _, block := range *blocks {
-		switchCaExpr := `Port=(\d+)\sLid=(\w+)\sGUID=(\w{18})\sDevice=(\d+)\sPort\sName=(.*)`
-		switchCaMatch, err := regexp.Compile(switchCaExpr)
-		if err != nil {
-			log.GetLogger().Error("Switch or ca error compiling regex")
-			break
+	for _, counter := range pmCounters {
+		ch <- counter.gauge
+	}
+	if p.Supported {
+		ch <- pmCounterSupportedGauge
+	}
+}
+
+func (p *LinkPm) Collect(ch chan<- prometheus.Metric) {
+	metrics := newMetricSet()
+	defer metrics.collect(ch)
+	var counters []pmCounter
+	for _, counter := range pmCounters {
+		if len(p.Counters) > 0 && !slices.Contains(p.Counters, counter.name) {
+			continue
+		}
+		counters = append(counters, counter)
+	}
+	var runTime time.Time
+	values := make(map[string]float64)
+	var reset bool
+	if p.Created && p.Mode == PmModeAll {
+		var err error
+		if runTime, err = GetRunTime(p.DbCsv); err != nil {
+			runTime = time.Now()
 		}
-		subSwitchCaMatch := switchCaMatch.FindStringSubmatch(block)
-		guid := subSwitchCaMatch[3]
-		port := subSwitchCaMatch[1]
-		name := subSwitchCaMatch[5]
-		var remoteGuid, remoteName, remotePort, localGuid, localName, localPort string
-		component := global.ComponentCa
-		_, exists := util.GetKeysFromCache(guid)
-		if exists {
-			component = global.ComponentSw
-			linkMap, exists := util.GetValueFromCache(fmt.Sprintf("%s_%s", guid, port))
-			if exists {
-				remoteGuid = guid
-				remoteName = linkMap["remoteName"]
-				remotePort = port
-				localGuid = linkMap["localGuid"]
-				localName = linkMap["localName"]
-				localPort = linkMap["localPort"]
+		pmHistory.Lock()
+		defer pmHistory.Unlock()
+		if !pmHistory.loaded {
+			if err := store.GetSection("pm", pmHistory); err != nil {
+				log.GetLogger().Error(fmt.Sprintf("Load pm history error: %s", err))
 			}
-		} else {
-			for _, linkMap := range util.Cache {
-				remoteGuid = guid
-				remotePort = port
-				if linkMap["localGuid"] == guid {
-					remoteName = linkMap["remoteName"]
-					localGuid = linkMap["localGuid"]
-					localName = linkMap["localName"]
-					localPort = linkMap["localPort"]
-					break
-				} else {
-					remoteName = name
-				}
+			if pmHistory.Created == nil {
+				pmHistory.Created = make(map[string]time.Time)
 			}
+			pmHistory.loaded = true
 		}
-		pm := Pm{
-			remoteGuid: remoteGuid,
-			remoteName: remoteName,
-			remotePort: remotePort,
-			component:  component,
-			localGuid:  localGuid,
-			localName:  localName,
-			localPort:  localPort,
-		}
-		getValue := func(regexStr string) (value float64) {
-			re := regexp.MustCompile(regexStr)
-			match := re.FindStringSubmatch(block)
-			if match == nil {
-				return 0
+		defer func() {
+			if runTime.Before(pmHistory.RunTime) {
+				return
 			}
-			metricValue := match[1]
-			if metricValue == "NA" {
-				return 0
+			pmHistory.RunTime = runTime
+			pmHistory.values = values
+			if !reset {
+				return
 			}
-			numberStr := strings.Replace(metricValue, "0x", "", -1)
-			numberStr = strings.Replace(numberStr, "0X", "", -1)
-			dec, err := strconv.ParseInt(numberStr, 16, 64)
-			if err != nil {
-				log.GetLogger().Error(fmt.Sprintf("Parse error:%s", err))
-				//TODO
-				return 0
+			if err := store.SetSection("pm", pmHistory); err != nil {
+				log.GetLogger().Error(fmt.Sprintf("Store pm history error: %s", err))
 			}
-			return float64(dec)
+		}()
+	}
+	var fabricCounters map[string]map[string]float64
+	if p.parsed != nil {
+		fabricCounters = make(map[string]map[string]float64)
+	}
+	err := ScanPmFile(p.FilePath, func(port *PmPort) {
+		if fabricCounters != nil {
+			fabricCounters[fmt.Sprintf("%s_%s", port.Guid, port.Port)] = getPmPortCounters(port)
 		}
+		pm := getPm(port.Guid, port.Port, port.Name)
 		labelValues := []string{pm.remoteGuid, pm.remoteName, pm.remotePort, pm.component, pm.localGuid, pm.localName, pm.localPort}
-		linkDownGauge.
-			WithLabelValues(labelValues...).
-			Set(getValue(`link_down_counter=(\w+)`))
-		linkErrorRecoveryGauge.
-			WithLabelValues(labelValues...).
-			Set(getValue(`link_error_recovery_counter=(\w+)`))
-		symbolErrorCounter.
-			WithLabelValues(labelValues...).
-			Set(getValue(`symbol_error_counter=(\w+)`))
-		portRcvRemotePhysicalErrors.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_rcv_remote_physical_errors=(\w+)`))
-		portRcvErrors.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_rcv_errors=(\w+)`))
-		portXmitDiscard.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_xmit_discard=(\w+)`))
-		portRcvSwitchRelayErrors.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_rcv_switch_relay_errors=(\w+)`))
-		excessiveBufferErrors.
-			WithLabelValues(labelValues...).
-			Set(getValue(`excessive_buffer_errors=(\w+)`))
-		localLinkIntegrityErrors.
-			WithLabelValues(labelValues...).
-			Set(getValue(`local_link_integrity_errors=(\w+)`))
-		portRcvConstraintErrors.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_rcv_constraint_errors=(\w+)`))
-		portXmitConstraintErrors.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_xmit_constraint_errors=(\w+)`))
-		vl15Dropped.
-			WithLabelValues(labelValues...).
-			Set(getValue(`vl15_dropped=(\w+)`))
-		portXmitData.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_xmit_data=(\w+)`))
-		portRcvData.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_rcv_data=(\w+)`))
-		portXmitPkts.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_xmit_pkts=(\w+)`))
-		portRcvPkts.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_rcv_pkts=(\w+)`))
-		portXmitWait.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_xmit_wait=(\w+)`))
-		portXmitDataExtended.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_xmit_data_extended=(\w+)`))
-		portRcvDataExtended.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_rcv_data_extended=(\w+)`))
-		portXmitPktsExtended.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_xmit_pkts_extended=(\w+)`))
-		portRcvPktsExtended.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_rcv_pkts_extended=(\w+)`))
-		portUnicastXmitPkts.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_unicast_xmit_pkts=(\w+)`))
-		portUnicastRcvPkts.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_unicast_rcv_pkts=(\w+)`))
-		portMulticastXmitPkts.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_multicast_xmit_pkts=(\w+)`))
-		portMulticastRcvPkts.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_multicast_rcv_pkts=(\w+)`))
-		symbolErrorCounterExtended.
-			WithLabelValues(labelValues...).
-			Set(getValue(`symbol_error_counter_extended=(\w+)`))
-		linkErrorRecoveryCounterExtended.
-			WithLabelValues(labelValues...).
-			Set(getValue(`link_error_recovery_counter_extended=(\w+)`))
-		linkDownedCounterExtended.
-			WithLabelValues(labelValues...).
-			Set(getValue(`link_downed_counter_extended=(\w+)`))
-		portRcvErrorsExtended.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_rcv_errors_extended=(\w+)`))
-		portRcvRemotePhysicalErrorsExtended.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_rcv_remote_physical_errors_extended=(\w+)`))
-		portRcvSwitchRelayErrorsExtended.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_rcv_switch_relay_errors_extended=(\w+)`))
-		portXmitDiscardsExtended.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_xmit_discards_extended=(\w+)`))
-		portXmitConstraintErrorsExtended.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_xmit_constraint_errors_extended=(\w+)`))
-		portRcvConstraintErrorsExtended.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_rcv_constraint_errors_extended=(\w+)`))
-		localLinkIntegrityErrorsExtended.
-			WithLabelValues(labelValues...).
-			Set(getValue(`local_link_integrity_errors_extended=(\w+)`))
-		excessiveBufferOverrunErrorsExtended.
-			WithLabelValues(labelValues...).
-			Set(getValue(`excessive_buffer_overrun_errors_extended=(\w+)`))
-		vl15DroppedExtended.
-			WithLabelValues(labelValues...).
-			Set(getValue(`vl15_dropped_extended=(\w+)`))
-		portXmitWaitExtended.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_xmit_wait_extended=(\w+)`))
-		qp1DroppedExtended.
-			WithLabelValues(labelValues...).
-			Set(getValue(`qp1_dropped_extended=(\w+)`))
-		retransmissionPerSec.
-			WithLabelValues(labelValues...).
-			Set(getValue(`retransmission_per_sec=(\w+)`))
-		maxRetransmissionRate.
-			WithLabelValues(labelValues...).
-			Set(getValue(`max_retransmission_rate=(\w+)`))
-		portLocalPhysicalErrors.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_local_physical_errors=(\w+)`))
-		portMalformedPacketErrors.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_malformed_packet_errors=(\w+)`))
-		portBufferOverrunErrors.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_buffer_overrun_errors=(\w+)`))
-		portDlidMappingErrors.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_dlid_mapping_errors=(\w+)`))
-		portVlMappingErrors.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_vl_mapping_errors=(\w+)`))
-		portLoopingErrors.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_looping_errors=(\w+)`))
-		portInactiveDiscards.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_inactive_discards=(\w+)`))
-		portNeighborMtuDiscards.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_neighbor_mtu_discards=(\w+)`))
-		portSwLifetimeLimitDiscards.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_sw_lifetime_limit_discards=(\w+)`))
-		portSwHoqLifetimeLimitDiscards.
-			WithLabelValues(labelValues...).
-			Set(getValue(`port_sw_hoq_lifetime_limit_discards=(\w+)`))
+		export := func(name string, desc *prometheus.Desc, valueType prometheus.ValueType) {
+			metricValue, exists := port.Counters[name]
+			supported := exists && metricValue != "NA"
+			if p.Supported {
+				metrics.set(pmCounterSupportedGauge, boolToFloat(supported), append(labelValues, name)...)
+			}
+			if !supported {
+				return
+			}
+			value := getPmValue(name, metricValue)
+			if value == nil {
+				return
+			}
+			if runTime.IsZero() || valueType != prometheus.CounterValue {
+				metrics.put(desc, valueType, *value, false, labelValues)
+				return
+			}
+			key := fmt.Sprintf("%s_%s_%s", port.Guid, port.Port, name)
+			// A counter first seen started at an unknown time, it is exported
+			// without _created until it is found reset.
+			if previous, seen := pmHistory.values[key]; seen && *value < previous && !runTime.Before(pmHistory.RunTime) {
+				pmHistory.Created[key] = runTime
+				reset = true
+			}
+			values[key] = *value
+			metrics.setCounterCreated(desc, *value, pmHistory.Created[key], labelValues...)
+		}
+		if p.Mode != PmModeAll {
+			for _, counter := range counters {
+				export(counter.name, counter.gauge, prometheus.GaugeValue)
+			}
+			return
+		}
+		for _, name := range port.Names {
+			if len(p.Counters) > 0 && !slices.Contains(p.Counters, name) {
+				continue
+			}
+			// Per lane counters, name[index], are exported by LinkVl.
+			if !pmCounterNameExpr.MatchString(name) {
+				continue
+			}
+			desc := getPmModeDesc(name)
+			export(name, desc.desc, desc.valueType)
+		}
+	})
+	if err != nil {
+		log.GetLogger().Error(fmt.Sprintf("Scan pm error: %s", err))
+		return
+	}
+	p.parsed.setCounters(fabricCounters)
+}
+
+// getPmModeDesc returns the desc of a counter in PmModeAll, creating it the
+// first time the counter shows up, with the help and type of pmCounters when
+// the counter is known and untyped otherwise.
+func getPmModeDesc(name string) pmModeDesc {
+	pmModeDescLock.Lock()
+	defer pmModeDescLock.Unlock()
+	desc, exists := pmModeDescs[name]
+	if exists {
+		return desc
+	}
+	help := fmt.Sprintf("%s of ibdiagnet2.pm, unknown to the exporter", name)
+	valueType := prometheus.UntypedValue
+	for _, counter := range pmCounters {
+		if counter.name != name {
+			continue
+		}
+		help = counter.help
+		valueType = prometheus.CounterValue
+		if counter.rate {
+			valueType = prometheus.GaugeValue
+		}
+	}
+	metricName := fmt.Sprintf("infiniband_pm_%s", name)
+	if valueType == prometheus.CounterValue {
+		metricName += "_total"
+	}
+	desc = pmModeDesc{
+		desc:      prometheus.NewDesc(metricName, help, pmLabels, nil),
+		valueType: valueType,
+	}
+	pmModeDescs[name] = desc
+	return desc
+}
+
+// PmPort is one port block of ibdiagnet2.pm. Counters holds the raw value of
+// every name=value line, e.g. 0x0000 or NA, and Names the counter names in
+// file order.
+type PmPort struct {
+	Port     string
+	Lid      string
+	Guid     string
+	Device   string
+	Name     string
+	Names    []string
+	Counters map[string]string
+}
+
+// ScanPm reads ibdiagnet2.pm in a single pass, line by line, calling fn with
+// every port block once its counters are read.
+func ScanPm(r io.Reader, fn func(port *PmPort)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var port *PmPort
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "Port=") {
+			if header := pmHeaderExpr.FindStringSubmatch(line); header != nil {
+				if port != nil {
+					fn(port)
+				}
+				port = &PmPort{
+					Port:     header[1],
+					Lid:      header[2],
+					Guid:     header[3],
+					Device:   header[4],
+					Name:     header[5],
+					Names:    make([]string, 0, len(pmCounters)),
+					Counters: make(map[string]string, len(pmCounters)),
+				}
+				continue
+			}
+		}
+		if port == nil {
+			continue
+		}
+		name, value, found := strings.Cut(line, "=")
+		if !found || name == "" {
+			continue
+		}
+		// The first value wins, as with the former per counter regexps.
+		if _, exists := port.Counters[name]; !exists {
+			port.Names = append(port.Names, name)
+			port.Counters[name] = strings.TrimSpace(value)
+		}
+	}
+	if port != nil {
+		fn(port)
+	}
+	return scanner.Err()
+}
+
+func ScanPmFile(filePath string, fn func(port *PmPort)) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return ScanPm(file, fn)
+}
+
+// getPmValue converts a raw counter value, hex as written by ibdiagnet, e.g.
+// 0x0000, or decimal. Counters are unsigned 64 bit, so ParseUint keeps even
+// 0xfffffffffffffffe, and the value is exact up to 2^53. It returns nil for
+// a value that is not a number, e.g. NA, logging the first such value of each
+// counter name.
+func getPmValue(name string, metricValue string) *float64 {
+	value := parseCounter(metricValue)
+	if value == nil {
+		pmInvalidNameLock.Lock()
+		defer pmInvalidNameLock.Unlock()
+		if !pmInvalidNames[name] {
+			pmInvalidNames[name] = true
+			log.GetLogger().Error(fmt.Sprintf("Parse pm value %q of %s error, the next ones of %s are not logged", metricValue, name, name))
+		}
 	}
+	return value
 }
@@ -0,0 +1,331 @@
+package ibdiagnet2
+
+import (
+	"bufio"
+	"fmt"
+	iblog "infiniband_exporter/log"
+	"infiniband_exporter/util"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	testDataDir = "../data/ibdiagnet2"
+	benchPorts  = 50000
+)
+
+var pmGuidExpr = regexp.MustCompile(`GUID=0x\w{16}`)
+
+func TestMain(m *testing.M) {
+	iblog.InitNopLogger()
+	os.Exit(m.Run())
+}
+
+const pmPortHeader = `-------------------------------------------------------
+Port=1 Lid=0x00b4 GUID=0xb0cf0e0300d33fc0 Device=54002 Port Name=ib-switch-sequoia/U1/P1/1/1
+-------------------------------------------------------
+`
+
+func TestScanPmFile(t *testing.T) {
+	var ports []*PmPort
+	if err := ScanPmFile(filepath.Join(testDataDir, "ibdiagnet2.pm"), func(port *PmPort) {
+		ports = append(ports, port)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(ports) != 542 {
+		t.Fatalf("%d ports, expected 542", len(ports))
+	}
+	port := ports[0]
+	if port.Port != "1" || port.Lid != "0x00b4" || port.Guid != "0xb0cf0e0300d33fc0" || port.Device != "54002" || port.Name != "ib-switch-sequoia/U1/P1/1/1" {
+		t.Errorf("unexpected header %+v", port)
+	}
+	if port.Names[0] != "link_down_counter" || port.Counters["port_xmit_data_extended"] != "0x00000045a9712343" {
+		t.Errorf("unexpected counters %v", port.Counters)
+	}
+	if port.Counters["port_looping_errors"] != "NA" {
+		t.Errorf("port_looping_errors is %q, expected NA", port.Counters["port_looping_errors"])
+	}
+}
+
+func TestScanPm(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		content  string
+		names    []string
+		counters map[string]string
+	}{
+		{
+			"NA kept raw",
+			pmPortHeader + "link_down_counter=NA\n",
+			[]string{"link_down_counter"},
+			map[string]string{"link_down_counter": "NA"},
+		},
+		{
+			"missing counter",
+			pmPortHeader + "port_xmit_data_extended=0x0000000000000010\n",
+			[]string{"port_xmit_data_extended"},
+			map[string]string{"port_xmit_data_extended": "0x0000000000000010"},
+		},
+		{
+			"first value wins",
+			pmPortHeader + "symbol_error_counter=0x1\nsymbol_error_counter=0x2\n",
+			[]string{"symbol_error_counter"},
+			map[string]string{"symbol_error_counter": "0x1"},
+		},
+		{
+			"lines outside a port and without a name",
+			"# port_rcv_errors=0x5\nport_rcv_errors=0x5\n" + pmPortHeader + "=0x1\nport_rcv_errors=0x2 \n",
+			[]string{"port_rcv_errors"},
+			map[string]string{"port_rcv_errors": "0x2"},
+		},
+		{
+			"no final newline",
+			pmPortHeader + "vl15_dropped=0xfffffffffffffffe",
+			[]string{"vl15_dropped"},
+			map[string]string{"vl15_dropped": "0xfffffffffffffffe"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var ports []*PmPort
+			if err := ScanPm(strings.NewReader(test.content), func(port *PmPort) {
+				ports = append(ports, port)
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if len(ports) != 1 {
+				t.Fatalf("%d ports, expected 1", len(ports))
+			}
+			if !reflect.DeepEqual(ports[0].Names, test.names) || !reflect.DeepEqual(ports[0].Counters, test.counters) {
+				t.Errorf("names %q counters %v, expected %q %v", ports[0].Names, ports[0].Counters, test.names, test.counters)
+			}
+		})
+	}
+}
+
+// TestLinkPmCollect checks that a counter NA or missing from its port block
+// is left out rather than set to 0 and that the counters are unsigned 64 bit.
+func TestLinkPmCollect(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		line      string
+		value     float64
+		supported bool
+	}{
+		{"hex", "link_down_counter=0x00000010", 16, true},
+		{"decimal", "link_down_counter=42", 42, true},
+		{"NA", "link_down_counter=NA", 0, false},
+		{"missing", "", 0, false},
+		{"above int64", "link_down_counter=0xfffffffffffffffe", 18446744073709551614, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			filePath := filepath.Join(t.TempDir(), "ibdiagnet2.pm")
+			if err := os.WriteFile(filePath, []byte(pmPortHeader+test.line+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			registry := prometheus.NewRegistry()
+			registry.MustRegister(&LinkPm{FilePath: filePath, Mode: PmModeKnown, Counters: []string{"link_down_counter"}, Supported: true})
+			metricFamilies, err := registry.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			families := make(map[string]*dto.MetricFamily)
+			for _, metricFamily := range metricFamilies {
+				families[metricFamily.GetName()] = metricFamily
+			}
+			counter, exists := families["infiniband_link_down_counter"]
+			if exists != test.supported {
+				t.Fatalf("infiniband_link_down_counter exported: %v, expected %v", exists, test.supported)
+			}
+			if exists && counter.Metric[0].GetGauge().GetValue() != test.value {
+				t.Errorf("value %v, expected %v", counter.Metric[0].GetGauge().GetValue(), test.value)
+			}
+			supported := families["infiniband_pm_counter_supported"]
+			if supported == nil || len(supported.Metric) != 1 {
+				t.Fatalf("expected one infiniband_pm_counter_supported, got %v", supported)
+			}
+			if value := supported.Metric[0].GetGauge().GetValue(); value != boolToFloat(test.supported) {
+				t.Errorf("infiniband_pm_counter_supported %v, expected %v", value, boolToFloat(test.supported))
+			}
+		})
+	}
+}
+
+// BenchmarkPmRegexp times the regexp parser LinkPm used to run, which
+// compiled the header and every counter expression again for each port.
+func BenchmarkPmRegexp(b *testing.B) {
+	filePath := scaledPmFile(b)
+	for i := 0; i < b.N; i++ {
+		blocks, err := util.GetContent(filePath, pmHeaderExpr.String())
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, block := range *blocks {
+			header := regexp.MustCompile(pmHeaderExpr.String()).FindStringSubmatch(block)
+			if header == nil {
+				continue
+			}
+			for _, counter := range pmCounters {
+				re := regexp.MustCompile(fmt.Sprintf(`%s=(\w+)`, counter.name))
+				if match := re.FindStringSubmatch(block); match != nil && match[1] != "NA" {
+					getPmValue(counter.name, match[1])
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkPmScan(b *testing.B) {
+	filePath := scaledPmFile(b)
+	for i := 0; i < b.N; i++ {
+		err := ScanPmFile(filePath, func(port *PmPort) {
+			for _, counter := range pmCounters {
+				if metricValue, exists := port.Counters[counter.name]; exists && metricValue != "NA" {
+					getPmValue(counter.name, metricValue)
+				}
+			}
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkPmCollect collects the scaled ibdiagnet2.pm with a link map naming
+// all its ports, so that every port is looked up in it.
+func BenchmarkPmCollect(b *testing.B) {
+	setBenchCache(b, benchPorts)
+	pm := &LinkPm{FilePath: scaledPmFile(b)}
+	for i := 0; i < b.N; i++ {
+		ch := make(chan prometheus.Metric, 1024)
+		go func() {
+			pm.Collect(ch)
+			close(ch)
+		}()
+		for range ch {
+		}
+	}
+}
+
+// scaledPmFile writes the sample ibdiagnet2.pm scaled to benchPorts ports in
+// a temporary directory and returns its path, timing only what follows.
+func scaledPmFile(b *testing.B) string {
+	b.Helper()
+	filePath := filepath.Join(b.TempDir(), "ibdiagnet2.pm")
+	if err := scalePmFile(filepath.Join(testDataDir, "ibdiagnet2.pm"), filePath, benchPorts); err != nil {
+		b.Fatal(err)
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(info.Size())
+	b.ReportAllocs()
+	b.ResetTimer()
+	return filePath
+}
+
+// scalePmFile writes to dst the port blocks of the src ibdiagnet2.pm repeated
+// until there are ports of them. The GUIDs of every repetition are shifted so
+// that each port stays distinct.
+func scalePmFile(src, dst string, ports int) error {
+	content, err := util.ReadFileContent(src)
+	if err != nil {
+		return err
+	}
+	// A block starts at the dashes line above its Port= header.
+	lines := strings.SplitAfter(content, "\n")
+	var starts []int
+	for i, line := range lines {
+		if i > 0 && strings.HasPrefix(line, "Port=") && pmHeaderExpr.MatchString(line) {
+			starts = append(starts, i-1)
+		}
+	}
+	if len(starts) == 0 {
+		return fmt.Errorf("no port found in %s", src)
+	}
+	var blocks []string
+	for i, start := range starts {
+		end := len(lines)
+		if i < len(starts)-1 {
+			end = starts[i+1]
+		}
+		block := strings.Join(lines[start:end], "")
+		if !strings.HasSuffix(block, "\n") {
+			block += "\n"
+		}
+		blocks = append(blocks, block)
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	writer := bufio.NewWriter(out)
+	if _, err := writer.WriteString(strings.Join(lines[:starts[0]], "")); err != nil {
+		return err
+	}
+	for i := 0; i < ports; i++ {
+		block := blocks[i%len(blocks)]
+		if round := i / len(blocks); round > 0 {
+			block = pmGuidExpr.ReplaceAllStringFunc(block, func(guid string) string {
+				return "GUID=" + shiftGuid(guid[len("GUID="):], round)
+			})
+		}
+		if _, err := writer.WriteString(block); err != nil {
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// shiftGuid returns the GUID of the repetition round of the port blocks
+// scalePmFile writes.
+func shiftGuid(guid string, round int) string {
+	value, _ := strconv.ParseUint(strings.TrimPrefix(guid, "0x"), 16, 64)
+	return fmt.Sprintf("0x%016x", value^uint64(round)<<32)
+}
+
+// setBenchCache sets, until the benchmark ends, the link map of the sample
+// ibdiagnet2.lst repeated with the GUIDs of scalePmFile up to ports ports.
+func setBenchCache(b *testing.B, ports int) {
+	b.Helper()
+	links, err := ParseLst(filepath.Join(testDataDir, "ibdiagnet2.lst"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	linkMap := make(map[string]map[string]string)
+	for round := 0; len(linkMap) < ports; round++ {
+		for _, link := range *links {
+			remote, local := link.Remote, link.Local
+			if remote.Component != "sw" {
+				remote, local = local, remote
+			}
+			remoteGuid, localGuid := shiftGuid(remote.NodeGuid, round), shiftGuid(local.NodeGuid, round)
+			linkMap[remoteGuid+"_"+remote.Port] = map[string]string{
+				"localGuid":  localGuid,
+				"localName":  local.Name,
+				"localPort":  local.Port,
+				"remoteGuid": remoteGuid,
+				"remoteName": remote.Name,
+				"remotePort": remote.Port,
+			}
+		}
+	}
+	util.SetCache(linkMap)
+	b.Cleanup(func() {
+		util.SetCache(make(map[string]map[string]string))
+	})
+}
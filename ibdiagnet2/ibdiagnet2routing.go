@@ -0,0 +1,232 @@
+package ibdiagnet2
+
+import (
+	"fmt"
+	"infiniband_exporter/log"
+	"infiniband_exporter/util"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const sharpAggregationNodeName = "Mellanox Technologies Aggregation Node"
+
+var (
+	arInfoLabels = []string{"guid", "name"}
+	arFeatures   = map[string]string{
+		"e":               "infiniband_ar_enabled",
+		"fr_enabled":      "infiniband_fr_enabled",
+		"rn_xmit_enabled": "infiniband_rn_xmit_enabled",
+		"whbf_en":         "infiniband_whbf_enabled",
+		"pfrn_enabled":    "infiniband_pfrn_enabled",
+	}
+	rnCounters = []string{
+		"port_rcv_rn_pkt",
+		"port_xmit_rn_pkt",
+		"port_rcv_rn_error",
+		"port_rcv_switch_relay_rn_error",
+		"port_ar_trails",
+		"pfrn_received_packet",
+		"pfrn_received_error",
+		"pfrn_xmit_packet",
+		"pfrn_start_packet",
+	}
+	hbfCounters = []string{
+		"rx_pkt_forwarding_static",
+		"rx_pkt_forwarding_hbf",
+		"rx_pkt_forwarding_ar",
+		"rx_pkt_hbf_fallback_local",
+		"rx_pkt_hbf_fallback_remote",
+		"rx_pkt_forwarding_hbf_sg0",
+		"rx_pkt_forwarding_hbf_sg1",
+		"rx_pkt_forwarding_hbf_sg2",
+		"rx_pkt_forwarding_ar_sg0",
+		"rx_pkt_forwarding_ar_sg1",
+		"rx_pkt_forwarding_ar_sg2",
+	}
+	arFeatureGauges      = make(map[string]*prometheus.Desc)
+	routingCounterGauges = make(map[string]*prometheus.Desc)
+	rnMaxGauge           = prometheus.NewDesc(
+		"infiniband_rn_max_value",
+		"Fabric wide maximum of routing notification counters from ibdiagnet2.rnc2",
+		[]string{"counter"},
+		nil,
+	)
+	sharpNodeGauge = prometheus.NewDesc(
+		"infiniband_sharp_aggregation_node_info",
+		"Gauge infiniband SHARP aggregation node info, 1 for ACT",
+		util.GetFieldNames(SharpNode{}),
+		nil,
+	)
+	sharpNodesGauge = prometheus.NewDesc(
+		"infiniband_sharp_aggregation_nodes",
+		"Number of SHARP aggregation nodes by link state",
+		[]string{"state"},
+		nil,
+	)
+
+	rnMaxExpr = regexp.MustCompile(`(?m)^(Max [^:]+):\s+(\S+)`)
+)
+
+type Routinger interface {
+	ParseContent() (*[]SharpNode, error)
+	prometheus.Collector
+}
+
+// LinkRouting exports adaptive routing, routing notification and HBF state
+// from ibdiagnet2.db_csv and ibdiagnet2.rnc2, and the SHARP aggregation nodes
+// listed in ibdiagnet2.lst.
+type LinkRouting struct {
+	FilePath string
+	RncPath  string
+	DbCsv    *util.DbCsv
+	parsed   *fabricFiles
+}
+
+type SharpNode struct {
+	guid       string
+	lid        string
+	switchGuid string
+	switchName string
+	switchPort string
+	state      string
+}
+
+func init() {
+	for column, name := range arFeatures {
+		arFeatureGauges[column] = prometheus.NewDesc(
+			name,
+			fmt.Sprintf("AR_INFO %s", column),
+			arInfoLabels,
+			nil,
+		)
+	}
+	for _, counter := range append(rnCounters, hbfCounters...) {
+		routingCounterGauges[counter] = prometheus.NewDesc(
+			fmt.Sprintf("infiniband_%s", counter),
+			counter,
+			pmLabels,
+			nil,
+		)
+	}
+	registerCollector("routing", func(c *CollectorContext) Collector {
+		return &LinkRouting{FilePath: c.Path("lst"), RncPath: c.Path("rnc2"), DbCsv: c.GetDbCsv(), parsed: c.getParsed()}
+	})
+}
+
+// ParseContent returns the SHARP aggregation nodes, which ibdiagnet reports as
+// CAs hanging off a switch port.
+func (r *LinkRouting) ParseContent() (*[]SharpNode, error) {
+	links, err := ParseLst(r.FilePath)
+	if err != nil {
+		return nil, err
+	}
+	r.parsed.setLst(links)
+	var sharpNodes []SharpNode
+	for _, link := range *links {
+		node, peer := link.Local, link.Remote
+		if peer.Name == sharpAggregationNodeName {
+			node, peer = peer, node
+		}
+		if node.Name != sharpAggregationNodeName {
+			continue
+		}
+		sharpNodes = append(sharpNodes, SharpNode{
+			guid:       node.PortGuid,
+			lid:        node.Lid,
+			switchGuid: peer.NodeGuid,
+			switchName: peer.Name,
+			switchPort: peer.Port,
+			state:      link.State,
+		})
+	}
+	return &sharpNodes, nil
+}
+
+func (r *LinkRouting) Describe(ch chan<- *prometheus.Desc) {
+	for _, gauge := range arFeatureGauges {
+		ch <- gauge
+	}
+	for _, gauge := range routingCounterGauges {
+		ch <- gauge
+	}
+	describe(ch,
+		rnMaxGauge,
+		sharpNodeGauge,
+		sharpNodesGauge,
+	)
+}
+
+func (r *LinkRouting) Collect(ch chan<- prometheus.Metric) {
+	metrics := newMetricSet()
+	defer metrics.collect(ch)
+	nodeNames := getNodeNames(r.DbCsv)
+	if rows, err := r.DbCsv.Section("AR_INFO"); err == nil {
+		for _, row := range *rows {
+			for column, gauge := range arFeatureGauges {
+				if value := parseCounter(row[column]); value != nil {
+					metrics.set(gauge, *value, row["NodeGUID"], nodeNames[row["NodeGUID"]])
+				}
+			}
+		}
+	}
+	r.updateCounters(metrics, "RN_COUNTERS", rnCounters, nodeNames)
+	r.updateCounters(metrics, "HBF_PORT_COUNTERS", hbfCounters, nodeNames)
+
+	if fileContent, err := util.ReadFileContent(r.RncPath); err == nil {
+		for _, match := range rnMaxExpr.FindAllStringSubmatch(fileContent, -1) {
+			if value := parseCounter(match[2]); value != nil {
+				counter := strings.ReplaceAll(strings.ToLower(match[1]), " ", "_")
+				metrics.set(rnMaxGauge, *value, counter)
+			}
+		}
+	}
+
+	sharpNodes, err := r.ParseContent()
+	if err != nil {
+		log.GetLogger().Error("Parse sharp aggregation nodes error")
+		return
+	}
+	for _, node := range *sharpNodes {
+		var value float64
+		if node.state == "ACT" {
+			value = 1
+		}
+		metrics.set(sharpNodeGauge, value, node.guid, node.lid, node.switchGuid, node.switchName, node.switchPort, node.state)
+		metrics.inc(sharpNodesGauge, node.state)
+	}
+}
+
+func (r *LinkRouting) updateCounters(metrics *metricSet, section string, counters []string, nodeNames map[string]string) {
+	rows, err := r.DbCsv.Section(section)
+	if err != nil {
+		return
+	}
+	for _, row := range *rows {
+		pm := getPm(row["NodeGUID"], row["PortNumber"], nodeNames[row["NodeGUID"]])
+		labelValues := []string{pm.remoteGuid, pm.remoteName, pm.remotePort, pm.component, pm.localGuid, pm.localName, pm.localPort}
+		for _, counter := range counters {
+			if value := parseCounter(row[counter]); value != nil {
+				metrics.set(routingCounterGauges[counter], *value, labelValues...)
+			}
+		}
+	}
+}
+
+// parseCounter parses decimal or 0x prefixed counters; N/A yields nil.
+func parseCounter(s string) *float64 {
+	base := 10
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		s, base = s[2:], 16
+	}
+	if value, err := strconv.ParseUint(s, base, 64); err == nil {
+		result := float64(value)
+		return &result
+	}
+	if base == 16 {
+		return nil
+	}
+	return parseFloat(s)
+}
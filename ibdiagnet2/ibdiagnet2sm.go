@@ -0,0 +1,313 @@
+package ibdiagnet2
+
+import (
+	"fmt"
+	"infiniband_exporter/log"
+	"infiniband_exporter/store"
+	"infiniband_exporter/util"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	smLabels    = []string{"guid", "name", "lid", "port", "state"}
+	smInfoGauge = prometheus.NewDesc(
+		"infiniband_sm_info",
+		"Gauge infiniband subnet manager info, 1 for master",
+		smLabels,
+		nil,
+	)
+	smPriorityGauge = prometheus.NewDesc(
+		"infiniband_sm_priority",
+		"sm_priority",
+		[]string{"guid", "name"},
+		nil,
+	)
+	smActCountGauge = prometheus.NewDesc(
+		"infiniband_sm_act_count",
+		"sm_act_count",
+		[]string{"guid", "name"},
+		nil,
+	)
+	smActCountRateGauge = prometheus.NewDesc(
+		"infiniband_sm_act_count_rate",
+		"ActCount increase per second between two ibdiagnet runs",
+		[]string{"guid", "name"},
+		nil,
+	)
+	smMasterCountGauge = prometheus.NewDesc(
+		"infiniband_sm_master_count",
+		"Number of subnet managers in master state",
+		nil,
+		nil,
+	)
+	smNoMasterGauge = prometheus.NewDesc(
+		"infiniband_sm_no_master",
+		"1 if no subnet manager is in master state",
+		nil,
+		nil,
+	)
+	smMultipleMastersGauge = prometheus.NewDesc(
+		"infiniband_sm_multiple_masters",
+		"1 if more than one subnet manager is in master state",
+		nil,
+		nil,
+	)
+	smMasterChangedGauge = prometheus.NewDesc(
+		"infiniband_sm_master_changed",
+		"1 if the master subnet manager changed since the last collection",
+		nil,
+		nil,
+	)
+	smMasterChangesCounter = prometheus.NewDesc(
+		"infiniband_sm_master_changes_total",
+		"Total master subnet manager changes seen by the exporter",
+		nil,
+		nil,
+	)
+
+	smStateNames = map[string]string{
+		"0": "not_active",
+		"1": "discovering",
+		"2": "standby",
+		"3": "master",
+	}
+	smHistory     = &smCollection{ActCounts: make(map[string]float64)}
+	smSectionExpr = regexp.MustCompile(`(?m)^\s*SM\s+-\s+(\w+)\s*$`)
+	smPortExpr    = regexp.MustCompile(`Port=(\d+)\s+lid=(\w+)\s+guid=(\w{18})\s+dev=\d+\s+priority:(\d+)`)
+)
+
+type SmInfoer interface {
+	ParseContent() (*[]Sm, error)
+	prometheus.Collector
+}
+
+// LinkSm reads the SM_INFO section of ibdiagnet2.db_csv and falls back to
+// ibdiagnet2.sm, which has no ActCount, when the section is missing.
+type LinkSm struct {
+	FilePath string
+	DbCsv    *util.DbCsv
+	// Created sets _created on infiniband_sm_master_changes_total.
+	Created bool
+}
+
+type Sm struct {
+	guid     string
+	name     string
+	lid      string
+	port     string
+	state    string
+	priority string
+	actCount string
+}
+
+// smCollection remembers the previous collection so that failovers and the
+// ActCount rate can be derived.
+type smCollection struct {
+	sync.Mutex `json:"-"`
+	loaded     bool
+	Masters    []string           `json:"masters"`
+	RunTime    time.Time          `json:"runTime"`
+	ActCounts  map[string]float64 `json:"actCounts"`
+	// MasterChanges counts the failovers seen since Created, the ibdiagnet
+	// run it was reset to 0 at by a fresh state.
+	MasterChanges float64   `json:"masterChanges"`
+	Created       time.Time `json:"created"`
+}
+
+func init() {
+	registerCollector("sm", func(c *CollectorContext) Collector {
+		return &LinkSm{FilePath: c.Path("sm"), DbCsv: c.GetDbCsv(), Created: c.Created}
+	})
+}
+
+func (s *LinkSm) ParseContent() (*[]Sm, error) {
+	rows, err := s.DbCsv.Section("SM_INFO")
+	if err != nil {
+		log.GetLogger().Info(fmt.Sprintf("SM_INFO unavailable, using %s: %s", s.FilePath, err))
+		return s.parseSmFile()
+	}
+	nodeNames := getNodeNames(s.DbCsv)
+	portLids := getPortLids(s.DbCsv)
+	var sms []Sm
+	for _, row := range *rows {
+		state, exists := smStateNames[row["SmState"]]
+		if !exists {
+			state = row["SmState"]
+		}
+		sms = append(sms, Sm{
+			guid:     row["PortGUID"],
+			name:     nodeNames[row["NodeGUID"]],
+			lid:      portLids[fmt.Sprintf("%s_%s", row["PortGUID"], row["PortNumber"])],
+			port:     row["PortNumber"],
+			state:    state,
+			priority: row["Priority"],
+			actCount: row["ActCount"],
+		})
+	}
+	return &sms, nil
+}
+
+func (s *LinkSm) parseSmFile() (*[]Sm, error) {
+	fileContent, err := util.ReadFileContent(s.FilePath)
+	if err != nil {
+		log.GetLogger().Error("Read sm file error")
+		return nil, err
+	}
+	var sms []Sm
+	sections := smSectionExpr.FindAllStringSubmatchIndex(fileContent, -1)
+	for i, section := range sections {
+		end := len(fileContent)
+		if i < len(sections)-1 {
+			end = sections[i+1][0]
+		}
+		state := fileContent[section[2]:section[3]]
+		for _, match := range smPortExpr.FindAllStringSubmatch(fileContent[section[1]:end], -1) {
+			sms = append(sms, Sm{
+				guid:     match[3],
+				lid:      hexToDecimal(match[2]),
+				port:     match[1],
+				state:    state,
+				priority: match[4],
+			})
+		}
+	}
+	return &sms, nil
+}
+
+func (s *LinkSm) Describe(ch chan<- *prometheus.Desc) {
+	describe(ch,
+		smInfoGauge,
+		smPriorityGauge,
+		smActCountGauge,
+		smActCountRateGauge,
+		smMasterCountGauge,
+		smNoMasterGauge,
+		smMultipleMastersGauge,
+		smMasterChangedGauge,
+		smMasterChangesCounter,
+	)
+}
+
+func (s *LinkSm) Collect(ch chan<- prometheus.Metric) {
+	metrics := newMetricSet()
+	defer metrics.collect(ch)
+	sms, err := s.ParseContent()
+	if err != nil {
+		log.GetLogger().Error("Parse sm content error")
+		return
+	}
+	runTime, err := GetRunTime(s.DbCsv)
+	if err != nil {
+		runTime = time.Now()
+	}
+	var masters []string
+	actCounts := make(map[string]float64)
+	smHistory.Lock()
+	defer smHistory.Unlock()
+	if !smHistory.loaded {
+		if err := store.GetSection("sm", smHistory); err != nil {
+			log.GetLogger().Error(fmt.Sprintf("Load sm history error: %s", err))
+		}
+		smHistory.loaded = true
+	}
+	for _, sm := range *sms {
+		var value float64
+		if sm.state == "master" {
+			value = 1
+			masters = append(masters, sm.guid)
+		}
+		metrics.set(smInfoGauge, value, sm.guid, sm.name, sm.lid, sm.port, sm.state)
+		if priority, err := strconv.ParseFloat(sm.priority, 64); err == nil {
+			metrics.set(smPriorityGauge, priority, sm.guid, sm.name)
+		}
+		actCount, err := strconv.ParseFloat(sm.actCount, 64)
+		if err != nil {
+			continue
+		}
+		actCounts[sm.guid] = actCount
+		metrics.set(smActCountGauge, actCount, sm.guid, sm.name)
+		previous, exists := smHistory.ActCounts[sm.guid]
+		elapsed := runTime.Sub(smHistory.RunTime).Seconds()
+		if exists && elapsed > 0 && actCount >= previous {
+			metrics.set(smActCountRateGauge, (actCount-previous)/elapsed, sm.guid, sm.name)
+		}
+	}
+	metrics.set(smMasterCountGauge, float64(len(masters)))
+	metrics.set(smNoMasterGauge, boolToFloat(len(masters) == 0))
+	metrics.set(smMultipleMastersGauge, boolToFloat(len(masters) > 1))
+	changed := smHistory.Masters != nil && len(masters) > 0 &&
+		len(util.DifferenceSlice(masters, smHistory.Masters)) > 0
+	metrics.set(smMasterChangedGauge, boolToFloat(changed))
+	if changed {
+		smHistory.MasterChanges++
+		log.GetLogger().Info(fmt.Sprintf("Master SM changed from %v to %v", smHistory.Masters, masters))
+	}
+	if smHistory.Created.IsZero() {
+		smHistory.Created = runTime
+	}
+	if s.Created {
+		metrics.setCounterCreated(smMasterChangesCounter, smHistory.MasterChanges, smHistory.Created)
+	} else {
+		metrics.setCounter(smMasterChangesCounter, smHistory.MasterChanges)
+	}
+	if len(masters) > 0 {
+		smHistory.Masters = masters
+	}
+	if runTime.After(smHistory.RunTime) {
+		smHistory.RunTime = runTime
+		smHistory.ActCounts = actCounts
+	}
+	if err := store.SetSection("sm", smHistory); err != nil {
+		log.GetLogger().Error(fmt.Sprintf("Store sm history error: %s", err))
+	}
+}
+
+// getNodeNames maps node GUIDs to their NodeDesc from the NODES section.
+func getNodeNames(dbCsv *util.DbCsv) map[string]string {
+	nodeNames := make(map[string]string)
+	rows, err := dbCsv.Section("NODES")
+	if err != nil {
+		return nodeNames
+	}
+	for _, row := range *rows {
+		nodeNames[row["NodeGUID"]] = row["NodeDesc"]
+	}
+	return nodeNames
+}
+
+// getPortLids maps <portGuid>_<portNum> to the port LID from the PORTS section.
+func getPortLids(dbCsv *util.DbCsv) map[string]string {
+	portLids := make(map[string]string)
+	rows, err := dbCsv.Section("PORTS")
+	if err != nil {
+		return portLids
+	}
+	for _, row := range *rows {
+		portLids[fmt.Sprintf("%s_%s", row["PortGuid"], row["PortNum"])] = row["LID"]
+	}
+	return portLids
+}
+
+// GetRunTime returns the time ibdiagnet was run, from the RUN_INFO section.
+func GetRunTime(dbCsv *util.DbCsv) (time.Time, error) {
+	rows, err := dbCsv.Section("RUN_INFO")
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(*rows) == 0 {
+		return time.Time{}, fmt.Errorf("empty RUN_INFO in %s", dbCsv.Path())
+	}
+	return time.Parse("2006-01-02 15:04:05 MST -0700", (*rows)[0]["Date"])
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
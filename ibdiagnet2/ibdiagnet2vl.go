@@ -0,0 +1,270 @@
+package ibdiagnet2
+
+import (
+	"fmt"
+	"infiniband_exporter/log"
+	"infiniband_exporter/store"
+	"infiniband_exporter/util"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	vlLabels        = append(util.GetFieldNames(Pm{}), "vl")
+	slLabels        = append(util.GetFieldNames(Pm{}), "sl")
+	sampleTickGauge = prometheus.NewDesc(
+		"infiniband_port_sample_tick",
+		"PortSamplesControl Tick as reported, the encoded PortXmitWait tick period",
+		pmLabels,
+		nil,
+	)
+	xmitWaitDeltaGauge = prometheus.NewDesc(
+		"infiniband_port_xmit_wait_delta",
+		"Ticks the port waited to transmit between the two last ibdiagnet runs, vl=all for the whole port",
+		vlLabels,
+		nil,
+	)
+	xmitWaitIntervalGauge = prometheus.NewDesc(
+		"infiniband_port_xmit_wait_interval_seconds",
+		"Seconds between the two last ibdiagnet runs infiniband_port_xmit_wait_delta spans",
+		nil,
+		nil,
+	)
+	vlCounterGauges = make(map[string]*prometheus.Desc)
+	vlCounterLock   sync.Mutex
+	vlHistory       = &vlCollection{XmitWaits: make(map[string]float64)}
+
+	pmHeaderExpr = regexp.MustCompile(`Port=(\d+)\sLid=(\w+)\sGUID=(\w{18})\sDevice=(\d+)\sPort\sName=(.*)`)
+	// csvLaneExpr matches name[index] in db_csv columns and pm counter names.
+	csvLaneExpr     = regexp.MustCompile(`^(\w+)\[(\d+)\]$`)
+	vlXmitWaitNames = []string{"port_vl_xmit_wait", "port_vl_xmit_wait_counters"}
+)
+
+type Vler interface {
+	ParseContent() (*[]VlCounter, error)
+	prometheus.Collector
+}
+
+// LinkVl exports per virtual lane and per service level counters, found as
+// name[index]=value lines in ibdiagnet2.pm or name[index] columns in
+// ibdiagnet2.db_csv when ibdiagnet runs with the per-VL counter options. The
+// PortXmitWait ticks counted between two runs are exported with the interval
+// they span and the raw sample Tick, the tick period being encoded, so that
+// the share of time waited is left to queries.
+type LinkVl struct {
+	FilePath string
+	DbCsv    *util.DbCsv
+}
+
+type VlCounter struct {
+	guid string
+	port string
+	name string
+	// counter is the metric name suffix, e.g. port_vl_xmit_wait, and lane
+	// the VL or SL index, or "all" for the port wide counter.
+	counter string
+	lane    string
+	value   float64
+}
+
+// vlCollection remembers the previous xmit wait counters so that their delta
+// can be derived.
+type vlCollection struct {
+	sync.Mutex `json:"-"`
+	loaded     bool
+	RunTime    time.Time          `json:"runTime"`
+	XmitWaits  map[string]float64 `json:"xmitWaits"`
+}
+
+func init() {
+	registerCollector("vl", func(c *CollectorContext) Collector {
+		return &LinkVl{FilePath: c.Path("pm"), DbCsv: c.GetDbCsv()}
+	})
+}
+
+func (v *LinkVl) ParseContent() (*[]VlCounter, error) {
+	var vlCounters []VlCounter
+	var hasLanes bool
+	err := ScanPmFile(v.FilePath, func(port *PmPort) {
+		for _, name := range port.Names {
+			match := csvLaneExpr.FindStringSubmatch(name)
+			if match == nil {
+				continue
+			}
+			if value := parseCounter(port.Counters[name]); value != nil {
+				hasLanes = true
+				vlCounters = append(vlCounters, VlCounter{
+					guid:    port.Guid,
+					port:    port.Port,
+					name:    port.Name,
+					counter: match[1],
+					lane:    match[2],
+					value:   *value,
+				})
+			}
+		}
+		if counter, exists := port.Counters["port_xmit_wait_extended"]; exists {
+			if value := parseCounter(counter); value != nil {
+				vlCounters = append(vlCounters, VlCounter{
+					guid:    port.Guid,
+					port:    port.Port,
+					name:    port.Name,
+					counter: "port_xmit_wait_extended",
+					lane:    "all",
+					value:   *value,
+				})
+			}
+		}
+	})
+	if err != nil {
+		log.GetLogger().Error("Get pm content error")
+		return nil, err
+	}
+	if hasLanes {
+		return &vlCounters, nil
+	}
+	// Fall back to db_csv sections carrying name[index] columns.
+	for _, section := range []string{"PM_PORT_VL_XMIT_WAIT_COUNTERS", "PM_PORT_XMIT_DATA_SL", "PM_PORT_RCV_DATA_SL"} {
+		rows, err := v.DbCsv.Section(section)
+		if err != nil {
+			continue
+		}
+		for _, row := range *rows {
+			for column, cell := range row {
+				match := csvLaneExpr.FindStringSubmatch(column)
+				if match == nil {
+					continue
+				}
+				if value := parseCounter(cell); value != nil {
+					vlCounters = append(vlCounters, VlCounter{
+						guid:    row["NodeGUID"],
+						port:    row["PortNumber"],
+						counter: util.CamelToSnake(match[1]),
+						lane:    match[2],
+						value:   *value,
+					})
+				}
+			}
+		}
+	}
+	return &vlCounters, nil
+}
+
+// Describe sends nothing: the per lane counters are only known once the
+// files are read, which makes LinkVl an unchecked collector.
+func (v *LinkVl) Describe(ch chan<- *prometheus.Desc) {
+}
+
+func (v *LinkVl) Collect(ch chan<- prometheus.Metric) {
+	metrics := newMetricSet()
+	defer metrics.collect(ch)
+	vlCounters, err := v.ParseContent()
+	if err != nil {
+		log.GetLogger().Error("Parse vl content error")
+		return
+	}
+	nodeNames := getNodeNames(v.DbCsv)
+	if rows, err := v.DbCsv.Section("PM_PORT_SAMPLES_CONTROL"); err == nil {
+		for _, row := range *rows {
+			tick := parseCounter(row["Tick"])
+			if tick == nil {
+				continue
+			}
+			pm := getPm(row["NodeGUID"], row["PortNumber"], nodeNames[row["NodeGUID"]])
+			metrics.set(sampleTickGauge, *tick, pm.remoteGuid, pm.remoteName, pm.remotePort, pm.component, pm.localGuid, pm.localName, pm.localPort)
+		}
+	}
+	runTime, err := GetRunTime(v.DbCsv)
+	if err != nil {
+		runTime = time.Now()
+	}
+	vlHistory.Lock()
+	defer vlHistory.Unlock()
+	if !vlHistory.loaded {
+		if err := store.GetSection("vl", vlHistory); err != nil {
+			log.GetLogger().Error(fmt.Sprintf("Load vl history error: %s", err))
+		}
+		vlHistory.loaded = true
+	}
+	elapsed := runTime.Sub(vlHistory.RunTime).Seconds()
+	var hasDelta bool
+	xmitWaits := make(map[string]float64)
+	for _, vlCounter := range *vlCounters {
+		name := vlCounter.name
+		if name == "" {
+			name = nodeNames[vlCounter.guid]
+		}
+		pm := getPm(vlCounter.guid, vlCounter.port, name)
+		labelValues := []string{
+			pm.remoteGuid, pm.remoteName, pm.remotePort, pm.component, pm.localGuid, pm.localName, pm.localPort,
+			vlCounter.lane,
+		}
+		if vlCounter.lane != "all" {
+			if gauge := getVlCounterGauge(vlCounter.counter); gauge != nil {
+				metrics.set(gauge, vlCounter.value, labelValues...)
+			}
+		}
+		if vlCounter.lane != "all" && !isVlXmitWait(vlCounter.counter) {
+			continue
+		}
+		key := fmt.Sprintf("%s_%s_%s", vlCounter.guid, vlCounter.port, vlCounter.lane)
+		xmitWaits[key] = vlCounter.value
+		previous, seen := vlHistory.XmitWaits[key]
+		if !seen || elapsed <= 0 || vlCounter.value < previous {
+			continue
+		}
+		hasDelta = true
+		metrics.set(xmitWaitDeltaGauge, vlCounter.value-previous, labelValues...)
+	}
+	if hasDelta {
+		metrics.set(xmitWaitIntervalGauge, elapsed)
+	}
+	if runTime.After(vlHistory.RunTime) {
+		vlHistory.RunTime = runTime
+		vlHistory.XmitWaits = xmitWaits
+		if err := store.SetSection("vl", vlHistory); err != nil {
+			log.GetLogger().Error(fmt.Sprintf("Store vl history error: %s", err))
+		}
+	}
+}
+
+// getVlCounterGauge returns the gauge for a per lane counter, creating it the
+// first time the counter shows up, or nil if the name clashes with another
+// metric.
+func getVlCounterGauge(counter string) *prometheus.Desc {
+	vlCounterLock.Lock()
+	defer vlCounterLock.Unlock()
+	gauge, exists := vlCounterGauges[counter]
+	if !exists {
+		labels := vlLabels
+		if strings.HasSuffix(counter, "_sl") {
+			labels = slLabels
+		}
+		gauge = prometheus.NewDesc(
+			fmt.Sprintf("infiniband_%s", counter),
+			counter,
+			labels,
+			nil,
+		)
+		if slices.Contains(PmCounterNames(), counter) || slices.Contains(append(rnCounters, hbfCounters...), counter) {
+			log.GetLogger().Error(fmt.Sprintf("Per lane counter %s clashes with another metric", counter))
+			gauge = nil
+		}
+		vlCounterGauges[counter] = gauge
+	}
+	return gauge
+}
+
+func isVlXmitWait(counter string) bool {
+	for _, name := range vlXmitWaitNames {
+		if strings.EqualFold(counter, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package ibdiagnet2
+
+import (
+	"infiniband_exporter/util"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// writeVlRun writes the ibdiagnet2.pm and ibdiagnet2.db_csv of a run at date
+// where the port waited xmitWait ticks, vl0Wait of them on VL 0.
+func writeVlRun(t *testing.T, date string, xmitWait string, vl0Wait string) *LinkVl {
+	t.Helper()
+	dir := t.TempDir()
+	pm := pmPortHeader + "port_xmit_wait_extended=" + xmitWait + "\nport_vl_xmit_wait[0]=" + vl0Wait + "\n"
+	dbCsv := "START_RUN_INFO\nDate\n\"" + date + "\"\nEND_RUN_INFO\n" +
+		"START_PM_PORT_SAMPLES_CONTROL\nNodeGUID,PortGUID,PortNumber,Tick\n" +
+		"0xb0cf0e0300d33fc0,0xb0cf0e0300d33fc0,1,0x07\nEND_PM_PORT_SAMPLES_CONTROL\n"
+	for name, content := range map[string]string{"ibdiagnet2.pm": pm, "ibdiagnet2.db_csv": dbCsv} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &LinkVl{FilePath: filepath.Join(dir, "ibdiagnet2.pm"), DbCsv: util.NewDbCsv(filepath.Join(dir, "ibdiagnet2.db_csv"))}
+}
+
+// gatherVl returns the values collected by v keyed by metric name and lane.
+func gatherVl(t *testing.T, v *LinkVl) map[string]float64 {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(v)
+	metricFamilies, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	for _, metricFamily := range metricFamilies {
+		for _, metric := range metricFamily.Metric {
+			key := metricFamily.GetName()
+			for _, label := range metric.Label {
+				if label.GetName() == "vl" {
+					key += "_" + label.GetValue()
+				}
+			}
+			values[key] = metric.GetGauge().GetValue()
+		}
+	}
+	return values
+}
+
+// TestLinkVlXmitWaitDelta checks that the xmit wait ticks counted between two
+// runs are exported with the interval they span and the raw sample Tick.
+func TestLinkVlXmitWaitDelta(t *testing.T) {
+	vlHistory = &vlCollection{XmitWaits: make(map[string]float64)}
+	t.Cleanup(func() {
+		vlHistory = &vlCollection{XmitWaits: make(map[string]float64)}
+	})
+	for _, run := range []struct {
+		name   string
+		date   string
+		wait   string
+		vl0    string
+		values map[string]float64
+	}{
+		{
+			"first run",
+			"2025-03-31 23:43:18 UTC +0000", "0x100", "0x10",
+			map[string]float64{"infiniband_port_sample_tick": 7, "infiniband_port_vl_xmit_wait_0": 16},
+		},
+		{
+			"a minute later",
+			"2025-03-31 23:44:18 UTC +0000", "0x400", "0x40",
+			map[string]float64{
+				"infiniband_port_sample_tick":                7,
+				"infiniband_port_vl_xmit_wait_0":             64,
+				"infiniband_port_xmit_wait_delta_all":        768,
+				"infiniband_port_xmit_wait_delta_0":          48,
+				"infiniband_port_xmit_wait_interval_seconds": 60,
+			},
+		},
+		{
+			"counters reset",
+			"2025-03-31 23:45:18 UTC +0000", "0x200", "0x20",
+			map[string]float64{"infiniband_port_sample_tick": 7, "infiniband_port_vl_xmit_wait_0": 32},
+		},
+		{
+			"older run replayed",
+			"2025-03-31 23:40:18 UTC +0000", "0x800", "0x80",
+			map[string]float64{"infiniband_port_sample_tick": 7, "infiniband_port_vl_xmit_wait_0": 128},
+		},
+	} {
+		if values := gatherVl(t, writeVlRun(t, run.date, run.wait, run.vl0)); !reflect.DeepEqual(values, run.values) {
+			t.Errorf("%s: values %v, expected %v", run.name, values, run.values)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package ibdiagnet2
+
+import (
+	"fmt"
+	"infiniband_exporter/log"
+	"infiniband_exporter/util"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	vportLabels     = util.GetFieldNames(VPort{})
+	vportCountGauge = prometheus.NewDesc(
+		"infiniband_vport_count",
+		"Number of virtual ports per physical port and state",
+		[]string{"guid", "port", "localName", "state"},
+		nil,
+	)
+	vportInfoGauge = prometheus.NewDesc(
+		"infiniband_vport_info",
+		"Gauge infiniband virtual port info, 1 for ACT",
+		vportLabels,
+		nil,
+	)
+	vportPkeyViolationsGauge = prometheus.NewDesc(
+		"infiniband_vport_pkey_violations",
+		"vport_pkey_violations",
+		[]string{"vportGuid", "localName"},
+		nil,
+	)
+	vportQkeyViolationsGauge = prometheus.NewDesc(
+		"infiniband_vport_qkey_violations",
+		"vport_qkey_violations",
+		[]string{"vportGuid", "localName"},
+		nil,
+	)
+	vportPkeyGauge = prometheus.NewDesc(
+		"infiniband_vport_pkey_info",
+		"Gauge infiniband virtual port partition membership info",
+		[]string{"vportGuid", "localName", "pkey", "membership"},
+		nil,
+	)
+
+	vportPkeyGroupExpr  = regexp.MustCompile(`(?m)^GROUP\s+VPKey:(\w+)\s+Virtual\s+Ports:(\d+)`)
+	vportPkeyMemberExpr = regexp.MustCompile(`(?m)^\s+(Full|Limited)\s+(\S+)\s+guid=(\w{18})`)
+
+	portStateNames = map[string]string{
+		"1": "DOWN",
+		"2": "INIT",
+		"3": "ARM",
+		"4": "ACT",
+	}
+)
+
+type VPorter interface {
+	ParseContent() (*[]VPort, error)
+	prometheus.Collector
+}
+
+// LinkVPorts exports the SR-IOV virtual ports found in the VNODES and VPORTS
+// sections of ibdiagnet2.db_csv, and their partitions from
+// ibdiagnet2.vports_pkey.
+type LinkVPorts struct {
+	FilePath string
+	DbCsv    *util.DbCsv
+}
+
+type VPort struct {
+	guid       string
+	port       string
+	localName  string
+	vportIndex string
+	vportGuid  string
+	vportLid   string
+	vnodeDesc  string
+	state      string
+}
+
+func init() {
+	registerCollector("vports", func(c *CollectorContext) Collector {
+		return &LinkVPorts{FilePath: c.Path("vports_pkey"), DbCsv: c.GetDbCsv()}
+	})
+}
+
+func (v *LinkVPorts) ParseContent() (*[]VPort, error) {
+	rows, err := v.DbCsv.Section("VPORTS")
+	if err != nil {
+		log.GetLogger().Error("Get vports content error")
+		return nil, err
+	}
+	vnodeDescs := make(map[string]string)
+	vnodes, err := v.DbCsv.Section("VNODES")
+	if err == nil {
+		for _, row := range *vnodes {
+			vnodeDescs[fmt.Sprintf("%s_%s", row["PortGUID"], row["VPortIndex"])] = row["VNodeDesc"]
+		}
+	}
+	nodeNames := getNodeNames(v.DbCsv)
+	var vports []VPort
+	for _, row := range *rows {
+		state, exists := portStateNames[row["VPortState"]]
+		if !exists {
+			state = row["VPortState"]
+		}
+		vports = append(vports, VPort{
+			guid:       row["PortGUID"],
+			port:       row["PortNum"],
+			localName:  getHostName(nodeNames[row["NodeGuid"]]),
+			vportIndex: row["VPortIndex"],
+			vportGuid:  row["VPortGuid"],
+			vportLid:   row["VPortLid"],
+			vnodeDesc:  vnodeDescs[fmt.Sprintf("%s_%s", row["PortGUID"], row["VPortIndex"])],
+			state:      state,
+		})
+	}
+	return &vports, nil
+}
+
+func (v *LinkVPorts) Describe(ch chan<- *prometheus.Desc) {
+	describe(ch,
+		vportCountGauge,
+		vportInfoGauge,
+		vportPkeyViolationsGauge,
+		vportQkeyViolationsGauge,
+		vportPkeyGauge,
+	)
+}
+
+func (v *LinkVPorts) Collect(ch chan<- prometheus.Metric) {
+	metrics := newMetricSet()
+	defer metrics.collect(ch)
+	vports, err := v.ParseContent()
+	if err != nil {
+		log.GetLogger().Error("Parse vports content error")
+		return
+	}
+	localNames := make(map[string]string)
+	for _, vport := range *vports {
+		localNames[vport.vportGuid] = vport.localName
+		metrics.inc(vportCountGauge, vport.guid, vport.port, vport.localName, vport.state)
+		var value float64
+		if vport.state == "ACT" {
+			value = 1
+		}
+		metrics.set(
+			vportInfoGauge,
+			value,
+			vport.guid,
+			vport.port,
+			vport.localName,
+			vport.vportIndex,
+			vport.vportGuid,
+			vport.vportLid,
+			vport.vnodeDesc,
+			vport.state,
+		)
+	}
+	rows, err := v.DbCsv.Section("VPORTS")
+	if err == nil {
+		for _, row := range *rows {
+			localName := localNames[row["VPortGuid"]]
+			if value, err := strconv.ParseFloat(row["PKEYViolations"], 64); err == nil {
+				metrics.set(vportPkeyViolationsGauge, value, row["VPortGuid"], localName)
+			}
+			if value, err := strconv.ParseFloat(row["QKEYViolations"], 64); err == nil {
+				metrics.set(vportQkeyViolationsGauge, value, row["VPortGuid"], localName)
+			}
+		}
+	}
+	pkeys, err := v.parseVPortPkeyFile()
+	if err != nil {
+		log.GetLogger().Error("Parse vports pkey content error")
+		return
+	}
+	for _, pkey := range *pkeys {
+		metrics.set(vportPkeyGauge, 1, pkey.guid, localNames[pkey.guid], pkey.pkey, pkey.membership)
+	}
+}
+
+// parseVPortPkeyFile reads ibdiagnet2.vports_pkey, which groups the virtual
+// ports by partition as "GROUP VPKey:0x7fff Virtual Ports:248" followed by
+// members such as "Full h4-10-gpu/U3/B184D0F0/0/0/1/VP0 guid=0x5c25730300c09c80".
+func (v *LinkVPorts) parseVPortPkeyFile() (*[]Pkey, error) {
+	fileContent, err := util.ReadFileContent(v.FilePath)
+	if err != nil {
+		log.GetLogger().Error("Read vports pkey file error")
+		return nil, err
+	}
+	var pkeys []Pkey
+	groups := vportPkeyGroupExpr.FindAllStringSubmatchIndex(fileContent, -1)
+	for i, group := range groups {
+		end := len(fileContent)
+		if i < len(groups)-1 {
+			end = groups[i+1][0]
+		}
+		pkey := normalizePkey(fileContent[group[2]:group[3]])
+		for _, match := range vportPkeyMemberExpr.FindAllStringSubmatch(fileContent[group[1]:end], -1) {
+			pkeys = append(pkeys, Pkey{
+				guid:       match[3],
+				name:       match[2],
+				pkey:       pkey,
+				membership: strings.ToLower(match[1]),
+			})
+		}
+	}
+	return &pkeys, nil
+}
+
+// getHostName resolves a CA node description such as "is-north-7-compute-1
+// HCA-1" to the name used for NetDump.localName.
+func getHostName(nodeDesc string) string {
+	fields := strings.Fields(nodeDesc)
+	if len(fields) != 2 {
+		return nodeDesc
+	}
+	localName, _ := getLocalName(fields[0], fields[1])
+	return localName
+}
@@ -0,0 +1,55 @@
+package ibdiagnet2
+
+import (
+	"infiniband_exporter/util"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestLinkVPortsCollect checks the partitions of the virtual ports of the
+// sample run, all full members of the default partition.
+func TestLinkVPortsCollect(t *testing.T) {
+	dataDir := filepath.Join(testDataDir, "infiniband-default")
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(&LinkVPorts{
+		FilePath: filepath.Join(dataDir, "ibdiagnet2.vports_pkey"),
+		DbCsv:    util.NewDbCsv(filepath.Join(dataDir, "ibdiagnet2.db_csv")),
+	})
+	metricFamilies, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	localNames := make(map[string]string)
+	pkeys := make(map[string]map[string]string)
+	for _, metricFamily := range metricFamilies {
+		for _, metric := range metricFamily.Metric {
+			labels := make(map[string]string)
+			for _, label := range metric.Label {
+				labels[label.GetName()] = label.GetValue()
+			}
+			switch metricFamily.GetName() {
+			case "infiniband_vport_info":
+				localNames[labels["vportGuid"]] = labels["localName"]
+			case "infiniband_vport_pkey_info":
+				pkeys[labels["vportGuid"]] = labels
+			}
+		}
+	}
+	if len(localNames) != 248 || len(pkeys) != 248 {
+		t.Fatalf("%d infiniband_vport_info and %d infiniband_vport_pkey_info, expected 248 of each", len(localNames), len(pkeys))
+	}
+	for vportGuid, labels := range pkeys {
+		if labels["pkey"] != "0x7fff" || labels["membership"] != "full" {
+			t.Errorf("%s: pkey %s %s, expected 0x7fff full", vportGuid, labels["pkey"], labels["membership"])
+		}
+		localName, exists := localNames[vportGuid]
+		if !exists || labels["localName"] != localName {
+			t.Errorf("%s: localName %q, expected %q", vportGuid, labels["localName"], localName)
+		}
+	}
+	if labels := pkeys["0x5c25730300c09c80"]; labels == nil || labels["localName"] == "" {
+		t.Errorf("0x5c25730300c09c80: unexpected labels %v", labels)
+	}
+}
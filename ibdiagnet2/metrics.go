@@ -0,0 +1,93 @@
+package ibdiagnet2
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type sampleKey struct {
+	desc   *prometheus.Desc
+	labels string
+}
+
+type sample struct {
+	desc        *prometheus.Desc
+	valueType   prometheus.ValueType
+	value       float64
+	labelValues []string
+	// created is the start of a counter, exposed as _created when set.
+	created time.Time
+}
+
+// metricSet gathers the samples of one Collect call. As GaugeVec.Set did, a
+// sample replaces an earlier one with the same labels, so that the registry
+// never sees the same series twice.
+type metricSet struct {
+	index   map[sampleKey]int
+	samples []sample
+}
+
+func newMetricSet() *metricSet {
+	return &metricSet{index: make(map[sampleKey]int)}
+}
+
+// put adds or updates a sample and returns its index in samples.
+func (m *metricSet) put(desc *prometheus.Desc, valueType prometheus.ValueType, value float64, add bool, labelValues []string) int {
+	key := sampleKey{desc, strings.Join(labelValues, "\xff")}
+	if i, exists := m.index[key]; exists {
+		if add {
+			value += m.samples[i].value
+		}
+		m.samples[i].value = value
+		return i
+	}
+	m.index[key] = len(m.samples)
+	m.samples = append(m.samples, sample{desc: desc, valueType: valueType, value: value, labelValues: labelValues})
+	return len(m.samples) - 1
+}
+
+// set sets a gauge.
+func (m *metricSet) set(desc *prometheus.Desc, value float64, labelValues ...string) {
+	m.put(desc, prometheus.GaugeValue, value, false, labelValues)
+}
+
+// inc adds one to a gauge.
+func (m *metricSet) inc(desc *prometheus.Desc, labelValues ...string) {
+	m.put(desc, prometheus.GaugeValue, 1, true, labelValues)
+}
+
+// setCounter sets a counter.
+func (m *metricSet) setCounter(desc *prometheus.Desc, value float64, labelValues ...string) {
+	m.put(desc, prometheus.CounterValue, value, false, labelValues)
+}
+
+// setCounterCreated sets a counter along with the time it started from 0.
+func (m *metricSet) setCounterCreated(desc *prometheus.Desc, value float64, created time.Time, labelValues ...string) {
+	i := m.put(desc, prometheus.CounterValue, value, false, labelValues)
+	m.samples[i].created = created
+}
+
+// incCounter adds one to a counter.
+func (m *metricSet) incCounter(desc *prometheus.Desc, labelValues ...string) {
+	m.put(desc, prometheus.CounterValue, 1, true, labelValues)
+}
+
+// collect sends the samples as const metrics, in the order they were first set.
+func (m *metricSet) collect(ch chan<- prometheus.Metric) {
+	for _, s := range m.samples {
+		if !s.created.IsZero() {
+			ch <- prometheus.MustNewConstMetricWithCreatedTimestamp(s.desc, s.valueType, s.value, s.created, s.labelValues...)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(s.desc, s.valueType, s.value, s.labelValues...)
+	}
+}
+
+// describe sends every desc.
+func describe(ch chan<- *prometheus.Desc, descs ...*prometheus.Desc) {
+	for _, desc := range descs {
+		ch <- desc
+	}
+}
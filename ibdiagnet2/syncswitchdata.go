@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"infiniband_exporter/config"
 	"infiniband_exporter/log"
 	"io"
 	"net/http"
@@ -26,15 +27,9 @@ import (
 type SyncData interface {
 	SyncSwitchData() (bool, error)
 }
-type SyncSwitchData struct {
-	IpAddress     string `yaml:"ipAddress"`
-	User          string `yaml:"user"`
-	Password      string `yaml:"password"`
-	HostUser      string `yaml:"hostUser"`
-	HostPassword  string `yaml:"hostPassword"`
-	HostIpAddress string `yaml:"hostIpAddress"`
-	HostFilePath  string `yaml:"hostFilePath"`
-}
+
+// SyncSwitchData is the syncDataConfig section of default.yaml.
+type SyncSwitchData config.SyncData
 
 type SyncResponse struct {
 	Results []SyncResult `json:"results"`
@@ -3,6 +3,7 @@ package log
 import (
 	"os"
 	"sync"
+	"sync/atomic"
 
 	"github.com/natefinch/lumberjack"
 	"go.uber.org/zap"
@@ -10,8 +11,9 @@ import (
 )
 
 var (
-	singleton *zap.Logger
-	once      sync.Once
+	singleton  *zap.Logger
+	once       sync.Once
+	errorCount atomic.Int64
 )
 
 func InitLogger(logFile string) error {
@@ -22,6 +24,37 @@ func InitLogger(logFile string) error {
 	return err
 }
 
+// InitCliLogger logs warnings and errors to stderr only, leaving stdout to
+// the output of the subcommands, and counts the errors, see ErrorCount.
+func InitCliLogger() error {
+	once.Do(func() {
+		config := zap.NewProductionEncoderConfig()
+		config.TimeKey = "timestamp"
+		config.EncodeTime = zapcore.ISO8601TimeEncoder
+		core := zapcore.NewCore(zapcore.NewJSONEncoder(config), zapcore.AddSync(os.Stderr), zap.WarnLevel)
+		singleton = zap.New(core, zap.AddCaller(), zap.Hooks(func(entry zapcore.Entry) error {
+			if entry.Level >= zap.ErrorLevel {
+				errorCount.Add(1)
+			}
+			return nil
+		}))
+	})
+	return nil
+}
+
+// InitNopLogger discards every log entry, so that logging does not weigh on
+// the timings of the benchmarks.
+func InitNopLogger() {
+	once.Do(func() {
+		singleton = zap.NewNop()
+	})
+}
+
+// ErrorCount returns the number of errors logged since InitCliLogger.
+func ErrorCount() int64 {
+	return errorCount.Load()
+}
+
 func GetLogger() *zap.Logger {
 	if singleton == nil {
 		panic("logger is not initialized")
@@ -0,0 +1,102 @@
+package push
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// influxEscaper escapes the measurements, tag keys and tag values of the
+// line protocol. A backslash is doubled, one ending a tag value would escape
+// the comma after it.
+var influxEscaper = strings.NewReplacer(`\`, `\\`, ",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+
+// InfluxSink writes snapshots as InfluxDB line protocol, one point per
+// sample measured by the metric name, its labels as tags and a single value
+// field, to the HTTP write endpoint URL, e.g.
+// http://influxdb:8086/api/v2/write?org=hpc&bucket=fabric, to File or to
+// both.
+type InfluxSink struct {
+	URL string
+	// Token is sent as an InfluxDB v2 API token when set.
+	Token   string
+	Timeout time.Duration
+	File    string
+	// Labels are added as tags to every point, e.g. fabric.
+	Labels map[string]string
+}
+
+// Send writes metricFamilies, stamped with now when they carry no
+// timestamp. Samples that are not finite, which InfluxDB refuses, are left
+// out.
+func (s *InfluxSink) Send(metricFamilies []*dto.MetricFamily, now time.Time) error {
+	payload := EncodeLineProtocol(metricFamilies, s.Labels, now)
+	if s.File != "" {
+		if err := appendFile(s.File, payload); err != nil {
+			return err
+		}
+	}
+	if s.URL == "" {
+		return nil
+	}
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("User-Agent", "infiniband-exporter")
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Token "+s.Token)
+	}
+	client := &http.Client{Timeout: s.Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("influx returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// EncodeLineProtocol encodes metricFamilies as line protocol with nanosecond
+// timestamps, adding labels to each point unless the metric has a label of
+// the same name. Empty labels are left out, the line protocol has no empty
+// tag.
+func EncodeLineProtocol(metricFamilies []*dto.MetricFamily, labels map[string]string, now time.Time) []byte {
+	var buf bytes.Buffer
+	for _, series := range ToSeries(metricFamilies) {
+		if math.IsNaN(series.Value) || math.IsInf(series.Value, 0) {
+			continue
+		}
+		seriesLabels := withLabels(series.Labels, labels)
+		names := make([]string, 0, len(seriesLabels))
+		for name, value := range seriesLabels {
+			if value != "" {
+				names = append(names, name)
+			}
+		}
+		// InfluxDB expects the tags sorted by key.
+		sort.Strings(names)
+		buf.WriteString(influxEscaper.Replace(series.Name))
+		for _, name := range names {
+			fmt.Fprintf(&buf, ",%s=%s", influxEscaper.Replace(name), influxEscaper.Replace(seriesLabels[name]))
+		}
+		timestamp := now.UnixNano()
+		if series.TimestampMs != 0 {
+			timestamp = time.UnixMilli(series.TimestampMs).UnixNano()
+		}
+		fmt.Fprintf(&buf, " value=%s %d\n", strconv.FormatFloat(series.Value, 'g', -1, 64), timestamp)
+	}
+	return buf.Bytes()
+}
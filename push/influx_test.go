@@ -0,0 +1,119 @@
+package push
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+func gaugeFamily(name string, value float64, labels ...string) *dto.MetricFamily {
+	metric := &dto.Metric{Gauge: &dto.Gauge{Value: proto.Float64(value)}}
+	for i := 0; i+1 < len(labels); i += 2 {
+		metric.Label = append(metric.Label, &dto.LabelPair{Name: proto.String(labels[i]), Value: proto.String(labels[i+1])})
+	}
+	return &dto.MetricFamily{Name: proto.String(name), Type: dto.MetricType_GAUGE.Enum(), Metric: []*dto.Metric{metric}}
+}
+
+func TestEncodeLineProtocol(t *testing.T) {
+	now := time.Unix(1743469200, 0)
+	for _, test := range []struct {
+		name   string
+		family *dto.MetricFamily
+		labels map[string]string
+		line   string
+	}{
+		{
+			"tags sorted",
+			gaugeFamily("infiniband_link_info", 1, "remotePort", "1", "remoteName", "SPAN01"),
+			nil,
+			"infiniband_link_info,remoteName=SPAN01,remotePort=1 value=1 1743469200000000000\n",
+		},
+		{
+			"space comma and equals",
+			gaugeFamily("infiniband_node_info", 1, "name", "node01 HCA-1,a=b"),
+			nil,
+			`infiniband_node_info,name=node01\ HCA-1\,a\=b value=1 1743469200000000000` + "\n",
+		},
+		{
+			"backslash ending a value",
+			gaugeFamily("infiniband_node_info", 1, "a", `C:\`, "b", "x"),
+			nil,
+			`infiniband_node_info,a=C:\\,b=x value=1 1743469200000000000` + "\n",
+		},
+		{
+			"newline",
+			gaugeFamily("infiniband_node_info", 1, "name", "a\nb"),
+			nil,
+			`infiniband_node_info,name=a\nb value=1 1743469200000000000` + "\n",
+		},
+		{
+			"empty label left out",
+			gaugeFamily("infiniband_pm_link_down_counter", 2, "localGuid", "", "remoteGuid", "0xb0cf0e0300d33fc0"),
+			nil,
+			"infiniband_pm_link_down_counter,remoteGuid=0xb0cf0e0300d33fc0 value=2 1743469200000000000\n",
+		},
+		{
+			"labels added unless set",
+			gaugeFamily("infiniband_sm_master_count", 1, "fabric", "own"),
+			map[string]string{"fabric": "cherry", "site": "dc 1"},
+			`infiniband_sm_master_count,fabric=own,site=dc\ 1 value=1 1743469200000000000` + "\n",
+		},
+		{
+			"large value",
+			gaugeFamily("infiniband_pm_port_xmit_data_extended", 18446744073709551614),
+			nil,
+			"infiniband_pm_port_xmit_data_extended value=1.8446744073709552e+19 1743469200000000000\n",
+		},
+		{
+			"NaN left out",
+			gaugeFamily("infiniband_raw_ber", math.NaN()),
+			nil,
+			"",
+		},
+		{
+			"infinite left out",
+			gaugeFamily("infiniband_raw_ber", math.Inf(1)),
+			nil,
+			"",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if line := string(EncodeLineProtocol([]*dto.MetricFamily{test.family}, test.labels, now)); line != test.line {
+				t.Errorf("line\n%q, expected\n%q", line, test.line)
+			}
+		})
+	}
+}
+
+func TestEncodeLineProtocolTimestamp(t *testing.T) {
+	family := gaugeFamily("infiniband_sm_master_count", 1)
+	family.Metric[0].TimestampMs = proto.Int64(1743469200123)
+	expected := "infiniband_sm_master_count value=1 1743469200123000000\n"
+	if line := string(EncodeLineProtocol([]*dto.MetricFamily{family}, nil, time.Now())); line != expected {
+		t.Errorf("line %q, expected %q", line, expected)
+	}
+}
+
+func TestInfluxSinkFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fabric.lp")
+	sink := &InfluxSink{File: path}
+	now := time.Unix(1743469200, 0)
+	for i := 0; i < 2; i++ {
+		if err := sink.Send([]*dto.MetricFamily{gaugeFamily("infiniband_sm_master_count", 1)}, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := "infiniband_sm_master_count value=1 1743469200000000000\n"
+	if string(content) != line+line {
+		t.Errorf("file %q, expected every snapshot appended", content)
+	}
+}
@@ -0,0 +1,34 @@
+package push
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// JSONSink appends snapshots to File as newline delimited JSON, one Series
+// per line, or writes them to stdout when File is -.
+type JSONSink struct {
+	File string
+	// Labels are added to every series, e.g. fabric.
+	Labels map[string]string
+}
+
+// Send writes metricFamilies, stamped with now when they carry no
+// timestamp.
+func (s *JSONSink) Send(metricFamilies []*dto.MetricFamily, now time.Time) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, series := range ToSeries(metricFamilies) {
+		series.Labels = withLabels(series.Labels, s.Labels)
+		if series.TimestampMs == 0 {
+			series.TimestampMs = now.UnixMilli()
+		}
+		if err := encoder.Encode(series); err != nil {
+			return err
+		}
+	}
+	return appendFile(s.File, buf.Bytes())
+}
@@ -0,0 +1,203 @@
+package push
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	otlpHttpPath = "/v1/metrics"
+	otlpGrpcPath = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+	// aggregationTemporalityCumulative is AGGREGATION_TEMPORALITY_CUMULATIVE.
+	aggregationTemporalityCumulative = 2
+)
+
+// OtlpExporter sends snapshots to an OpenTelemetry collector as an
+// ExportMetricsServiceRequest, over OTLP/HTTP or OTLP/gRPC. Endpoint is the
+// collector base URL, e.g. http://otel-collector:4318 for HTTP or
+// http://otel-collector:4317 for gRPC, https for TLS.
+type OtlpExporter struct {
+	Endpoint string
+	// Protocol is http or grpc.
+	Protocol string
+	Timeout  time.Duration
+	// Resource holds the resource attributes, e.g. fabric and host.name.
+	Resource map[string]string
+	// Monotonic tells the gauges that only go up until reset, exported as
+	// monotonic sums along with the counters.
+	Monotonic func(name string) bool
+}
+
+// Send exports metricFamilies, stamped with now when they carry no
+// timestamp.
+func (e *OtlpExporter) Send(metricFamilies []*dto.MetricFamily, now time.Time) error {
+	request := EncodeOtlpRequest(metricFamilies, e.Resource, e.Monotonic, now)
+	endpoint, err := url.Parse(e.Endpoint)
+	if err != nil {
+		return err
+	}
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/")
+	if e.Protocol == "grpc" {
+		return e.exportGrpc(endpoint, request)
+	}
+	endpoint.Path += otlpHttpPath
+	client := &http.Client{Timeout: e.Timeout}
+	resp, err := client.Post(endpoint.String(), "application/x-protobuf", bytes.NewReader(request))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// exportGrpc makes the unary Export call over HTTP/2, cleartext for an http
+// endpoint.
+func (e *OtlpExporter) exportGrpc(endpoint *url.URL, request []byte) error {
+	var protocols http.Protocols
+	if endpoint.Scheme == "https" {
+		protocols.SetHTTP2(true)
+	} else {
+		protocols.SetUnencryptedHTTP2(true)
+	}
+	client := &http.Client{
+		Timeout:   e.Timeout,
+		Transport: &http.Transport{Protocols: &protocols},
+	}
+	endpoint.Path += otlpGrpcPath
+	// A gRPC message is prefixed by its compressed flag and length.
+	frame := make([]byte, 5, 5+len(request))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(request)))
+	frame = append(frame, request...)
+	req, err := http.NewRequest(http.MethodPost, endpoint.String(), bytes.NewReader(frame))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	req.Header.Set("User-Agent", "infiniband-exporter")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("otlp grpc returned http %d", resp.StatusCode)
+	}
+	// A trailers only response carries the status in the headers.
+	status, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if status != "0" {
+		return fmt.Errorf("otlp grpc returned status %s: %s", status, message)
+	}
+	return nil
+}
+
+// EncodeOtlpRequest encodes metricFamilies as an ExportMetricsServiceRequest
+// holding one ResourceMetrics. Counters, and the gauges monotonic tells, are
+// cumulative monotonic sums named without their _total suffix, the other
+// families gauges. Histograms and summaries are left out.
+func EncodeOtlpRequest(metricFamilies []*dto.MetricFamily, resource map[string]string, monotonic func(string) bool, now time.Time) []byte {
+	var resourceBuf []byte
+	for key, value := range resource {
+		resourceBuf = appendMessage(resourceBuf, 1, appendKeyValue(nil, key, value))
+	}
+	var scopeBuf []byte
+	scopeBuf = appendMessage(scopeBuf, 1, appendString(nil, 1, "infiniband_exporter"))
+	for _, metricFamily := range metricFamilies {
+		metricType := metricFamily.GetType()
+		if metricType != dto.MetricType_COUNTER && metricType != dto.MetricType_GAUGE && metricType != dto.MetricType_UNTYPED {
+			continue
+		}
+		name := metricFamily.GetName()
+		isSum := metricType == dto.MetricType_COUNTER || (monotonic != nil && monotonic(name))
+		var points []byte
+		for _, metric := range metricFamily.Metric {
+			var value float64
+			var start time.Time
+			switch {
+			case metric.Counter != nil:
+				value = metric.Counter.GetValue()
+				if created := metric.Counter.GetCreatedTimestamp(); created != nil {
+					start = created.AsTime()
+				}
+			case metric.Gauge != nil:
+				value = metric.Gauge.GetValue()
+			case metric.Untyped != nil:
+				value = metric.Untyped.GetValue()
+			}
+			timestamp := now
+			if metric.TimestampMs != nil {
+				timestamp = time.UnixMilli(metric.GetTimestampMs())
+			}
+			// NumberDataPoint
+			var point []byte
+			if !start.IsZero() {
+				point = protowire.AppendTag(point, 2, protowire.Fixed64Type)
+				point = protowire.AppendFixed64(point, uint64(start.UnixNano()))
+			}
+			point = protowire.AppendTag(point, 3, protowire.Fixed64Type)
+			point = protowire.AppendFixed64(point, uint64(timestamp.UnixNano()))
+			point = protowire.AppendTag(point, 4, protowire.Fixed64Type)
+			point = protowire.AppendFixed64(point, math.Float64bits(value))
+			for _, label := range metric.Label {
+				point = appendMessage(point, 7, appendKeyValue(nil, label.GetName(), label.GetValue()))
+			}
+			points = appendMessage(points, 1, point)
+		}
+		// Metric
+		var metricBuf []byte
+		if isSum {
+			metricBuf = appendString(metricBuf, 1, strings.TrimSuffix(name, "_total"))
+		} else {
+			metricBuf = appendString(metricBuf, 1, name)
+		}
+		metricBuf = appendString(metricBuf, 2, metricFamily.GetHelp())
+		if isSum {
+			points = protowire.AppendTag(points, 2, protowire.VarintType)
+			points = protowire.AppendVarint(points, aggregationTemporalityCumulative)
+			points = protowire.AppendTag(points, 3, protowire.VarintType)
+			points = protowire.AppendVarint(points, 1)
+			metricBuf = appendMessage(metricBuf, 7, points)
+		} else {
+			metricBuf = appendMessage(metricBuf, 5, points)
+		}
+		scopeBuf = appendMessage(scopeBuf, 2, metricBuf)
+	}
+	var resourceMetrics []byte
+	resourceMetrics = appendMessage(resourceMetrics, 1, resourceBuf)
+	resourceMetrics = appendMessage(resourceMetrics, 2, scopeBuf)
+	return appendMessage(nil, 1, resourceMetrics)
+}
+
+func appendMessage(buf []byte, number protowire.Number, message []byte) []byte {
+	buf = protowire.AppendTag(buf, number, protowire.BytesType)
+	return protowire.AppendBytes(buf, message)
+}
+
+func appendString(buf []byte, number protowire.Number, s string) []byte {
+	buf = protowire.AppendTag(buf, number, protowire.BytesType)
+	return protowire.AppendString(buf, s)
+}
+
+// appendKeyValue encodes a KeyValue holding a string AnyValue.
+func appendKeyValue(buf []byte, key string, value string) []byte {
+	buf = appendString(buf, 1, key)
+	return appendMessage(buf, 2, appendString(nil, 1, value))
+}
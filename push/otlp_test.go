@@ -0,0 +1,263 @@
+package push
+
+import (
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	collectormetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metrics "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var otlpResource = map[string]string{"fabric": "cherry", "host.name": "ufm01", "service.name": "infiniband_exporter"}
+
+func otlpMetricFamilies(created time.Time) []*dto.MetricFamily {
+	label := []*dto.LabelPair{{Name: proto.String("remoteGuid"), Value: proto.String("0xb0cf0e0300d33fc0")}}
+	return []*dto.MetricFamily{
+		{
+			Name: proto.String("infiniband_pm_port_xmit_data_extended_total"),
+			Help: proto.String("port_xmit_data_extended"),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{{
+				Label:   label,
+				Counter: &dto.Counter{Value: proto.Float64(1024), CreatedTimestamp: timestamppb.New(created)},
+			}},
+		},
+		{
+			Name:   proto.String("infiniband_link_down_counter"),
+			Type:   dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{Label: label, Gauge: &dto.Gauge{Value: proto.Float64(3)}}},
+		},
+		{
+			Name: proto.String("infiniband_sm_master_count"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{
+				Gauge:       &dto.Gauge{Value: proto.Float64(1)},
+				TimestampMs: proto.Int64(created.Add(time.Hour).UnixMilli()),
+			}},
+		},
+		{
+			Name:   proto.String("infiniband_pm_unknown_counter"),
+			Type:   dto.MetricType_UNTYPED.Enum(),
+			Metric: []*dto.Metric{{Label: label, Untyped: &dto.Untyped{Value: proto.Float64(7)}}},
+		},
+		{
+			Name:   proto.String("infiniband_exporter_scrape_seconds"),
+			Type:   dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{{Histogram: &dto.Histogram{SampleCount: proto.Uint64(1)}}},
+		},
+	}
+}
+
+func isLinkDownCounter(name string) bool {
+	return name == "infiniband_link_down_counter"
+}
+
+func TestEncodeOtlpRequest(t *testing.T) {
+	created := time.Date(2025, 4, 1, 1, 0, 0, 0, time.UTC)
+	now := created.Add(2 * time.Hour)
+	request := &collectormetrics.ExportMetricsServiceRequest{}
+	if err := proto.Unmarshal(EncodeOtlpRequest(otlpMetricFamilies(created), otlpResource, isLinkDownCounter, now), request); err != nil {
+		t.Fatal(err)
+	}
+	if len(request.ResourceMetrics) != 1 || len(request.ResourceMetrics[0].ScopeMetrics) != 1 {
+		t.Fatalf("expected one resource and one scope, got %v", request)
+	}
+	attributes := make(map[string]string)
+	for _, attribute := range request.ResourceMetrics[0].Resource.Attributes {
+		attributes[attribute.Key] = attribute.Value.GetStringValue()
+	}
+	for key, value := range otlpResource {
+		if attributes[key] != value {
+			t.Errorf("resource attribute %s is %q, expected %q", key, attributes[key], value)
+		}
+	}
+	scope := request.ResourceMetrics[0].ScopeMetrics[0]
+	if scope.Scope.GetName() != "infiniband_exporter" {
+		t.Errorf("scope %q", scope.Scope.GetName())
+	}
+
+	got := make(map[string]*metrics.Metric)
+	for _, metric := range scope.Metrics {
+		got[metric.Name] = metric
+	}
+	for _, test := range []struct {
+		name      string
+		sum       bool
+		value     float64
+		start     time.Time
+		timestamp time.Time
+	}{
+		{"infiniband_pm_port_xmit_data_extended", true, 1024, created, now},
+		{"infiniband_link_down_counter", true, 3, time.Time{}, now},
+		{"infiniband_sm_master_count", false, 1, time.Time{}, created.Add(time.Hour)},
+		{"infiniband_pm_unknown_counter", false, 7, time.Time{}, now},
+	} {
+		metric, exists := got[test.name]
+		if !exists {
+			t.Errorf("%s missing", test.name)
+			continue
+		}
+		var points []*metrics.NumberDataPoint
+		if test.sum {
+			sum := metric.GetSum()
+			if sum == nil {
+				t.Errorf("%s is not a sum", test.name)
+				continue
+			}
+			if sum.AggregationTemporality != metrics.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE || !sum.IsMonotonic {
+				t.Errorf("%s is %s, monotonic %v", test.name, sum.AggregationTemporality, sum.IsMonotonic)
+			}
+			points = sum.DataPoints
+		} else {
+			if metric.GetGauge() == nil {
+				t.Errorf("%s is not a gauge", test.name)
+				continue
+			}
+			points = metric.GetGauge().DataPoints
+		}
+		if len(points) != 1 {
+			t.Errorf("%s has %d points", test.name, len(points))
+			continue
+		}
+		point := points[0]
+		if point.GetAsDouble() != test.value {
+			t.Errorf("%s value %v, expected %v", test.name, point.GetAsDouble(), test.value)
+		}
+		var start uint64
+		if !test.start.IsZero() {
+			start = uint64(test.start.UnixNano())
+		}
+		if point.StartTimeUnixNano != start {
+			t.Errorf("%s start_time_unix_nano %d, expected %d", test.name, point.StartTimeUnixNano, start)
+		}
+		if point.TimeUnixNano != uint64(test.timestamp.UnixNano()) {
+			t.Errorf("%s time_unix_nano %d, expected %d", test.name, point.TimeUnixNano, test.timestamp.UnixNano())
+		}
+	}
+	if len(got) != 4 {
+		t.Errorf("expected the histogram left out, got %d metrics", len(got))
+	}
+	if metric := got["infiniband_pm_port_xmit_data_extended"]; metric != nil {
+		if metric.Description != "port_xmit_data_extended" {
+			t.Errorf("description %q", metric.Description)
+		}
+		if attributes := metric.GetSum().DataPoints[0].Attributes; len(attributes) != 1 || attributes[0].Key != "remoteGuid" {
+			t.Errorf("attributes %v", attributes)
+		}
+	}
+}
+
+func TestOtlpExporterHttp(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/otlp/v1/metrics" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("unexpected request %s %v", r.URL.Path, r.Header)
+		}
+		body, _ := io.ReadAll(r.Body)
+		if err := proto.Unmarshal(body, &collectormetrics.ExportMetricsServiceRequest{}); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+	exporter := &OtlpExporter{Endpoint: server.URL + "/otlp/", Protocol: "http", Timeout: time.Second}
+	if err := exporter.Send(otlpMetricFamilies(time.Now()), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newGrpcServer stands in for the gRPC metrics service over h2c, checking the
+// message framing and answering with respond.
+func newGrpcServer(t *testing.T, respond func(w http.ResponseWriter)) *httptest.Server {
+	t.Helper()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.URL.Path != otlpGrpcPath || r.Header.Get("Content-Type") != "application/grpc" {
+			t.Errorf("unexpected request %s %s %v", r.Proto, r.URL.Path, r.Header)
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil || len(body) < 5 {
+			t.Fatalf("read message: %v, %d bytes", err, len(body))
+		}
+		if body[0] != 0 {
+			t.Errorf("compressed flag %d", body[0])
+		}
+		if length := binary.BigEndian.Uint32(body[1:5]); int(length) != len(body)-5 {
+			t.Errorf("length prefix %d, message of %d bytes", length, len(body)-5)
+		}
+		if err := proto.Unmarshal(body[5:], &collectormetrics.ExportMetricsServiceRequest{}); err != nil {
+			t.Error(err)
+		}
+		respond(w)
+	}))
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetHTTP1(true)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestOtlpExporterGrpc(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		respond func(w http.ResponseWriter)
+		err     string
+	}{
+		{
+			"ok",
+			func(w http.ResponseWriter) {
+				w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+				w.Header().Set("Content-Type", "application/grpc")
+				w.Write([]byte{0, 0, 0, 0, 0})
+				w.Header().Set("Grpc-Status", "0")
+			},
+			"",
+		},
+		{
+			"status in trailer",
+			func(w http.ResponseWriter) {
+				w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+				w.Header().Set("Content-Type", "application/grpc")
+				w.WriteHeader(http.StatusOK)
+				w.Header().Set("Grpc-Status", "3")
+				w.Header().Set("Grpc-Message", "invalid metric")
+			},
+			"status 3: invalid metric",
+		},
+		{
+			"trailers only",
+			func(w http.ResponseWriter) {
+				w.Header().Set("Content-Type", "application/grpc")
+				w.Header().Set("Grpc-Status", "14")
+				w.Header().Set("Grpc-Message", "unavailable")
+				w.WriteHeader(http.StatusOK)
+			},
+			"status 14: unavailable",
+		},
+		{
+			"http error",
+			func(w http.ResponseWriter) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			},
+			"http 503",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			server := newGrpcServer(t, test.respond)
+			exporter := &OtlpExporter{Endpoint: server.URL, Protocol: "grpc", Timeout: time.Second}
+			err := exporter.Send(otlpMetricFamilies(time.Now()), time.Now())
+			if test.err == "" && err != nil {
+				t.Errorf("unexpected error %s", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("error %v, expected %q", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package push
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Pushgateway replaces the metrics of the Job group, further grouped by
+// Grouping, e.g. fabric, on a Pushgateway with every snapshot.
+type Pushgateway struct {
+	URL      string
+	Job      string
+	Grouping map[string]string
+	Timeout  time.Duration
+}
+
+// Send pushes metricFamilies without their timestamps, which the
+// Pushgateway refuses.
+func (p *Pushgateway) Send(metricFamilies []*dto.MetricFamily, now time.Time) error {
+	var unstamped []*dto.MetricFamily
+	for _, metricFamily := range metricFamilies {
+		family := &dto.MetricFamily{Name: metricFamily.Name, Help: metricFamily.Help, Type: metricFamily.Type}
+		for _, metric := range metricFamily.Metric {
+			family.Metric = append(family.Metric, &dto.Metric{
+				Label:   metric.Label,
+				Gauge:   metric.Gauge,
+				Counter: metric.Counter,
+				Untyped: metric.Untyped,
+			})
+		}
+		unstamped = append(unstamped, family)
+	}
+	pusher := push.New(p.URL, p.Job).Gatherer(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return unstamped, nil
+	}))
+	for name, value := range p.Grouping {
+		pusher = pusher.Grouping(name, value)
+	}
+	if p.Timeout > 0 {
+		pusher = pusher.Client(&http.Client{Timeout: p.Timeout})
+	}
+	return pusher.Push()
+}
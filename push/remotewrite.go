@@ -0,0 +1,429 @@
+package push
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	queuePrefix = "write-"
+	queueSuffix = ".pb.snappy"
+)
+
+// The backoff between two attempts doubles from minBackoff up to maxBackoff.
+// A Send stops retrying once it has taken sendTimeout, so that an endpoint
+// down for long does not hold back the next collection, and queues what is
+// left.
+var (
+	minBackoff  = time.Second
+	maxBackoff  = 30 * time.Second
+	sendTimeout = 2 * time.Minute
+)
+
+// RemoteWriter sends snapshots to a Prometheus remote write endpoint, as
+// snappy compressed WriteRequest protobufs. A snapshot that cannot be sent
+// after Retries attempts is queued in QueueDir and sent, oldest first, before
+// the next one. Zero limits disable the corresponding rule.
+type RemoteWriter struct {
+	URL      string
+	Timeout  time.Duration
+	Retries  int
+	QueueDir string
+	MaxQueue int
+	// Labels are added to every series, e.g. fabric.
+	Labels map[string]string
+}
+
+// Label is a remote write label.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// TimeSeries is a remote write series, its Labels sorted by name.
+type TimeSeries struct {
+	Labels      []Label
+	Value       float64
+	TimestampMs int64
+}
+
+// Send sends the queued snapshots then metricFamilies, stamped with now
+// when they carry no timestamp.
+func (w *RemoteWriter) Send(metricFamilies []*dto.MetricFamily, now time.Time) error {
+	payload := snappy.Encode(nil, EncodeWriteRequest(ToTimeSeries(metricFamilies, w.Labels, now)))
+	deadline := time.Now().Add(sendTimeout)
+	err := w.flushQueue(deadline)
+	if err == nil {
+		err = w.send(payload, deadline)
+	}
+	if err == nil || !retryable(err) || w.QueueDir == "" {
+		return err
+	}
+	if queueErr := w.enqueue(payload, now); queueErr != nil {
+		return fmt.Errorf("%w, queue: %s", err, queueErr)
+	}
+	return err
+}
+
+// Queued returns the number of snapshots waiting in the queue.
+func (w *RemoteWriter) Queued() (int, error) {
+	queued, err := w.queue()
+	return len(queued), err
+}
+
+// flushQueue sends the queued snapshots, oldest first, stopping at the first
+// one that fails for a reason worth retrying or at deadline.
+func (w *RemoteWriter) flushQueue(deadline time.Time) error {
+	queued, err := w.queue()
+	if err != nil {
+		return err
+	}
+	for i, path := range queued {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("remote write queue not flushed within %s, %d snapshots left", sendTimeout, len(queued)-i)
+		}
+		payload, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := w.send(payload, deadline); err != nil && retryable(err) {
+			return err
+		}
+		// A snapshot the endpoint refuses is dropped, it would be refused
+		// again.
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queue returns the queued snapshots, oldest first.
+func (w *RemoteWriter) queue() ([]string, error) {
+	if w.QueueDir == "" {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(w.QueueDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var queued []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && strings.HasPrefix(name, queuePrefix) && strings.HasSuffix(name, queueSuffix) {
+			queued = append(queued, filepath.Join(w.QueueDir, name))
+		}
+	}
+	// The names hold a fixed width timestamp.
+	sort.Strings(queued)
+	return queued, nil
+}
+
+// enqueue keeps payload for a later Send, dropping the oldest snapshots
+// beyond MaxQueue.
+func (w *RemoteWriter) enqueue(payload []byte, now time.Time) error {
+	if err := os.MkdirAll(w.QueueDir, 0755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s%020d%s", queuePrefix, now.UnixNano(), queueSuffix)
+	tmpFile, err := os.CreateTemp(w.QueueDir, name+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(payload); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile.Name(), filepath.Join(w.QueueDir, name)); err != nil {
+		return err
+	}
+	queued, err := w.queue()
+	if err != nil {
+		return err
+	}
+	for w.MaxQueue > 0 && len(queued) > w.MaxQueue {
+		if err := os.Remove(queued[0]); err != nil {
+			return err
+		}
+		queued = queued[1:]
+	}
+	return nil
+}
+
+// statusError is a response of the remote write endpoint other than 2xx.
+type statusError struct {
+	status int
+	body   string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("remote write returned %d: %s", e.status, e.body)
+}
+
+// retryable tells whether a failed send may succeed later: a network error,
+// a 5xx or a 429. Any other status means the endpoint refuses the payload.
+func retryable(err error) bool {
+	if statusErr, ok := err.(*statusError); ok {
+		return statusErr.status >= 500 || statusErr.status == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// send posts payload, retrying with a doubling backoff until deadline.
+func (w *RemoteWriter) send(payload []byte, deadline time.Time) error {
+	client := &http.Client{Timeout: w.Timeout}
+	backoff := minBackoff
+	var err error
+	for attempt := 0; attempt <= w.Retries; attempt++ {
+		if attempt > 0 {
+			if time.Now().Add(backoff).After(deadline) {
+				return err
+			}
+			time.Sleep(backoff)
+			backoff = min(backoff*2, maxBackoff)
+		}
+		if err = post(client, w.URL, payload); err == nil || !retryable(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func post(client *http.Client, url string, payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "infiniband-exporter")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return &statusError{status: resp.StatusCode, body: strings.TrimSpace(string(body))}
+}
+
+// ToTimeSeries flattens metricFamilies into remote write series, adding
+// labels to each of them unless the metric has a label of the same name.
+// Summaries and histograms are split into their quantile or _bucket series,
+// _sum and _count, as Prometheus scrapes them.
+func ToTimeSeries(metricFamilies []*dto.MetricFamily, labels map[string]string, now time.Time) []TimeSeries {
+	var series []TimeSeries
+	for _, metricFamily := range metricFamilies {
+		name := metricFamily.GetName()
+		for _, metric := range metricFamily.Metric {
+			timestampMs := now.UnixMilli()
+			if metric.TimestampMs != nil {
+				timestampMs = metric.GetTimestampMs()
+			}
+			add := func(name string, value float64, extra ...Label) {
+				series = append(series, TimeSeries{Labels: seriesLabels(name, metric, labels, extra), Value: value, TimestampMs: timestampMs})
+			}
+			switch {
+			case metric.Gauge != nil:
+				add(name, metric.Gauge.GetValue())
+			case metric.Counter != nil:
+				add(name, metric.Counter.GetValue())
+			case metric.Untyped != nil:
+				add(name, metric.Untyped.GetValue())
+			case metric.Summary != nil:
+				for _, quantile := range metric.Summary.Quantile {
+					add(name, quantile.GetValue(), Label{"quantile", formatFloat(quantile.GetQuantile())})
+				}
+				add(name+"_sum", metric.Summary.GetSampleSum())
+				add(name+"_count", float64(metric.Summary.GetSampleCount()))
+			case metric.Histogram != nil:
+				infinite := false
+				for _, bucket := range metric.Histogram.Bucket {
+					infinite = infinite || math.IsInf(bucket.GetUpperBound(), 1)
+					add(name+"_bucket", float64(bucket.GetCumulativeCount()), Label{"le", formatFloat(bucket.GetUpperBound())})
+				}
+				// The +Inf bucket is implicit in the client, required by
+				// Prometheus.
+				if !infinite {
+					add(name+"_bucket", float64(metric.Histogram.GetSampleCount()), Label{"le", "+Inf"})
+				}
+				add(name+"_sum", metric.Histogram.GetSampleSum())
+				add(name+"_count", float64(metric.Histogram.GetSampleCount()))
+			}
+		}
+	}
+	return series
+}
+
+// seriesLabels returns the labels of the series name of metric, with extra
+// and the ones of labels the metric lacks, sorted by name.
+func seriesLabels(name string, metric *dto.Metric, labels map[string]string, extra []Label) []Label {
+	result := []Label{{"__name__", name}}
+	names := make(map[string]bool)
+	for _, label := range metric.Label {
+		result = append(result, Label{label.GetName(), label.GetValue()})
+		names[label.GetName()] = true
+	}
+	result = append(result, extra...)
+	for labelName, labelValue := range labels {
+		if !names[labelName] {
+			result = append(result, Label{labelName, labelValue})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// formatFloat formats a quantile or bucket bound the way Prometheus does,
+// e.g. 0.5 or +Inf.
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// EncodeWriteRequest encodes series as a prometheus.WriteRequest:
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label        { string name = 1; string value = 2; }
+//	Sample       { double value = 1; int64 timestamp = 2; }
+func EncodeWriteRequest(series []TimeSeries) []byte {
+	var buf []byte
+	for _, s := range series {
+		var seriesBuf []byte
+		for _, label := range s.Labels {
+			var labelBuf []byte
+			labelBuf = protowire.AppendTag(labelBuf, 1, protowire.BytesType)
+			labelBuf = protowire.AppendString(labelBuf, label.Name)
+			labelBuf = protowire.AppendTag(labelBuf, 2, protowire.BytesType)
+			labelBuf = protowire.AppendString(labelBuf, label.Value)
+			seriesBuf = protowire.AppendTag(seriesBuf, 1, protowire.BytesType)
+			seriesBuf = protowire.AppendBytes(seriesBuf, labelBuf)
+		}
+		var sampleBuf []byte
+		sampleBuf = protowire.AppendTag(sampleBuf, 1, protowire.Fixed64Type)
+		sampleBuf = protowire.AppendFixed64(sampleBuf, math.Float64bits(s.Value))
+		sampleBuf = protowire.AppendTag(sampleBuf, 2, protowire.VarintType)
+		sampleBuf = protowire.AppendVarint(sampleBuf, uint64(s.TimestampMs))
+		seriesBuf = protowire.AppendTag(seriesBuf, 2, protowire.BytesType)
+		seriesBuf = protowire.AppendBytes(seriesBuf, sampleBuf)
+		buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, seriesBuf)
+	}
+	return buf
+}
+
+// DecodeWriteRequest reads back a snappy compressed WriteRequest, one
+// TimeSeries per sample, to check what RemoteWriter posts.
+func DecodeWriteRequest(payload []byte) ([]TimeSeries, error) {
+	buf, err := snappy.Decode(nil, payload)
+	if err != nil {
+		return nil, err
+	}
+	var series []TimeSeries
+	err = decodeFields(buf, func(number protowire.Number, value []byte) error {
+		if number != 1 {
+			return nil
+		}
+		var labels []Label
+		var samples []TimeSeries
+		err := decodeFields(value, func(number protowire.Number, value []byte) error {
+			switch number {
+			case 1:
+				var label Label
+				err := decodeFields(value, func(number protowire.Number, value []byte) error {
+					switch number {
+					case 1:
+						label.Name = string(value)
+					case 2:
+						label.Value = string(value)
+					}
+					return nil
+				})
+				labels = append(labels, label)
+				return err
+			case 2:
+				var sample TimeSeries
+				err := decodeFields(value, func(number protowire.Number, value []byte) error {
+					switch number {
+					case 1:
+						bits, n := protowire.ConsumeFixed64(value)
+						if n < 0 {
+							return protowire.ParseError(n)
+						}
+						sample.Value = math.Float64frombits(bits)
+					case 2:
+						timestamp, n := protowire.ConsumeVarint(value)
+						if n < 0 {
+							return protowire.ParseError(n)
+						}
+						sample.TimestampMs = int64(timestamp)
+					}
+					return nil
+				})
+				samples = append(samples, sample)
+				return err
+			}
+			return nil
+		})
+		for _, sample := range samples {
+			sample.Labels = labels
+			series = append(series, sample)
+		}
+		return err
+	})
+	return series, err
+}
+
+// decodeFields calls fn with every field of a protobuf message. Length
+// delimited fields are passed their content, the other ones their raw
+// encoding.
+func decodeFields(buf []byte, fn func(protowire.Number, []byte) error) error {
+	for len(buf) > 0 {
+		number, fieldType, n := protowire.ConsumeTag(buf)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		buf = buf[n:]
+		var value []byte
+		if fieldType == protowire.BytesType {
+			value, n = protowire.ConsumeBytes(buf)
+		} else {
+			n = protowire.ConsumeFieldValue(number, fieldType, buf)
+			value = buf[:max(n, 0)]
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		buf = buf[n:]
+		if err := fn(number, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
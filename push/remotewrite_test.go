@@ -0,0 +1,256 @@
+package push
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// writeServer stands in for a remote write endpoint, answering the statuses
+// in turn, then 204, and keeping the series of every request it accepts.
+type writeServer struct {
+	*httptest.Server
+	lock     sync.Mutex
+	statuses []int
+	requests int
+	received [][]TimeSeries
+}
+
+func newWriteServer(t *testing.T, statuses ...int) *writeServer {
+	t.Helper()
+	s := &writeServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.requests++
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+		if len(s.statuses) > 0 {
+			status := s.statuses[0]
+			s.statuses = s.statuses[1:]
+			if status/100 != 2 {
+				http.Error(w, http.StatusText(status), status)
+				return
+			}
+		}
+		payload, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("read body: %s", err)
+		}
+		series, err := DecodeWriteRequest(payload)
+		if err != nil {
+			t.Errorf("decode write request: %s", err)
+		}
+		s.received = append(s.received, series)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func testMetricFamilies(value float64) []*dto.MetricFamily {
+	return []*dto.MetricFamily{
+		{
+			Name: proto.String("infiniband_pm_port_rcv_data_extended_total"),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{{
+				Label: []*dto.LabelPair{
+					{Name: proto.String("remotePort"), Value: proto.String("1")},
+					{Name: proto.String("remoteGuid"), Value: proto.String("0xb0cf0e0300d33fc0")},
+				},
+				Counter: &dto.Counter{Value: proto.Float64(value)},
+			}},
+		},
+		{
+			Name: proto.String("infiniband_sm_master_count"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{
+				Label:       []*dto.LabelPair{{Name: proto.String("fabric"), Value: proto.String("own")}},
+				Gauge:       &dto.Gauge{Value: proto.Float64(1)},
+				TimestampMs: proto.Int64(1743469200000),
+			}},
+		},
+	}
+}
+
+func TestRemoteWriterSend(t *testing.T) {
+	server := newWriteServer(t)
+	writer := &RemoteWriter{URL: server.URL, Timeout: time.Second, Labels: map[string]string{"fabric": "cherry"}}
+	now := time.UnixMilli(1743469260000)
+	if err := writer.Send(testMetricFamilies(42), now); err != nil {
+		t.Fatal(err)
+	}
+	expected := []TimeSeries{
+		{
+			Labels: []Label{
+				{"__name__", "infiniband_pm_port_rcv_data_extended_total"},
+				{"fabric", "cherry"},
+				{"remoteGuid", "0xb0cf0e0300d33fc0"},
+				{"remotePort", "1"},
+			},
+			Value:       42,
+			TimestampMs: now.UnixMilli(),
+		},
+		{
+			// The label of the metric wins, its timestamp is kept.
+			Labels:      []Label{{"__name__", "infiniband_sm_master_count"}, {"fabric", "own"}},
+			Value:       1,
+			TimestampMs: 1743469200000,
+		},
+	}
+	if len(server.received) != 1 || !reflect.DeepEqual(server.received[0], expected) {
+		t.Errorf("received %+v, expected %+v", server.received, expected)
+	}
+}
+
+func TestRemoteWriterStatus(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		statuses []int
+		retries  int
+		err      bool
+		requests int
+		queued   int
+	}{
+		{"retry 5xx", []int{http.StatusServiceUnavailable}, 1, false, 2, 0},
+		{"retry 429", []int{http.StatusTooManyRequests}, 1, false, 2, 0},
+		{"queue 5xx", []int{http.StatusInternalServerError}, 0, true, 1, 1},
+		{"drop 4xx", []int{http.StatusBadRequest}, 1, true, 1, 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			server := newWriteServer(t, test.statuses...)
+			writer := &RemoteWriter{URL: server.URL, Timeout: time.Second, Retries: test.retries, QueueDir: t.TempDir()}
+			err := writer.Send(testMetricFamilies(1), time.Now())
+			if (err != nil) != test.err {
+				t.Errorf("error %v, expected one: %v", err, test.err)
+			}
+			if server.requests != test.requests {
+				t.Errorf("%d requests, expected %d", server.requests, test.requests)
+			}
+			queued, err := writer.Queued()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if queued != test.queued {
+				t.Errorf("%d queued, expected %d", queued, test.queued)
+			}
+		})
+	}
+}
+
+// TestRemoteWriterBackoff checks that the backoff stops doubling at
+// maxBackoff and that a Send gives up retrying after sendTimeout, queueing
+// the snapshot.
+func TestRemoteWriterBackoff(t *testing.T) {
+	defaults := []time.Duration{minBackoff, maxBackoff, sendTimeout}
+	minBackoff, maxBackoff, sendTimeout = 10*time.Millisecond, 20*time.Millisecond, 200*time.Millisecond
+	t.Cleanup(func() {
+		minBackoff, maxBackoff, sendTimeout = defaults[0], defaults[1], defaults[2]
+	})
+	down := make([]int, 100)
+	for i := range down {
+		down[i] = http.StatusServiceUnavailable
+	}
+	server := newWriteServer(t, down...)
+	writer := &RemoteWriter{URL: server.URL, Timeout: time.Second, Retries: len(down), QueueDir: t.TempDir()}
+	start := time.Now()
+	if err := writer.Send(testMetricFamilies(1), start); err == nil {
+		t.Fatal("send succeeded while the endpoint is down")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("send took %s, expected about %s", elapsed, sendTimeout)
+	}
+	// A doubling backoff alone would leave time for 5 attempts.
+	if server.requests <= 5 || server.requests >= len(down) {
+		t.Errorf("%d requests, expected one every %s within %s", server.requests, maxBackoff, sendTimeout)
+	}
+	if queued, _ := writer.Queued(); queued != 1 {
+		t.Errorf("%d queued, expected 1", queued)
+	}
+}
+
+func TestRemoteWriterQueue(t *testing.T) {
+	down := http.StatusServiceUnavailable
+	server := newWriteServer(t, down, down, down)
+	writer := &RemoteWriter{URL: server.URL, Timeout: time.Second, QueueDir: t.TempDir(), MaxQueue: 2}
+	start := time.UnixMilli(1743469200000)
+	for i := 0; i < 3; i++ {
+		if err := writer.Send(testMetricFamilies(float64(i)), start.Add(time.Duration(i)*time.Minute)); err == nil {
+			t.Fatalf("send %d succeeded while the endpoint is down", i)
+		}
+	}
+	// The first snapshot is dropped beyond MaxQueue.
+	if queued, _ := writer.Queued(); queued != 2 {
+		t.Fatalf("%d queued, expected 2", queued)
+	}
+	if err := writer.Send(testMetricFamilies(3), start.Add(3*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if queued, _ := writer.Queued(); queued != 0 {
+		t.Errorf("%d still queued", queued)
+	}
+	var values []float64
+	for _, series := range server.received {
+		values = append(values, series[0].Value)
+	}
+	if expected := []float64{1, 2, 3}; !reflect.DeepEqual(values, expected) {
+		t.Errorf("received values %v, expected the queue drained oldest first %v", values, expected)
+	}
+}
+
+func TestToTimeSeriesSummaryHistogram(t *testing.T) {
+	metricFamilies := []*dto.MetricFamily{
+		{
+			Name: proto.String("infiniband_collect_seconds"),
+			Type: dto.MetricType_SUMMARY.Enum(),
+			Metric: []*dto.Metric{{
+				Summary: &dto.Summary{
+					SampleCount: proto.Uint64(4),
+					SampleSum:   proto.Float64(10),
+					Quantile:    []*dto.Quantile{{Quantile: proto.Float64(0.5), Value: proto.Float64(2)}},
+				},
+			}},
+		},
+		{
+			Name: proto.String("infiniband_push_seconds"),
+			Type: dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{{
+				Label: []*dto.LabelPair{{Name: proto.String("target"), Value: proto.String("otlp")}},
+				Histogram: &dto.Histogram{
+					SampleCount: proto.Uint64(3),
+					SampleSum:   proto.Float64(1.5),
+					Bucket:      []*dto.Bucket{{UpperBound: proto.Float64(0.25), CumulativeCount: proto.Uint64(1)}},
+				},
+			}},
+		},
+	}
+	var values []string
+	for _, series := range ToTimeSeries(metricFamilies, nil, time.UnixMilli(1743469260000)) {
+		value := ""
+		for _, label := range series.Labels {
+			value += label.Name + "=" + label.Value + " "
+		}
+		values = append(values, value+strconv.FormatFloat(series.Value, 'g', -1, 64))
+	}
+	expected := []string{
+		"__name__=infiniband_collect_seconds quantile=0.5 2",
+		"__name__=infiniband_collect_seconds_sum 10",
+		"__name__=infiniband_collect_seconds_count 4",
+		"__name__=infiniband_push_seconds_bucket le=0.25 target=otlp 1",
+		"__name__=infiniband_push_seconds_bucket le=+Inf target=otlp 3",
+		"__name__=infiniband_push_seconds_sum target=otlp 1.5",
+		"__name__=infiniband_push_seconds_count target=otlp 3",
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("series\n%q, expected\n%q", values, expected)
+	}
+}
@@ -0,0 +1,89 @@
+package push
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Sink receives the snapshot of every collection, the metric families
+// /metrics serves, so that one ibdiagnet run feeds several systems.
+type Sink interface {
+	Send(metricFamilies []*dto.MetricFamily, now time.Time) error
+}
+
+// Series is one sample, as printed by the parse subcommand and written by
+// JSONSink.
+type Series struct {
+	Name   string            `json:"name"`
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+	// TimestampMs is set for the samples stamped with their ibdiagnet run.
+	TimestampMs int64 `json:"timestampMs,omitempty"`
+}
+
+// ToSeries flattens metricFamilies, histograms and summaries having no
+// single value.
+func ToSeries(metricFamilies []*dto.MetricFamily) []Series {
+	seriesList := []Series{}
+	for _, metricFamily := range metricFamilies {
+		for _, metric := range metricFamily.Metric {
+			series := Series{
+				Name:        metricFamily.GetName(),
+				Type:        strings.ToLower(metricFamily.GetType().String()),
+				Labels:      make(map[string]string),
+				TimestampMs: metric.GetTimestampMs(),
+			}
+			for _, label := range metric.Label {
+				series.Labels[label.GetName()] = label.GetValue()
+			}
+			switch {
+			case metric.Gauge != nil:
+				series.Value = metric.Gauge.GetValue()
+			case metric.Counter != nil:
+				series.Value = metric.Counter.GetValue()
+			case metric.Untyped != nil:
+				series.Value = metric.Untyped.GetValue()
+			}
+			seriesList = append(seriesList, series)
+		}
+	}
+	return seriesList
+}
+
+// withLabels returns labels with the ones of extra the series lacks.
+func withLabels(labels map[string]string, extra map[string]string) map[string]string {
+	for name, value := range extra {
+		if _, exists := labels[name]; !exists {
+			labels[name] = value
+		}
+	}
+	return labels
+}
+
+// fileLock keeps the snapshots written by concurrent collections from
+// interleaving.
+var fileLock sync.Mutex
+
+// appendFile appends payload to path, or writes it to stdout when path is -.
+func appendFile(path string, payload []byte) error {
+	fileLock.Lock()
+	defer fileLock.Unlock()
+	if path == "-" {
+		_, err := os.Stdout.Write(payload)
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(payload); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
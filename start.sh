@@ -2,9 +2,11 @@
 
 go build .
 
-# ./infiniband_exporter -w $(pwd) -m dev -g true
+# ./infiniband_exporter config generate data/ibdiagnet2 -c config/config.yaml --write
 
 # cp ./config/sequoia_config.yaml ./config/config.yaml
 # cp ./config/sequoia_default.yaml ./config/default.yaml
 
+# ./infiniband_exporter --config.file config/exporter.yaml
+
 ./infiniband_exporter -w $(pwd) -m dev
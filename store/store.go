@@ -0,0 +1,226 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Version is bumped whenever the layout of State changes incompatibly.
+const Version = 1
+
+var (
+	state     = newState()
+	statePath string
+	stateLock sync.RWMutex
+	// MaxAge is how long Expire keeps the nodes and ports no run saw, 0 to
+	// keep them forever.
+	MaxAge time.Duration
+)
+
+// State is everything the exporter remembers between restarts. Collectors
+// keep their derived history in Sections under their own name.
+type State struct {
+	Version  int                        `json:"version"`
+	SavedAt  time.Time                  `json:"savedAt"`
+	Nodes    map[string]*Node           `json:"nodes"`
+	Ports    map[string]*Port           `json:"ports"`
+	Sections map[string]json.RawMessage `json:"sections"`
+}
+
+type Node struct {
+	Guid      string    `json:"guid"`
+	Name      string    `json:"name"`
+	Component string    `json:"component"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+type Port struct {
+	Guid      string    `json:"guid"`
+	Port      string    `json:"port"`
+	State     string    `json:"state"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+func newState() *State {
+	return &State{
+		Version:  Version,
+		Nodes:    make(map[string]*Node),
+		Ports:    make(map[string]*Port),
+		Sections: make(map[string]json.RawMessage),
+	}
+}
+
+// Load reads the state file at path, which is also where Save writes. A
+// missing file starts an empty state.
+func Load(path string) error {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	statePath = path
+	state = newState()
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	loaded := newState()
+	if err := json.Unmarshal(content, loaded); err != nil {
+		return fmt.Errorf("decode state file %s: %w", path, err)
+	}
+	if loaded.Version > Version {
+		return fmt.Errorf("state file %s has version %d, newer than %d", path, loaded.Version, Version)
+	}
+	loaded.Version = Version
+	state = loaded
+	return nil
+}
+
+// Save writes the state atomically, through a temporary file renamed over
+// the previous one.
+func Save() error {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	if statePath == "" {
+		return nil
+	}
+	state.SavedAt = time.Now()
+	content, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(statePath), 0755); err != nil {
+		return err
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(statePath), filepath.Base(statePath)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(content); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), statePath)
+}
+
+// GetSection decodes the named section into v, leaving v untouched when the
+// section does not exist.
+func GetSection(name string, v any) error {
+	stateLock.RLock()
+	defer stateLock.RUnlock()
+	raw, exists := state.Sections[name]
+	if !exists {
+		return nil
+	}
+	return json.Unmarshal(raw, v)
+}
+
+func SetSection(name string, v any) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	state.Sections[name] = raw
+	return nil
+}
+
+// TouchNode records that the node was seen by the ibdiagnet run at t. Runs
+// may come out of order, e.g. replayed ones.
+func TouchNode(guid string, name string, component string, t time.Time) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	node, exists := state.Nodes[guid]
+	if !exists {
+		node = &Node{Guid: guid, FirstSeen: t}
+		state.Nodes[guid] = node
+	}
+	if t.Before(node.FirstSeen) {
+		node.FirstSeen = t
+	}
+	node.Name = name
+	node.Component = component
+	if t.After(node.LastSeen) {
+		node.LastSeen = t
+	}
+}
+
+// TouchPort records the state of the port seen by the ibdiagnet run at t.
+// The state of an older run than the last one is ignored.
+func TouchPort(guid string, port string, portState string, t time.Time) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	key := fmt.Sprintf("%s_%s", guid, port)
+	p, exists := state.Ports[key]
+	if !exists {
+		p = &Port{Guid: guid, Port: port, FirstSeen: t}
+		state.Ports[key] = p
+	}
+	if t.Before(p.FirstSeen) {
+		p.FirstSeen = t
+	}
+	if !t.Before(p.LastSeen) {
+		p.State = portState
+		p.LastSeen = t
+	}
+}
+
+// Expire drops the nodes and ports last seen more than MaxAge before the
+// ibdiagnet run at t, e.g. decommissioned ones, so that the state file does
+// not grow forever.
+func Expire(t time.Time) {
+	if MaxAge <= 0 {
+		return
+	}
+	before := t.Add(-MaxAge)
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	for guid, node := range state.Nodes {
+		if node.LastSeen.Before(before) {
+			delete(state.Nodes, guid)
+		}
+	}
+	for key, port := range state.Ports {
+		if port.LastSeen.Before(before) {
+			delete(state.Ports, key)
+		}
+	}
+}
+
+// GetNodes returns a copy of the known nodes keyed by GUID.
+func GetNodes() map[string]Node {
+	stateLock.RLock()
+	defer stateLock.RUnlock()
+	nodes := make(map[string]Node, len(state.Nodes))
+	for guid, node := range state.Nodes {
+		nodes[guid] = *node
+	}
+	return nodes
+}
+
+// GetPorts returns a copy of the known ports keyed by <guid>_<port>.
+func GetPorts() map[string]Port {
+	stateLock.RLock()
+	defer stateLock.RUnlock()
+	ports := make(map[string]Port, len(state.Ports))
+	for key, port := range state.Ports {
+		ports[key] = *port
+	}
+	return ports
+}
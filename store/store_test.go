@@ -0,0 +1,207 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+var runTime = time.Date(2025, 3, 31, 23, 43, 18, 0, time.UTC)
+
+type testSection struct {
+	RunTime time.Time          `json:"runTime"`
+	Values  map[string]float64 `json:"values"`
+}
+
+func TestSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data", "state.json")
+	if err := Load(path); err != nil {
+		t.Fatalf("missing state file: %s", err)
+	}
+	TouchNode("0xb0cf0e0300d33fc0", "SPAN01", "sw", runTime)
+	TouchPort("0xb0cf0e0300d33fc0", "1", "ACT", runTime)
+	section := testSection{RunTime: runTime, Values: map[string]float64{"0xb0cf0e0300d33fc0_1": 42}}
+	if err := SetSection("test", section); err != nil {
+		t.Fatal(err)
+	}
+	if err := Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Load(path); err != nil {
+		t.Fatal(err)
+	}
+	node := Node{Guid: "0xb0cf0e0300d33fc0", Name: "SPAN01", Component: "sw", FirstSeen: runTime, LastSeen: runTime}
+	if nodes := GetNodes(); !reflect.DeepEqual(nodes, map[string]Node{node.Guid: node}) {
+		t.Errorf("nodes %v, expected %v", nodes, node)
+	}
+	port := Port{Guid: "0xb0cf0e0300d33fc0", Port: "1", State: "ACT", FirstSeen: runTime, LastSeen: runTime}
+	if ports := GetPorts(); !reflect.DeepEqual(ports, map[string]Port{"0xb0cf0e0300d33fc0_1": port}) {
+		t.Errorf("ports %v, expected %v", ports, port)
+	}
+	var loaded testSection
+	if err := GetSection("test", &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, section) {
+		t.Errorf("section %v, expected %v", loaded, section)
+	}
+	// A missing section leaves the value untouched.
+	if err := GetSection("missing", &loaded); err != nil || !reflect.DeepEqual(loaded, section) {
+		t.Errorf("missing section changed %v: %v", loaded, err)
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("temporary files left: %v", entries)
+	}
+}
+
+func TestLoadError(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"corrupt", `{"version":1,"nodes":`, "decode state file"},
+		{"not an object", `[]`, "decode state file"},
+		{"newer version", `{"version":2}`, "has version 2, newer than 1"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "state.json")
+			if err := os.WriteFile(path, []byte(test.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			TouchNode("0xb0cf0e0300d33fc0", "SPAN01", "sw", runTime)
+			err := Load(path)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("error %v, expected %q", err, test.err)
+			}
+			// The exporter goes on with an empty state, saved over the bad
+			// file.
+			if nodes := GetNodes(); len(nodes) != 0 {
+				t.Errorf("state not empty: %v", nodes)
+			}
+			if err := Save(); err != nil {
+				t.Fatal(err)
+			}
+			if err := Load(path); err != nil {
+				t.Errorf("saved state unreadable: %s", err)
+			}
+		})
+	}
+}
+
+func TestLoadOlderVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	content := `{"version":0,"nodes":{"0xb0cf0e0300d33fc0":{"guid":"0xb0cf0e0300d33fc0","name":"SPAN01"}}}`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := GetNodes()["0xb0cf0e0300d33fc0"]; !exists {
+		t.Error("nodes of an older state file dropped")
+	}
+	// Sections missing from an older file can still be set.
+	if err := SetSection("test", testSection{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTouchPort(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		state string
+		t     time.Time
+		port  Port
+	}{
+		{
+			"newer run",
+			"DOWN", runTime.Add(time.Hour),
+			Port{State: "DOWN", FirstSeen: runTime, LastSeen: runTime.Add(time.Hour)},
+		},
+		{
+			"same run",
+			"DOWN", runTime,
+			Port{State: "DOWN", FirstSeen: runTime, LastSeen: runTime},
+		},
+		{
+			"older run",
+			"DOWN", runTime.Add(-time.Hour),
+			Port{State: "ACT", FirstSeen: runTime.Add(-time.Hour), LastSeen: runTime},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if err := Load(filepath.Join(t.TempDir(), "state.json")); err != nil {
+				t.Fatal(err)
+			}
+			TouchPort("0xb0cf0e0300d33fc0", "1", "ACT", runTime)
+			TouchPort("0xb0cf0e0300d33fc0", "1", test.state, test.t)
+			test.port.Guid, test.port.Port = "0xb0cf0e0300d33fc0", "1"
+			if port := GetPorts()["0xb0cf0e0300d33fc0_1"]; port != test.port {
+				t.Errorf("port %+v, expected %+v", port, test.port)
+			}
+		})
+	}
+}
+
+func TestTouchNode(t *testing.T) {
+	if err := Load(filepath.Join(t.TempDir(), "state.json")); err != nil {
+		t.Fatal(err)
+	}
+	TouchNode("0xb0cf0e0300d33fc0", "SPAN01", "sw", runTime)
+	TouchNode("0xb0cf0e0300d33fc0", "SPAN01-old", "sw", runTime.Add(-time.Hour))
+	node := GetNodes()["0xb0cf0e0300d33fc0"]
+	if !node.FirstSeen.Equal(runTime.Add(-time.Hour)) || !node.LastSeen.Equal(runTime) {
+		t.Errorf("node seen %s to %s, expected %s to %s", node.FirstSeen, node.LastSeen, runTime.Add(-time.Hour), runTime)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		maxAge time.Duration
+		kept   []string
+	}{
+		{"no max age", 0, []string{"0xb0cf0e0300d33fc0", "0xfc6a1c03008a4dc0", "0xfc6a1c030091cf00"}},
+		{"a day", 24 * time.Hour, []string{"0xb0cf0e0300d33fc0", "0xfc6a1c030091cf00"}},
+		{"an hour", time.Hour, []string{"0xb0cf0e0300d33fc0"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if err := Load(filepath.Join(t.TempDir(), "state.json")); err != nil {
+				t.Fatal(err)
+			}
+			MaxAge = test.maxAge
+			t.Cleanup(func() { MaxAge = 0 })
+			for guid, lastSeen := range map[string]time.Time{
+				"0xb0cf0e0300d33fc0": runTime,
+				"0xfc6a1c030091cf00": runTime.Add(-2 * time.Hour),
+				"0xfc6a1c03008a4dc0": runTime.Add(-48 * time.Hour),
+			} {
+				TouchNode(guid, "", "sw", lastSeen)
+				TouchPort(guid, "1", "ACT", lastSeen)
+			}
+			Expire(runTime)
+			var nodes, ports []string
+			for guid := range GetNodes() {
+				nodes = append(nodes, guid)
+			}
+			for _, port := range GetPorts() {
+				ports = append(ports, port.Guid)
+			}
+			for _, kept := range [][]string{nodes, ports} {
+				slices.Sort(kept)
+				if !slices.Equal(kept, test.kept) {
+					t.Errorf("kept %v, expected %v", kept, test.kept)
+				}
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package util
 
 import (
 	"bytes"
+	"encoding/csv"
 	"fmt"
 	"infiniband_exporter/log"
 	"io"
@@ -9,16 +10,19 @@ import (
 	"os/exec"
 	"reflect"
 	"regexp"
-	"slices"
 	"strings"
 	"sync"
-
-	"gopkg.in/yaml.v2"
+	"unicode"
 )
 
 var (
 	Cache     = make(map[string]map[string]string)
 	CacheLock sync.RWMutex
+	// cacheGuids holds the switch GUIDs of Cache and cacheLocal the keys of
+	// its entries by <localGuid>_<localPort> and by localGuid, both built by
+	// SetCache so that the port lookups do not walk the whole link map.
+	cacheGuids = make(map[string]bool)
+	cacheLocal = make(map[string]string)
 )
 
 func GetFieldNames(i any) []string {
@@ -61,23 +65,28 @@ func ReadFileContent(filename string) (string, error) {
 	return string(contentBytes), nil
 }
 
-func SetCache(configFilePath string) {
-	yamlFile, err := os.ReadFile(configFilePath)
-	if err != nil {
-		log.GetLogger().Error(fmt.Sprintf("Read yaml file error:%s", err))
-		os.Exit(1)
-	}
-	var linkMap map[string]map[string]string
-	err = yaml.Unmarshal(yamlFile, &linkMap)
-	if err != nil {
-		log.GetLogger().Error("Unmarshal yaml file error")
-		os.Exit(1)
+// SetCache replaces the link map, keyed by <guid>_<port>.
+func SetCache(linkMap map[string]map[string]string) {
+	guids := make(map[string]bool)
+	local := make(map[string]string)
+	for key, link := range linkMap {
+		guid, _, _ := strings.Cut(key, "_")
+		guids[guid] = true
+		localGuid := link["localGuid"]
+		if localGuid == "" {
+			continue
+		}
+		local[localGuid+"_"+link["localPort"]] = key
+		// The lowest key, for a port of a multi port CA to always get the
+		// same entry.
+		if existing, exists := local[localGuid]; !exists || key < existing {
+			local[localGuid] = key
+		}
 	}
-
 	CacheLock.Lock()
-	for k, v := range linkMap {
-		Cache[k] = v
-	}
+	Cache = linkMap
+	cacheGuids = guids
+	cacheLocal = local
 	CacheLock.Unlock()
 }
 
@@ -88,20 +97,42 @@ func GetValueFromCache(key string) (map[string]string, bool) {
 	return val, exists
 }
 
+// GetLocalFromCache returns the entry of the link map whose local end is the
+// port guid_port or, when there is none, another port of guid.
+func GetLocalFromCache(guid string, port string) (map[string]string, bool) {
+	CacheLock.RLock()
+	defer CacheLock.RUnlock()
+	key, exists := cacheLocal[guid+"_"+port]
+	if !exists {
+		key, exists = cacheLocal[guid]
+	}
+	if !exists {
+		return nil, false
+	}
+	return Cache[key], true
+}
+
+// CacheHasGuid reports whether guid has ports in the link map, that is
+// whether it is a switch.
+func CacheHasGuid(guid string) bool {
+	CacheLock.RLock()
+	defer CacheLock.RUnlock()
+	return cacheGuids[guid]
+}
+
+// GetKeysFromCache returns the switch GUIDs of the link map and whether guid
+// is one of them.
 func GetKeysFromCache(guid string) ([]string, bool) {
 	CacheLock.RLock()
 	defer CacheLock.RUnlock()
-	var guids []string
-	for key := range Cache {
-		keySplits := strings.Split(key, "_")
-		if !slices.Contains(guids, keySplits[0]) {
-			guids = append(guids, keySplits[0])
-		}
+	guids := make([]string, 0, len(cacheGuids))
+	for key := range cacheGuids {
+		guids = append(guids, key)
 	}
 	if guid == "" {
 		return guids, false
 	}
-	return guids, slices.Contains(guids, guid)
+	return guids, cacheGuids[guid]
 }
 
 func GetContent(filePath string, regexExpr string) (*[]string, error) {
@@ -123,6 +154,94 @@ func GetContent(filePath string, regexExpr string) (*[]string, error) {
 	return &blocks, nil
 }
 
+// GetCsvSection returns the rows between START_<section> and END_<section> of
+// an ibdiagnet2.db_csv file, keyed by the column names of the header row.
+// Readers of several sections share a DbCsv instead.
+func GetCsvSection(filePath string, section string) (*[]map[string]string, error) {
+	return NewDbCsv(filePath).Section(section)
+}
+
+// DbCsv is an ibdiagnet2.db_csv file, read and split into its sections once,
+// on first use, for every collector of a collection.
+type DbCsv struct {
+	path     string
+	once     sync.Once
+	err      error
+	sections map[string]string
+}
+
+func NewDbCsv(filePath string) *DbCsv {
+	return &DbCsv{path: filePath}
+}
+
+func (d *DbCsv) Path() string {
+	return d.path
+}
+
+// Section returns the rows between START_<section> and END_<section>, keyed
+// by the column names of the header row.
+func (d *DbCsv) Section(section string) (*[]map[string]string, error) {
+	d.once.Do(d.load)
+	if d.err != nil {
+		return nil, d.err
+	}
+	sectionContent, exists := d.sections[section]
+	if !exists {
+		return nil, fmt.Errorf("section %s not found in %s", section, d.path)
+	}
+	reader := csv.NewReader(strings.NewReader(sectionContent))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var rows []map[string]string
+	if len(records) == 0 {
+		return &rows, nil
+	}
+	header := records[0]
+	for _, record := range records[1:] {
+		row := make(map[string]string, len(header))
+		for i, column := range header {
+			if i < len(record) {
+				row[strings.TrimSpace(column)] = strings.TrimSpace(record[i])
+			}
+		}
+		rows = append(rows, row)
+	}
+	return &rows, nil
+}
+
+// load splits the file into its sections. An unterminated section is left
+// out.
+func (d *DbCsv) load() {
+	fileContent, err := ReadFileContent(d.path)
+	if err != nil {
+		log.GetLogger().Error("Read db csv file error")
+		d.err = err
+		return
+	}
+	d.sections = make(map[string]string)
+	for {
+		start := strings.Index(fileContent, "START_")
+		if start < 0 {
+			return
+		}
+		fileContent = fileContent[start+len("START_"):]
+		section, rest, found := strings.Cut(fileContent, "\n")
+		if !found {
+			return
+		}
+		end := strings.Index(rest, fmt.Sprintf("END_%s", section))
+		if end < 0 {
+			continue
+		}
+		d.sections[strings.TrimSpace(section)] = rest[:end]
+		fileContent = rest[end:]
+	}
+}
+
 func StringToBool(s string) (bool, error) {
 	switch strings.ToLower(strings.TrimSpace(s)) {
 	case "true", "1":
@@ -147,3 +266,22 @@ func DifferenceSlice[T comparable](a, b []T) []T {
 	}
 	return diff
 }
+
+// CamelToSnake converts db_csv column names such as PortVLXmitWait to
+// port_vl_xmit_wait.
+func CamelToSnake(s string) string {
+	runes := []rune(s)
+	var builder strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 && (unicode.IsLower(runes[i-1]) ||
+				(i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1]))) {
+				builder.WriteRune('_')
+			}
+			builder.WriteRune(unicode.ToLower(r))
+		} else {
+			builder.WriteRune(r)
+		}
+	}
+	return builder.String()
+}